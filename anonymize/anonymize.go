@@ -0,0 +1,283 @@
+// anonymize produces anonymized copies of Bibliofil database exports, to be
+// used as test data for migration, without disclosing personal data.
+//
+// input:
+//   laaner: database export from Bibliofil
+//   lmarc: database export from Bibliofil
+//   lnel: database export from Bibliofil
+//   exemp: database export from Bibliofil
+//   res: database export from Bibliofil
+//
+// output:
+//   the same files, with the same names, written to -outdir
+//
+// Names, addresses, emails, phone numbers, fnr, PINs, borrower notes and hold
+// notes are replaced by pseudonyms. Pseudonyms are derived from a keyed hash of
+// the original values, so that the same value gets the same pseudonym in all
+// files, and borrower numbers still link loans and holds to patrons. Use the
+// same key (-key) to get the same pseudonyms across runs. All files to be used
+// together must be anonymized in the same run. The structure of the dumps is
+// kept, so that the output can be given to patronmassage, catmassage and
+// res2sql.
+//
+// Any input file may be omitted.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/boutros/marc"
+)
+
+// anonymizer replaces personal data in Bibliofil records.
+type anonymizer struct {
+	ps *pseudonymizer
+}
+
+func newAnonymizer(key []byte) *anonymizer {
+	return &anonymizer{ps: newPseudonymizer(key)}
+}
+
+// laaner anonymizes a record from the laaner dump.
+func (a *anonymizer) laaner(rec map[string]string) {
+	for k, v := range rec {
+		switch k {
+		case "ln_nr":
+			rec[k] = a.ps.Borrowernr(v)
+		case "ln_navn":
+			rec[k] = a.ps.Name(v)
+		case "ln_adr1", "ln_adr2", "ln_arbg", "ln_altadr":
+			rec[k] = a.ps.Address(v)
+		case "ln_tlf":
+			rec[k] = a.ps.Phone(v)
+		case "ln_foedt":
+			rec[k] = a.ps.Date(v)
+		case "ln_melding":
+			rec[k] = a.ps.Text(v)
+		case "ln_alt_id":
+			rec[k] = a.ps.Digits(v)
+		}
+	}
+}
+
+// lnel anonymizes a record from the lnel dump.
+func (a *anonymizer) lnel(rec map[string]string) {
+	for k, v := range rec {
+		switch k {
+		case "lnel_nr":
+			rec[k] = a.ps.Borrowernr(v)
+		case "lnel_epost":
+			rec[k] = a.ps.Email(v)
+		case "lnel_pin":
+			rec[k] = a.ps.Digits(v)
+		}
+	}
+}
+
+// exemp anonymizes a record from the exemp dump; only the borrower
+// number of loaned items is personal data.
+func (a *anonymizer) exemp(rec map[string]string) {
+	if v, ok := rec["ex_laanr"]; ok {
+		rec["ex_laanr"] = a.ps.Borrowernr(v)
+	}
+}
+
+// res anonymizes a record from the res dump.
+func (a *anonymizer) res(rec map[string]string) {
+	if v, ok := rec["res_laanr"]; ok {
+		rec["res_laanr"] = a.ps.Borrowernr(v)
+	}
+	if v, ok := rec["res_merknad"]; ok {
+		rec["res_merknad"] = a.ps.Text(v)
+	}
+}
+
+// lmarc anonymizes a record from the lmarc dump.
+func (a *anonymizer) lmarc(rec *marc.Record) {
+	for i, f := range rec.CtrlFields {
+		if f.Tag == "001" {
+			rec.CtrlFields[i].Value = a.ps.Borrowernr(f.Value)
+		}
+	}
+	for _, f := range rec.DataFields {
+		for i, sf := range f.SubFields {
+			if fn := a.lmarcSubField(f.Tag, sf.Code); fn != nil {
+				f.SubFields[i].Value = fn(sf.Value)
+			}
+		}
+	}
+}
+
+// lmarcSubField returns the function anonymizing the given subfield,
+// or nil if it holds no personal data.
+func (a *anonymizer) lmarcSubField(tag, code string) func(string) string {
+	switch tag + "$" + code {
+	case "105$a", "601$a": // foresatte, navn
+		return a.ps.Name
+	case "402$a", "601$b": // adresse
+		return a.ps.Address
+	case "150$a": // melding
+		return a.ps.Text
+	case "190$a", "606$b": // fødselsnummer
+		return a.ps.Fnr
+	case "240$a", "603$c": // telefonnr
+		return a.ps.Phone
+	case "604$a": // epost
+		return a.ps.Email
+	case "261$a", "606$d": // PIN
+		return a.ps.Digits
+	case "261$z", "606$z": // hashed PIN
+		return a.ps.Hash
+	case "600$a": // nasjonalt lånenummer
+		return a.ps.Digits
+	case "606$a": // fødselsdato
+		return a.ps.Date
+	}
+	return nil
+}
+
+// anonymizeKV anonymizes a dump in key-value format, keeping the order of keys.
+func anonymizeKV(r io.Reader, w io.Writer, fn func(map[string]string)) (int, error) {
+	dec := NewKVDecoder(r)
+	enc := NewKVEncoder(w)
+	n := 0
+	for rec, err := dec.Decode(); err != io.EOF; rec, err = dec.Decode() {
+		if err != nil {
+			return n, err
+		}
+		fn(rec)
+		if err := enc.Encode(rec, dec.Keys()); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, enc.Flush()
+}
+
+// anonymizeLmarc anonymizes a dump in line-MARC format.
+func (a *anonymizer) anonymizeLmarc(r io.Reader, w io.Writer) (int, error) {
+	dec := marc.NewDecoder(r, marc.LineMARC)
+	enc := marc.NewEncoder(w, marc.LineMARC)
+	defer enc.Flush()
+	n := 0
+	for rec, err := dec.Decode(); err != io.EOF; rec, err = dec.Decode() {
+		if err != nil {
+			return n, err
+		}
+		a.lmarc(rec)
+		if err := enc.Encode(rec); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func main() {
+	var (
+		laaner = flag.String("laaner", "", "laaner dump")
+		lmarc  = flag.String("lmarc", "", "lmarc dump")
+		lnel   = flag.String("lnel", "", "lnel dump")
+		exemp  = flag.String("exemp", "", "exemp dump")
+		res    = flag.String("res", "", "res dump")
+		outDir = flag.String("outdir", "", "output directory (must differ from the directories of the input files)")
+		keyF   = flag.String("key", "", "file containing key for pseudonyms (random key if empty)")
+	)
+	flag.Parse()
+
+	if *laaner+*lmarc+*lnel+*exemp+*res == "" || *outDir == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var key []byte
+	if *keyF != "" {
+		b, err := ioutil.ReadFile(*keyF)
+		if err != nil {
+			log.Fatal(err)
+		}
+		key = bytes.TrimSpace(b)
+	} else {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("no key given; pseudonyms will differ from other runs")
+	}
+
+	a := newAnonymizer(key)
+
+	// lmarc, laaner and lnel before exemp and res, so that
+	// patrons get the same borrower numbers regardless of loans and holds.
+	files := []struct {
+		path string
+		fn   func(io.Reader, io.Writer) (int, error)
+	}{
+		{*lmarc, a.anonymizeLmarc},
+		{*laaner, func(r io.Reader, w io.Writer) (int, error) { return anonymizeKV(r, w, a.laaner) }},
+		{*lnel, func(r io.Reader, w io.Writer) (int, error) { return anonymizeKV(r, w, a.lnel) }},
+		{*exemp, func(r io.Reader, w io.Writer) (int, error) { return anonymizeKV(r, w, a.exemp) }},
+		{*res, func(r io.Reader, w io.Writer) (int, error) { return anonymizeKV(r, w, a.res) }},
+	}
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		out := filepath.Join(*outDir, filepath.Base(f.path))
+		if sameFile(f.path, out) {
+			log.Fatalf("refusing to overwrite input file %s", f.path)
+		}
+		inF := mustOpen(f.path)
+		outF := mustCreate(out)
+		n, err := f.fn(inF, outF)
+		if err != nil {
+			log.Fatalf("%s: %v", f.path, err)
+		}
+		inF.Close()
+		if err := outF.Close(); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("anonymized %d records from %s", n, f.path)
+	}
+}
+
+func sameFile(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fa, fb)
+}
+
+func mustOpen(s string) *os.File {
+	f, err := os.Open(s)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func mustCreate(s string) *os.File {
+	f, err := os.Create(s)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func init() {
+	log.SetFlags(0)
+	log.SetPrefix("anonymize: ")
+}
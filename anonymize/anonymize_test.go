@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/boutros/marc"
+)
+
+const (
+	testLaaner = `ln_nr |1234|
+ln_navn |Testesen, Test|
+ln_adr1 |Lyngveien 4|
+ln_post |0550 OSLO|
+ln_tlf |22 33 44 55|
+ln_foedt |02/03/1911|
+ln_melding |Ringer ofte om purringer|
+ln_kat |V|
+^
+ln_nr |1235|
+ln_navn |!!Testesen, Anna|
+ln_foedt |00/00/0000|
+^
+`
+	testLnel = `lnel_nr |1234|
+lnel_epost |test.testesen@gmail.com|
+lnel_pin |9876|
+^
+`
+	testRes = `res_titnr |555|
+res_laanr |1234|
+^
+res_titnr |556|
+res_laanr |1235|
+res_merknad |Ring Test på 22 33 44 55|
+^
+`
+	testLmarc = `*0011234
+*10500$aTestesen, Test
+*190  $a02031145530
+*240  $a98765432$cmobil
+*261  $a9876$z81dc9bdb52d04dc20036dbd8313ed055
+^
+`
+)
+
+func TestAnonymize(t *testing.T) {
+	a := newAnonymizer([]byte("secret"))
+
+	var laaner, lnel, res, lmarc bytes.Buffer
+	for _, f := range []struct {
+		in  string
+		out io.Writer
+		fn  func(io.Reader, io.Writer) (int, error)
+		n   int
+	}{
+		{testLmarc, &lmarc, a.anonymizeLmarc, 1},
+		{testLaaner, &laaner, func(r io.Reader, w io.Writer) (int, error) { return anonymizeKV(r, w, a.laaner) }, 2},
+		{testLnel, &lnel, func(r io.Reader, w io.Writer) (int, error) { return anonymizeKV(r, w, a.lnel) }, 1},
+		{testRes, &res, func(r io.Reader, w io.Writer) (int, error) { return anonymizeKV(r, w, a.res) }, 2},
+	} {
+		n, err := f.fn(strings.NewReader(f.in), f.out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != f.n {
+			t.Errorf("anonymized %d records; want %d", n, f.n)
+		}
+	}
+
+	all := laaner.String() + lnel.String() + res.String() + lmarc.String()
+	for _, secret := range []string{"1234", "1235", "Testesen", "Lyngveien", "22 33 44 55", "02/03/1911",
+		"Ringer", "Ring Test", "gmail", "9876", "02031145530", "98765432", "81dc9bdb52d04dc20036dbd8313ed055"} {
+		if strings.Contains(all, secret) {
+			t.Errorf("output contains %q:\n%s", secret, all)
+		}
+	}
+	for _, kept := range []string{"0550 OSLO", "ln_kat |V|", "ln_foedt |00/00/0000|", "!!", "res_titnr |555|", "$cmobil"} {
+		if !strings.Contains(all, kept) {
+			t.Errorf("output missing %q:\n%s", kept, all)
+		}
+	}
+
+	// structure is kept
+	for _, test := range []struct{ in, out string }{
+		{testLaaner, laaner.String()},
+		{testLnel, lnel.String()},
+		{testRes, res.String()},
+	} {
+		if got, want := keysOf(test.out), keysOf(test.in); got != want {
+			t.Errorf("keys => %q; want %q", got, want)
+		}
+	}
+
+	// cross-references survive
+	dec := NewKVDecoder(&laaner)
+	l1, _ := dec.Decode()
+	l2, _ := dec.Decode()
+	n1, _ := NewKVDecoder(&lnel).Decode()
+	dec = NewKVDecoder(&res)
+	r1, _ := dec.Decode()
+	r2, _ := dec.Decode()
+	m1, err := marc.NewDecoder(&lmarc, marc.LineMARC).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l1["ln_nr"] != n1["lnel_nr"] || l1["ln_nr"] != r1["res_laanr"] || l1["ln_nr"] != m1.CtrlFields[0].Value {
+		t.Errorf("borrower number 1234 pseudonymized inconsistently: laaner %s, lnel %s, res %s, lmarc %s",
+			l1["ln_nr"], n1["lnel_nr"], r1["res_laanr"], m1.CtrlFields[0].Value)
+	}
+	if l2["ln_nr"] != r2["res_laanr"] || l2["ln_nr"] == l1["ln_nr"] {
+		t.Errorf("borrower number 1235 pseudonymized to %s and %s; 1234 to %s", l2["ln_nr"], r2["res_laanr"], l1["ln_nr"])
+	}
+	if l1["ln_navn"][:strings.Index(l1["ln_navn"], ",")] != l2["ln_navn"][2:strings.Index(l2["ln_navn"], ",")] {
+		t.Errorf("surname pseudonymized inconsistently: %q and %q", l1["ln_navn"], l2["ln_navn"])
+	}
+	if l1["ln_navn"] != m1.DataFields[0].SubFields[0].Value {
+		t.Errorf("name pseudonymized inconsistently: laaner %q, lmarc %q", l1["ln_navn"], m1.DataFields[0].SubFields[0].Value)
+	}
+	if l1["ln_foedt"][6:] != "1911" {
+		t.Errorf("year of birth not kept: %s", l1["ln_foedt"])
+	}
+	if n1["lnel_pin"] != m1.DataFields[3].SubFields[0].Value {
+		t.Errorf("PIN pseudonymized inconsistently: lnel %s, lmarc %s", n1["lnel_pin"], m1.DataFields[3].SubFields[0].Value)
+	}
+
+	// fnr is valid, and matches the pseudonymized date of birth
+	fnr := m1.DataFields[1].SubFields[0].Value
+	dob, dnumber, _, ok := parseFnr(fnr)
+	if !ok || dnumber {
+		t.Fatalf("pseudonymized fnr %s is not a valid fødselsnummer", fnr)
+	}
+	if got := dob.Format(noDateFormat); got != l1["ln_foedt"] {
+		t.Errorf("fnr date of birth %s; want %s", got, l1["ln_foedt"])
+	}
+}
+
+func TestPseudonymizer(t *testing.T) {
+	ps := newPseudonymizer([]byte("secret"))
+	for _, fnr := range []string{"02031145530", "42031145524", "01010550048"} {
+		p := ps.Fnr(fnr)
+		_, dnumber, ind, ok := parseFnr(p)
+		_, wantDnumber, wantInd, _ := parseFnr(fnr)
+		if !ok || dnumber != wantDnumber || (ind >= 500) != (wantInd >= 500) {
+			t.Errorf("Fnr(%s) => %s; want valid fnr of same kind and century", fnr, p)
+		}
+		if ps.Fnr(fnr) != p {
+			t.Errorf("Fnr(%s) not deterministic", fnr)
+		}
+	}
+
+	seen := make(map[string]string)
+	for i := 1; i < 100; i++ {
+		v := string(rune('0'+i/10)) + string(rune('0'+i%10))
+		if i < 10 {
+			v = v[1:]
+		}
+		p := ps.Borrowernr(v)
+		if len(p) != len(v) {
+			t.Errorf("Borrowernr(%s) => %s; want same length", v, p)
+		}
+		if other, ok := seen[p]; ok {
+			t.Errorf("Borrowernr(%s) and Borrowernr(%s) => %s", v, other, p)
+		}
+		seen[p] = v
+	}
+	if got := ps.Borrowernr("-42"); got != "-"+ps.Borrowernr("42") {
+		t.Errorf("Borrowernr(-42) => %s; want -%s", got, ps.Borrowernr("42"))
+	}
+
+	if got := ps.Phone("+47 22 33 44 55"); !strings.HasPrefix(got, "+47 2") || len(got) != len("+47 22 33 44 55") {
+		t.Errorf("Phone(+47 22 33 44 55) => %s; want country code, first digit and format kept", got)
+	}
+}
+
+func keysOf(dump string) string {
+	var keys []string
+	for _, line := range strings.Split(dump, "\n") {
+		if i := strings.Index(line, " |"); i != -1 {
+			keys = append(keys, line[:i])
+		} else {
+			keys = append(keys, line)
+		}
+	}
+	return strings.Join(keys, ",")
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bufio"
+	"io"
+)
+
+// KVEncoder writes records in the key-value format of Bibliofil database
+// exports, as read by KVDecoder.
+type KVEncoder struct {
+	w *bufio.Writer
+}
+
+func NewKVEncoder(w io.Writer) *KVEncoder {
+	return &KVEncoder{
+		w: bufio.NewWriter(w),
+	}
+}
+
+// Encode writes the record, with keys in the given order,
+// followed by the end of record marker.
+func (e *KVEncoder) Encode(rec map[string]string, keys []string) error {
+	for _, k := range keys {
+		e.w.WriteString(k)
+		e.w.WriteString(" |")
+		e.w.WriteString(rec[k])
+		e.w.WriteString("|\n")
+	}
+	_, err := e.w.WriteString("^\n")
+	return err
+}
+
+// Flush writes any buffered data to the underlying writer.
+func (e *KVEncoder) Flush() error {
+	return e.w.Flush()
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	noDateFormat  = "02/01/2006"
+	isoDateFormat = "2006-01-02"
+)
+
+var (
+	firstnames = []string{
+		"Anne", "Inger", "Kari", "Marit", "Ingrid", "Liv", "Eva", "Berit", "Astrid", "Bjørg",
+		"Hilde", "Anna", "Solveig", "Marianne", "Randi", "Ida", "Nina", "Maria", "Elisabeth", "Kristin",
+		"Jan", "Per", "Bjørn", "Ole", "Lars", "Kjell", "Knut", "Arne", "Svein", "Thomas",
+		"Hans", "Geir", "Tor", "Morten", "Terje", "Odd", "Erik", "Martin", "Andreas", "John",
+		"Emma", "Nora", "Sofie", "Sara", "Leah", "Jakob", "Emil", "Noah", "Oliver", "Filip",
+	}
+	surnames = []string{
+		"Hansen", "Johansen", "Olsen", "Larsen", "Andersen", "Pedersen", "Nilsen", "Kristiansen", "Jensen", "Karlsen",
+		"Johnsen", "Pettersen", "Eriksen", "Berg", "Haugen", "Hagen", "Johannessen", "Andreassen", "Jacobsen", "Dahl",
+		"Jørgensen", "Halvorsen", "Henriksen", "Lund", "Sørensen", "Jakobsen", "Moen", "Gundersen", "Iversen", "Strand",
+		"Solberg", "Svendsen", "Eide", "Knutsen", "Martinsen", "Paulsen", "Bakken", "Kristoffersen", "Mathisen", "Lie",
+	}
+	streets = []string{
+		"Storgata", "Kirkeveien", "Skolegata", "Parkveien", "Bakkegata", "Solveien", "Granveien", "Bjørkeveien",
+		"Furuveien", "Nedre gate", "Øvre gate", "Sjøgata", "Strandveien", "Industriveien", "Fjellveien", "Markveien",
+		"Tollbugata", "Kongens gate", "Dronningens gate", "Havnegata",
+	}
+)
+
+// pseudonymizer replaces personal data with pseudonyms. Pseudonyms are
+// derived from a keyed hash of the original value, so that the same input
+// always gives the same output, also across files, while the original value
+// cannot be recovered without the key.
+type pseudonymizer struct {
+	key []byte
+
+	borrowers     map[string]string // borrower number -> pseudonym
+	usedBorrowers map[string]bool
+}
+
+func newPseudonymizer(key []byte) *pseudonymizer {
+	return &pseudonymizer{
+		key:           key,
+		borrowers:     make(map[string]string),
+		usedBorrowers: make(map[string]bool),
+	}
+}
+
+// sum returns a keyed hash of the value, for the given kind of value.
+func (ps *pseudonymizer) sum(kind, v string) []byte {
+	mac := hmac.New(sha256.New, ps.key)
+	mac.Write([]byte(kind))
+	mac.Write([]byte{0})
+	mac.Write([]byte(v))
+	return mac.Sum(nil)
+}
+
+func (ps *pseudonymizer) num(kind, v string) uint64 {
+	return binary.BigEndian.Uint64(ps.sum(kind, v))
+}
+
+func (ps *pseudonymizer) pick(kind, v string, list []string) string {
+	return list[ps.num(kind, v)%uint64(len(list))]
+}
+
+// Name pseudonymizes a name on the form "Surname, Firstname". Surnames and
+// first names are replaced independently, so that family members share surname.
+// The prefix "!!" marking deleted patrons is kept.
+func (ps *pseudonymizer) Name(v string) string {
+	if strings.TrimSpace(v) == "" {
+		return v
+	}
+	prefix := ""
+	if strings.HasPrefix(v, "!!") {
+		prefix, v = "!!", v[2:]
+	}
+	i := strings.Index(v, ",")
+	if i == -1 {
+		return prefix + ps.pick("surname", normKey(v), surnames)
+	}
+	surname := ps.pick("surname", normKey(v[:i]), surnames)
+	firstname := strings.TrimSpace(v[i+1:])
+	if firstname == "" {
+		return prefix + surname + ","
+	}
+	return prefix + surname + ", " + ps.pick("firstname", normKey(firstname), firstnames)
+}
+
+// Address pseudonymizes a street address. Values consisting of digits only
+// are treated as phone numbers.
+func (ps *pseudonymizer) Address(v string) string {
+	if strings.TrimSpace(v) == "" {
+		return v
+	}
+	if onlyDigits(v) == strings.TrimSpace(v) {
+		return ps.Phone(v)
+	}
+	n := ps.num("address", normKey(v))
+	return fmt.Sprintf("%s %d", streets[n%uint64(len(streets))], 1+(n>>32)%150)
+}
+
+// Email pseudonymizes an email address, using the reserved example.com domain.
+func (ps *pseudonymizer) Email(v string) string {
+	if strings.TrimSpace(v) == "" {
+		return v
+	}
+	key := normKey(v)
+	n := ps.num("email", key)
+	return fmt.Sprintf("%s.%s%d@example.com",
+		strings.ToLower(ps.pick("email-first", key, firstnames)),
+		strings.ToLower(ps.pick("email-last", key, surnames)),
+		n%10000)
+}
+
+// Phone pseudonymizes a phone number, keeping its formatting, an international
+// prefix and the first digit of the number, which tells mobile from landline.
+func (ps *pseudonymizer) Phone(v string) string {
+	digits := onlyDigits(v)
+	if digits == "" {
+		return v
+	}
+	keep := 1
+	switch {
+	case strings.HasPrefix(digits, "0047"):
+		keep = 5
+	case strings.HasPrefix(digits, "47") && len(digits) == 10:
+		keep = 3
+	}
+	return ps.replaceDigits("phone", v, digits, keep)
+}
+
+// Digits replaces all digits of the value, ex: a PIN.
+func (ps *pseudonymizer) Digits(v string) string {
+	return ps.replaceDigits("digits", v, onlyDigits(v), 0)
+}
+
+// replaceDigits replaces the digits in v, except the first keep digits,
+// with digits derived from the keyed hash of all the digits.
+func (ps *pseudonymizer) replaceDigits(kind, v, digits string, keep int) string {
+	if keep > len(digits) {
+		keep = len(digits)
+	}
+	sum := ps.sum(kind, digits)
+	var b strings.Builder
+	i := 0
+	for _, r := range v {
+		if !unicode.IsDigit(r) {
+			b.WriteRune(r)
+			continue
+		}
+		if i < keep {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('0' + sum[i%len(sum)]%10)
+		}
+		i++
+	}
+	return b.String()
+}
+
+// Hash replaces a hex-encoded hash with another of the same length.
+func (ps *pseudonymizer) Hash(v string) string {
+	if v == "" {
+		return v
+	}
+	h := hex.EncodeToString(ps.sum("hash", v))
+	for len(h) < len(v) {
+		h += h
+	}
+	return h[:len(v)]
+}
+
+// Text replaces free text, such as borrower notes.
+func (ps *pseudonymizer) Text(v string) string {
+	if strings.TrimSpace(v) == "" {
+		return v
+	}
+	return fmt.Sprintf("Anonymisert melding %d", ps.num("text", v)%100000)
+}
+
+// Date pseudonymizes a date in one of the formats used by Bibliofil,
+// keeping the year. Unknown dates ("00/00/0000") are kept.
+func (ps *pseudonymizer) Date(v string) string {
+	for _, layout := range []string{noDateFormat, isoDateFormat} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return ps.date(t).Format(layout)
+		}
+	}
+	return v
+}
+
+func (ps *pseudonymizer) date(t time.Time) time.Time {
+	jan1 := time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	days := ps.num("date", t.Format(isoDateFormat)) % 365
+	return jan1.AddDate(0, 0, int(days))
+}
+
+// Fnr pseudonymizes a Norwegian national identity number. Valid numbers are
+// replaced by valid numbers with the pseudonymized date of birth, in the same
+// century and of the same kind (fødselsnummer or D-number). Other values have
+// their digits replaced.
+func (ps *pseudonymizer) Fnr(v string) string {
+	dob, dnumber, ind, ok := parseFnr(v)
+	if !ok {
+		return ps.Digits(v)
+	}
+	pdob := ps.date(dob)
+	day := pdob.Day()
+	if dnumber {
+		day += 40
+	}
+	prefix := fmt.Sprintf("%02d%02d%02d", day, int(pdob.Month()), pdob.Year()%100)
+
+	// individual number in the same range as the original, which gives the century
+	lo, hi := 0, 500
+	switch {
+	case ind >= 900:
+		lo, hi = 900, 1000
+	case ind >= 750:
+		lo, hi = 750, 900
+	case ind >= 500:
+		lo, hi = 500, 750
+	}
+	n := ps.num("fnr", v)
+	for i := uint64(0); i < uint64(hi-lo); i++ {
+		s := prefix + fmt.Sprintf("%03d", lo+int((n+i)%uint64(hi-lo)))
+		if k, ok := fnrCheckDigits(s); ok {
+			return s + k
+		}
+	}
+	return ps.Digits(v)
+}
+
+// Borrowernr pseudonymizes a borrower number, keeping a leading minus sign
+// and the number of digits. Distinct borrower numbers are guaranteed to get
+// distinct pseudonyms, so that cross-references between dumps survive.
+func (ps *pseudonymizer) Borrowernr(v string) string {
+	sign := ""
+	if strings.HasPrefix(v, "-") {
+		sign, v = "-", v[1:]
+	}
+	if v == "" || v == "0" || onlyDigits(v) != v {
+		return sign + v
+	}
+	if p, ok := ps.borrowers[v]; ok {
+		return sign + p
+	}
+	lo := uint64(1)
+	for i := 1; i < len(v); i++ {
+		lo *= 10
+	}
+	span := lo*10 - lo
+	if len(v) == 1 {
+		span = 9
+	}
+	n := ps.num("borrowernr", v)
+	var p string
+	for i := uint64(0); ; i++ {
+		p = strconv.FormatUint(lo+(n+i)%span, 10)
+		if !ps.usedBorrowers[p] {
+			break
+		}
+		if i == span {
+			// all numbers of this length taken; widen
+			p = v + "0"
+			break
+		}
+	}
+	ps.usedBorrowers[p] = true
+	ps.borrowers[v] = p
+	return sign + p
+}
+
+// parseFnr extracts date of birth, D-number flag and individual number from a
+// Norwegian national identity number, reporting whether it is valid.
+func parseFnr(s string) (time.Time, bool, int, bool) {
+	if len(s) != 11 || onlyDigits(s) != s {
+		return time.Time{}, false, 0, false
+	}
+	if k, ok := fnrCheckDigits(s[:9]); !ok || k != s[9:] {
+		return time.Time{}, false, 0, false
+	}
+	day, _ := strconv.Atoi(s[0:2])
+	month, _ := strconv.Atoi(s[2:4])
+	year, _ := strconv.Atoi(s[4:6])
+	ind, _ := strconv.Atoi(s[6:9])
+	dnumber := day > 40
+	if dnumber {
+		day -= 40
+	}
+	switch {
+	case ind < 500:
+		year += 1900
+	case ind < 750 && year >= 54:
+		year += 1800
+	case year < 40:
+		year += 2000
+	case ind >= 900:
+		year += 1900
+	default:
+		return time.Time{}, false, 0, false
+	}
+	dob := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if dob.Day() != day || int(dob.Month()) != month {
+		return time.Time{}, false, 0, false
+	}
+	return dob, dnumber, ind, true
+}
+
+// fnrCheckDigits returns the two modulus 11 check digits of the first nine
+// digits of a national identity number, or false if there are none.
+func fnrCheckDigits(s string) (string, bool) {
+	var d [10]int
+	for i := 0; i < 9; i++ {
+		d[i] = int(s[i] - '0')
+	}
+	k1 := 11 - (3*d[0]+7*d[1]+6*d[2]+1*d[3]+8*d[4]+9*d[5]+4*d[6]+5*d[7]+2*d[8])%11
+	if k1 == 11 {
+		k1 = 0
+	}
+	d[9] = k1
+	k2 := 11 - (5*d[0]+4*d[1]+3*d[2]+2*d[3]+7*d[4]+6*d[5]+5*d[6]+4*d[7]+3*d[8]+2*d[9])%11
+	if k2 == 11 {
+		k2 = 0
+	}
+	if k1 == 10 || k2 == 10 {
+		return "", false
+	}
+	return fmt.Sprintf("%d%d", k1, k2), true
+}
+
+// normKey normalizes a value before hashing, so that differences in
+// case and whitespace do not give different pseudonyms.
+func normKey(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+// onlyDigits strip all characters from string except digits
+func onlyDigits(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if unicode.IsDigit(c) {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
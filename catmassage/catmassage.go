@@ -13,12 +13,21 @@
 //   nydalen.marcxml:    catalogue with items belonging to "nydalen-læremidler"
 //   branches.sql:       holding branches extracted from items, to be inserted in MySQL before bulkmarcimport
 //   itypes.sql          item types to be inserted in MySQL before bulkmarcimport
+//
+// Loans of duplicate patrons merged by patronmassage are re-pointed to the
+// surviving patron when given patronmassage's borrowermerge.csv (-borrowermap).
+//
+// Fixes given by -fix (see marcedit.ParseFixes) are applied to the records
+// before they are written to catalogue.marcxml, except fixes on 952, which
+// are applied after items are merged into 952, before the records are written
+// to catalogue.mrc and split into the bjornholt and nydalen dumps.
 
 package main
 
 import (
 	"bufio"
 	"bytes"
+	"encoding/csv"
 	"flag"
 	"fmt"
 	"io"
@@ -27,12 +36,12 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 	"text/template"
 
 	"github.com/boutros/marc"
+	"github.com/digibib/migtools/marcedit"
 )
 
 var (
@@ -62,6 +71,8 @@ type Main struct {
 	limit        int
 	skip         int
 	branches     map[string]string
+	borrowerMap  map[string]string // duplicate borrower nr -> surviving borrower nr, from patronmassage
+	fixes        []*marcedit.Fix
 }
 
 type Issue struct {
@@ -81,18 +92,20 @@ var outMARCXML bool
 
 func main() {
 	var (
-		vmarc  = flag.String("vmarc", "/home/boutros/src/github.com/digibib/ls.ext/migration/example_data/data.vmarc.20141020-084813.txt", "catalogue database in line-marc")
-		exemp  = flag.String("exemp", "/home/boutros/src/github.com/digibib/ls.ext/migration/example_data/data.exemp.20141020-085129.txt", "exemplar database key-val")
-		emarc  = flag.String("emarc", "/home/boutros/src/github.com/digibib/ls.ext/migration/example_data/data.emarc.20141020-085154.txt", "exemplar database in line-marc")
+		vmarc  = flag.String("vmarc", "", "catalogue database in line-marc")
+		exemp  = flag.String("exemp", "", "exemplar database key-val")
+		emarc  = flag.String("emarc", "", "exemplar database in line-marc")
 		limit  = flag.Int("limit", -1, "stop after n records")
 		skip   = flag.Int("skip", 0, "skip first n records")
 		outDir = flag.String("outdir", "", "output directory (default to current working directory)")
+		bMap   = flag.String("borrowermap", "", "borrowermerge.csv from patronmassage, to re-point loans of merged duplicate patrons")
+		fix    = flag.String("fix", "", "fix file, applied to records before items are merged, or after for fixes on 952")
 	)
 	flag.BoolVar(&outMARCXML, "marcxml", false, "output merged records in marcxml instead of ISOmarc")
 
 	flag.Parse()
 
-	if *vmarc == "" || *exemp == "" {
+	if *vmarc == "" || *exemp == "" || *emarc == "" {
 		flag.Usage()
 		os.Exit(1)
 	}
@@ -125,6 +138,21 @@ func main() {
 	defer emarcF.Close()
 
 	m := newMain(vmarcF, exempF, emarcF, outMerged, outNoItems, outBjornholt, outNydalen, outIssues, *limit, *skip)
+	if *bMap != "" {
+		bMapF := mustOpen(*bMap)
+		var err error
+		m.borrowerMap, err = loadBorrowerMap(bMapF)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bMapF.Close()
+	}
+	if *fix != "" {
+		var err error
+		if m.fixes, err = marcedit.LoadFixes(*fix); err != nil {
+			log.Fatal(err)
+		}
+	}
 	if err := m.Run(); err != nil {
 		log.Fatal(err)
 	}
@@ -190,7 +218,7 @@ func (m *Main) Run() error {
 			continue
 		}
 		barcode := fmt.Sprintf("0301%07d%03d", tnr, exnr)
-		switch firstVal(rec, "250", "a") {
+		switch marcedit.First(rec, "250", "a") {
 		case "Hurtiglån 14 dager":
 			laan14dag[barcode] = true
 		case "Hurtiglån 7 dager":
@@ -198,7 +226,7 @@ func (m *Main) Run() error {
 		case "Dagslån":
 			laan1dag[barcode] = true
 		}
-		if branch := firstVal(rec, "100", "c"); branch != "" {
+		if branch := marcedit.First(rec, "100", "c"); branch != "" {
 			issuebranch[barcode] = branch
 		}
 	}
@@ -254,6 +282,8 @@ func (m *Main) Run() error {
 	encFbjl := marc.NewEncoder(m.outBjornholt, marc.MARCXML)
 	encFnyl := marc.NewEncoder(m.outNydalen, marc.MARCXML)
 
+	recFixes, itemFixes := splitFixes(m.fixes)
+
 	// Loop over records in database, and merge exemplar info into field 952
 
 	skipCount := 0
@@ -287,7 +317,7 @@ func (m *Main) Run() error {
 		}
 
 		// Add 942 field (record level item type)
-		v := strings.TrimSpace(strings.ToLower(firstVal(r, "019", "b")))
+		v := strings.TrimSpace(strings.ToLower(marcedit.First(r, "019", "b")))
 		if v == "ge" || v == "ib" || v == "ic" || v == "co" {
 			// Skip nettressurser, arkivmapper og mikrofilm
 			continue
@@ -316,7 +346,7 @@ func (m *Main) Run() error {
 		} else {
 			v = "UKJENT"
 		}
-		r.DataFields = append(r.DataFields, marc.DField{
+		marcedit.Append(r, marc.DField{
 			Tag:       "942",
 			Ind1:      " ",
 			Ind2:      " ",
@@ -324,11 +354,11 @@ func (m *Main) Run() error {
 		})
 
 		// Replace 521a field (Age restriction) with age restriction (integer) from 019s
-		age := firstVal(r, "019", "s")
+		age := marcedit.First(r, "019", "s")
 		if age != "" {
-			removeSubfield(r, "521", "a")
+			marcedit.Delete(r, "521", "a")
 
-			r.DataFields = append(r.DataFields, marc.DField{
+			marcedit.Append(r, marc.DField{
 				Tag:       "521",
 				Ind1:      " ",
 				Ind2:      " ",
@@ -336,6 +366,8 @@ func (m *Main) Run() error {
 			})
 		}
 
+		marcedit.ApplyFixes(r, recFixes)
+
 		// write MARCXML record, before merging in items
 		if err := encMARCXML.Encode(r); err != nil {
 			return err
@@ -408,7 +440,7 @@ func (m *Main) Run() error {
 					case "ex_plass":
 						// 952$c shelving location (authorized value? TODO check)
 						v := getValue(scanner.Bytes())
-						switch firstVal(r, "092", "a") {
+						switch marcedit.First(r, "092", "a") {
 						case "MILJØHYLLA":
 							v = "Miljøhylla"
 						case "VINDU MOT SHANGHAI":
@@ -493,20 +525,20 @@ func (m *Main) Run() error {
 
 					// 952$o full call number (hyllesignatur)
 					// TODO factour out this string concatination
-					callnumber := firstVal(r, "090", "a")
-					if v := firstVal(r, "090", "b"); v != "" {
+					callnumber := marcedit.First(r, "090", "a")
+					if v := marcedit.First(r, "090", "b"); v != "" {
 						if len(callnumber) > 0 {
 							callnumber += " "
 						}
 						callnumber += v
 					}
-					if v := firstVal(r, "090", "c"); v != "" {
+					if v := marcedit.First(r, "090", "c"); v != "" {
 						if len(callnumber) > 0 {
 							callnumber += " "
 						}
 						callnumber += v
 					}
-					if v := firstVal(r, "090", "d"); v != "" {
+					if v := marcedit.First(r, "090", "d"); v != "" {
 						if len(callnumber) > 0 {
 							callnumber += " "
 						}
@@ -517,7 +549,7 @@ func (m *Main) Run() error {
 					}
 
 					// Add item type (used for issuing rule) based on item type from record:
-					iType := firstVal(r, "942", "y")
+					iType := marcedit.First(r, "942", "y")
 					if laan7dag[barcode] {
 						iType = "UKESLAAN"
 					} else if laan14dag[barcode] {
@@ -527,14 +559,17 @@ func (m *Main) Run() error {
 					}
 					f.SubFields = append(f.SubFields, marc.SubField{Code: "y", Value: iType})
 
-					if !belongsTo(f, []string{"dfb", "fnyl", "fbjl", "fsor", "fxxx", "idep", "innk", "fbju", "fgab"}) {
-						r.DataFields = append(r.DataFields, f)
+					if !marcedit.SubField("a", "dfb", "fnyl", "fbjl", "fsor", "fxxx", "idep", "innk", "fbju", "fgab")(f) {
+						marcedit.Append(r, f)
 					} else {
 						onLoan = false // otherwise loans to deleted dfb/fnyl/fbjl items are written to issue.sql
 					}
 					f = marc.DField{Tag: "952"} // start from anew
 
 					if onLoan {
+						if survivor, ok := m.borrowerMap[issue.BibliofilBorrowerNr]; ok {
+							issue.BibliofilBorrowerNr = survivor
+						}
 						issue.Branch = issuebranch[issue.Barcode]
 						if newBranch, ok := branchOldToNew[issue.Branch]; ok {
 							issue.Branch = newBranch
@@ -557,6 +592,8 @@ func (m *Main) Run() error {
 			return err
 		}
 
+		marcedit.ApplyFixes(r, itemFixes)
+
 		// strip items beloning to bjornholt-læremidler and nydalen-læremidler
 		fbjl, fnyl := splitItems(r)
 
@@ -570,16 +607,16 @@ func (m *Main) Run() error {
 
 		// encode records with bjornholt-læremidler items, if any
 		if len(fbjl) > 0 {
-			remove952(r) // remove all items
-			r.DataFields = append(r.DataFields, fbjl...)
+			marcedit.Remove(r, marcedit.Tag("952")) // remove all items
+			marcedit.Append(r, fbjl...)
 			if err := encFbjl.Encode(r); err != nil {
 				return err
 			}
 		}
 		// encode records with nydalen-læremidler items, if any
 		if len(fnyl) > 0 {
-			remove952(r) // remove any items from bjornholt-læremidler
-			r.DataFields = append(r.DataFields, fnyl...)
+			marcedit.Remove(r, marcedit.Tag("952")) // remove any items from bjornholt-læremidler
+			marcedit.Append(r, fnyl...)
 			if err := encFnyl.Encode(r); err != nil {
 				return err
 			}
@@ -595,6 +632,9 @@ func (m *Main) Run() error {
 	for branch, count := range missingBranch {
 		fmt.Printf("%s\t%d\n", branch, count)
 	}
+	if len(m.fixes) > 0 {
+		marcedit.WriteFixCounts(os.Stdout, m.fixes)
+	}
 
 	// flush all buffered writers
 	encMARC.Flush()
@@ -618,32 +658,21 @@ func (m *Main) Run() error {
 	return err
 }
 
-func remove952(r *marc.Record) {
-	sort.Sort(r.DataFields)
-	for i, d := range r.DataFields {
-		if d.Tag == "952" {
-			r.DataFields = r.DataFields[:i]
-			break
-		}
+// loadBorrowerMap reads a CSV file of duplicate and surviving borrower numbers,
+// as written by patronmassage.
+func loadBorrowerMap(r io.Reader) (map[string]string, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
 	}
-}
-
-func removeSubfield(r *marc.Record, tag string, code string) {
-	for i, d := range r.DataFields {
-		if d.Tag == tag {
-			for i2, s := range d.SubFields {
-				if s.Code == code {
-					if len(r.DataFields[i].SubFields) == 1 {
-						// Remove tag entirely if it's the only subfieldd
-						r.DataFields = append(r.DataFields[:i], r.DataFields[i+1:]...)
-					} else {
-						r.DataFields[i].SubFields = append(d.SubFields[:i2], d.SubFields[i2+1:]...)
-					}
-					break
-				}
-			}
+	res := make(map[string]string, len(rows))
+	for _, row := range rows {
+		if len(row) != 2 {
+			return nil, fmt.Errorf("borrower map: expected 2 columns, got %d", len(row))
 		}
+		res[row[0]] = row[1]
 	}
+	return res, nil
 }
 
 // titleNumber returns the Record's title number from the 001 control field,
@@ -678,34 +707,6 @@ func copyNumber(r *marc.Record) string {
 	return ""
 }
 
-// firstVal returns the first value of a given tag and substring code
-// of a Record, or empty string if not found.
-func firstVal(r *marc.Record, tag string, code string) string {
-	for _, f := range r.DataFields {
-		if f.Tag == tag {
-			for _, s := range f.SubFields {
-				if s.Code == code {
-					return s.Value
-				}
-			}
-		}
-	}
-	return ""
-}
-
-func belongsTo(f marc.DField, branchcodes []string) bool {
-	for _, s := range f.SubFields {
-		if s.Code == "a" {
-			for _, branch := range branchcodes {
-				if s.Value == branch {
-					return true
-				}
-			}
-		}
-	}
-	return false
-}
-
 // getValue returns the value from an line in exemplar database.
 // Ex: []byte("ex_avd |hutl|") would return the string "hutl"
 func getValue(b []byte) string {
@@ -717,31 +718,29 @@ func getValue(b []byte) string {
 	return ""
 }
 
+// splitFixes splits fixes into those applied to records without items, and
+// those on items (952), applied after items are merged.
+func splitFixes(fixes []*marcedit.Fix) (recFixes, itemFixes []*marcedit.Fix) {
+	for _, fx := range fixes {
+		onItems := false
+		for _, tag := range fx.Tags() {
+			onItems = onItems || tag == "952"
+		}
+		if onItems {
+			itemFixes = append(itemFixes, fx)
+		} else {
+			recFixes = append(recFixes, fx)
+		}
+	}
+	return recFixes, itemFixes
+}
+
 // splitItems will return the items belonging to Nydalen-læremidler and Bjornholt-lærmidler,
 // represented as a set of 952 marc.DataFields. The record itself will be modified in-place
 // and stripped of the returned items.
 func splitItems(r *marc.Record) (marc.DFields, marc.DFields) {
-	var fbjl, fnyl, rest marc.DFields
-	for _, f := range r.DataFields {
-		if f.Tag == "952" {
-			match := false
-			for _, sf := range f.SubFields {
-				if sf.Code == "a" && sf.Value == "fbjl" {
-					fbjl = append(fbjl, f)
-					match = true
-				}
-				if sf.Code == "a" && sf.Value == "fnyl" {
-					fnyl = append(fnyl, f)
-					match = true
-				}
-			}
-			if !match {
-				rest = append(rest, f)
-			}
-		}
-	}
-	remove952(r)                                 // remove all items
-	r.DataFields = append(r.DataFields, rest...) // add back items, excluding fbjl/fnyl items
+	fbjl := marcedit.Remove(r, marcedit.And(marcedit.Tag("952"), marcedit.SubField("a", "fbjl")))
+	fnyl := marcedit.Remove(r, marcedit.And(marcedit.Tag("952"), marcedit.SubField("a", "fnyl")))
 	return fbjl, fnyl
 }
 
@@ -5,9 +5,11 @@ import (
 	"io"
 	"io/ioutil"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/boutros/marc"
+	"github.com/digibib/migtools/marcedit"
 )
 
 func parseRecords(t *testing.T, r io.Reader, format marc.Format) []*marc.Record {
@@ -45,7 +47,7 @@ func TestMerge(t *testing.T) {
 			t.Fatalf("got:\n%+v\nwant:%+v", r, want[i])
 		}
 		// verify that the full marcxml and marc records without items are equal, when the 952 fields are removed:
-		remove952(want[i])
+		marcedit.Remove(want[i], marcedit.Tag("952"))
 		if !gotNoItems[i].Eq(want[i]) {
 			t.Fatalf("got:\n%+v\nwant:%+v", gotNoItems[i], want[i])
 		}
@@ -227,6 +229,91 @@ const wantMARCXML = `<?xml version="1.0" encoding="UTF-8"?>
 </record>
 </collection>`
 
+// TestFieldOrder checks that the fields added to records sorted by tag
+// keep them sorted.
+func TestFieldOrder(t *testing.T) {
+	vmarc := `
+*000     c
+*0010379371
+*008920916                a          0 nob
+*019  $bl$s10
+*090  $c641.3$dGra
+*100 0$aGrahl-Nielsen, Thora$d1901-$jn.
+*24510$aUgress er også mat
+*500  $aNote
+*521  $aAge limit note
+*650  $aVille vekster
+*999  $aLocal
+^
+`
+	var outMerged, outNoItems bytes.Buffer
+	m := newMain(bytes.NewBufferString(vmarc), bytes.NewReader([]byte(sampleEXEMP)), bytes.NewBufferString(sampleEMARC), &outMerged, &outNoItems, ioutil.Discard, ioutil.Discard, ioutil.Discard, -1, 0)
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	tags := func(r *marc.Record) (res []string) {
+		for _, f := range r.DataFields {
+			res = append(res, f.Tag)
+		}
+		return res
+	}
+	got := parseRecords(t, bytes.NewReader(outMerged.Bytes()), marc.MARC)
+	gotNoItems := parseRecords(t, bytes.NewReader(outNoItems.Bytes()), marc.MARCXML)
+	if len(got) != 1 || len(gotNoItems) != 1 {
+		t.Fatalf("got %d records, %d without items; want 1", len(got), len(gotNoItems))
+	}
+	if want := []string{"019", "090", "100", "245", "500", "521", "650", "942", "952", "952", "999"}; !reflect.DeepEqual(tags(got[0]), want) {
+		t.Errorf("got fields %v; want %v", tags(got[0]), want)
+	}
+	if want := []string{"019", "090", "100", "245", "500", "521", "650", "942", "999"}; !reflect.DeepEqual(tags(gotNoItems[0]), want) {
+		t.Errorf("got fields without items %v; want %v", tags(gotNoItems[0]), want)
+	}
+	if v := marcedit.First(got[0], "521", "a"); v != "Aldersgrense 10" {
+		t.Errorf("got 521$a %q; want %q", v, "Aldersgrense 10")
+	}
+}
+
+func TestFixes(t *testing.T) {
+	vmarc := `
+*000     c
+*0010379371
+*019  $bl
+*090  $c641.3$dGra
+*24510$aUgress er også mat
+^
+`
+	var outMerged, outNoItems bytes.Buffer
+	m := newMain(bytes.NewBufferString(vmarc), bytes.NewReader([]byte(sampleEXEMP)), bytes.NewBufferString(sampleEMARC), &outMerged, &outNoItems, ioutil.Discard, ioutil.Discard, ioutil.Discard, -1, 0)
+	var err error
+	m.fixes, err = marcedit.ParseFixes(strings.NewReader("set\t952$x\tfixed\t952$a=hutl\nreplace\t090$c\t^(\\d+)\\.(\\d+)$\t$1,$2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+	got := parseRecords(t, bytes.NewReader(outMerged.Bytes()), marc.MARC)
+	gotNoItems := parseRecords(t, bytes.NewReader(outNoItems.Bytes()), marc.MARCXML)
+	if len(got) != 1 || len(gotNoItems) != 1 {
+		t.Fatalf("got %d records, %d without items; want 1", len(got), len(gotNoItems))
+	}
+	for _, r := range []*marc.Record{got[0], gotNoItems[0]} {
+		if v := marcedit.First(r, "090", "c"); v != "641,3" {
+			t.Errorf("got 090$c %q; want fixed before items are merged", v)
+		}
+	}
+	if got := marcedit.Values(got[0], "952", "x"); !reflect.DeepEqual(got, []string{"fixed"}) {
+		t.Errorf("got 952$x %v; want fixed for the hutl item", got)
+	}
+	// call numbers of items are taken from the fixed 090$c
+	if v := marcedit.Values(got[0], "952", "o"); len(v) != 2 || v[0] != "641,3 Gra" {
+		t.Errorf("got 952$o %v", v)
+	}
+	if len(m.fixes) != 2 || m.fixes[0].N != 1 || m.fixes[1].N != 1 {
+		t.Errorf("got fix counts %d, %d; want 1, 1", m.fixes[0].N, m.fixes[1].N)
+	}
+}
+
 const sampleVMARC = `
 *000     d
 *0010379371
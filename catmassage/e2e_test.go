@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/boutros/marc"
+	"github.com/digibib/migtools/dumpgen"
+	"github.com/digibib/migtools/marcedit"
+)
+
+var e2eConfig = dumpgen.Config{
+	Titles:   300,
+	Copies:   3,
+	Patrons:  200,
+	LoanRate: 0.2,
+	HoldRate: 0.1,
+	Date:     time.Date(2016, 8, 19, 7, 31, 0, 0, time.UTC),
+}
+
+var rgxIssueBarcode = regexp.MustCompile(`items\.barcode = '(\d+)'`)
+
+// TestGeneratedDumps runs catmassage on dumps from dumpgen, checking that the
+// outputs are consistent with each other.
+func TestGeneratedDumps(t *testing.T) {
+	d, err := dumpgen.Generate(e2eConfig, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var merged, noItems, issues bytes.Buffer
+	m := newMain(&d.Vmarc, bytes.NewReader(d.Exemp.Bytes()), &d.Emarc, &merged, &noItems, ioutil.Discard, ioutil.Discard, &issues, -1, 0)
+	if err := m.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	recs := parseRecords(t, &merged, marc.MARC)
+	if len(recs) == 0 || len(recs) >= e2eConfig.Titles {
+		t.Fatalf("got %d records from %d titles; want deleted titles skipped", len(recs), e2eConfig.Titles)
+	}
+	if n := len(parseRecords(t, &noItems, marc.MARCXML)); n != len(recs) {
+		t.Errorf("got %d records without items; want %d", n, len(recs))
+	}
+
+	barcodes := make(map[string]bool)
+	for _, r := range recs {
+		if marcedit.First(r, "942", "y") == "" {
+			t.Errorf("record %s without item type (942$y)", titleNumber(r))
+		}
+		for _, f := range marcedit.Fields(r, marcedit.Tag("952")) {
+			barcode := marcedit.First(&marc.Record{DataFields: marc.DFields{f}}, "952", "p")
+			if tnr, _ := strconv.Atoi(titleNumber(r)); len(barcode) != 14 || barcode[:11] != fmt.Sprintf("0301%07d", tnr) {
+				t.Errorf("record %s: item with barcode %q", titleNumber(r), barcode)
+			}
+			if marcedit.SubField("a", "dfb", "fnyl", "fbjl")(f) {
+				t.Errorf("record %s: item %s not to be migrated", titleNumber(r), barcode)
+			}
+			barcodes[barcode] = true
+		}
+	}
+	if len(barcodes) == 0 {
+		t.Fatal("no items migrated")
+	}
+
+	loans := rgxIssueBarcode.FindAllStringSubmatch(issues.String(), -1)
+	if len(loans) == 0 {
+		t.Fatal("no issues written")
+	}
+	for _, loan := range loans {
+		if !barcodes[loan[1]] {
+			t.Errorf("issue of item %s not in catalogue", loan[1])
+		}
+	}
+}
+
+func BenchmarkGeneratedDumps(b *testing.B) {
+	cfg := e2eConfig
+	cfg.Titles, cfg.Patrons = 2000, 1000
+	d, err := dumpgen.Generate(cfg, 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m := newMain(bytes.NewReader(d.Vmarc.Bytes()), bytes.NewReader(d.Exemp.Bytes()), bytes.NewReader(d.Emarc.Bytes()),
+			ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard, ioutil.Discard, -1, 0)
+		if err := m.Run(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
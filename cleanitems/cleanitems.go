@@ -1,32 +1,71 @@
-// cleanitems cleans items marcdatabases for Nydalen|Bjørnholt-lærmidler.
+// cleanitems cleans the items (952) of marcdatabases, by default for
+// Nydalen|Bjørnholt-lærmidler.
 //
-// It performs the following operations:
-//  * removes any due dates (952$q)
-//  * removes items makred as lost, paid for ++
-//    TODO get specifics! 952$7=? 952$1=?
-//  * sets item type 952$y to "L" for "Læremidler"
+// The operations are given by a rules file (-rules), see parseRules; the
+// default rules (see defaultRules):
+//   - remove any due dates (952$q)
+//   - remove items marked as lost, billed, or lost and paid for (952$1=1,12,8)
+//   - remove lost codes 952$1=9,10,11 and notforloan code 952$7=2, and change
+//     952$1=5 "påstått ikke lånt" to 4 "ikke på plass"
+//   - set item type 952$y to "L" for "Læremidler"
 //
-// The result is dumped to standard out
+// Fixes given by -fix (see marcedit.ParseFixes) are applied after the rules.
+//
+// The result is dumped to standard out, with the number of items each rule
+// touched to standard error. With -dryrun, only the counts are printed.
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/boutros/marc"
+	"github.com/digibib/migtools/marcedit"
 )
 
 func main() {
 	log.SetFlags(0)
 	log.SetPrefix("cleanitems: ")
-	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "Usage: cleanitems <marcdatabase>\n")
+	rulesFile := flag.String("rules", "", "rules file (default: built-in rules, see defaultRules)")
+	fixFile := flag.String("fix", "", "fix file, applied after the rules")
+	dryRun := flag.Bool("dryrun", false, "only report how many items each rule would touch")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: cleanitems [flags] <marcdatabase>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	f, err := os.Open(os.Args[1])
+	var rulesConfig io.Reader = strings.NewReader(defaultRules)
+	if *rulesFile != "" {
+		rulesF, err := os.Open(*rulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer rulesF.Close()
+		rulesConfig = rulesF
+	}
+	rules, err := parseRules(rulesConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var fixes []*marcedit.Fix
+	if *fixFile != "" {
+		if fixes, err = marcedit.LoadFixes(*fixFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(flag.Arg(0))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -51,102 +90,34 @@ func main() {
 		log.Fatal(err)
 	}
 
+	var out io.Writer = os.Stdout
+	summary := os.Stderr
+	if *dryRun {
+		out, summary = ioutil.Discard, os.Stdout
+	}
+
+	counts := make([]int, len(rules))
 	dec := marc.NewDecoder(f, format)
-	enc := marc.NewEncoder(os.Stdout, format)
+	enc := marc.NewEncoder(out, format)
 	for rec, err := dec.Decode(); err != io.EOF; rec, err = dec.Decode() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		stripDueDate(rec)
-		removeItems(rec)
-		stripStatusCodes(rec)
-		setItemType(rec)
+		for i, ru := range rules {
+			counts[i] += ru.apply(rec)
+		}
+		marcedit.ApplyFixes(rec, fixes)
 		if err := enc.Encode(rec); err != nil {
 			log.Fatal(err)
 		}
 	}
-}
+	enc.Flush()
 
-// stripDueDateremove any occurency of 952$q from MARC record.
-func stripDueDate(rec *marc.Record) {
-	for i, f := range rec.DataFields {
-		if f.Tag == "952" {
-			for j, sf := range f.SubFields {
-				if sf.Code == "q" {
-					rec.DataFields[i].SubFields = append(rec.DataFields[i].SubFields[:j], rec.DataFields[i].SubFields[j+1:]...)
-				}
-			}
-		}
+	fmt.Fprintln(summary, "Items touched by rule:")
+	for i, ru := range rules {
+		fmt.Fprintf(summary, "%d: %s\t%d\n", ru.line, ru.text, counts[i])
 	}
-}
-
-// removeItems removes any items marked as: "Tapt", "Regning", "Tapt. Regning betalt"
-// that is, where 952$1 equals "1", "12", "8"
-func removeItems(rec *marc.Record) {
-	for i, f := range rec.DataFields {
-		if f.Tag == "952" {
-			for _, sf := range f.SubFields {
-				if sf.Code == "1" {
-					switch sf.Value {
-					case "1", "12", "8":
-						rec.DataFields = append(rec.DataFields[:i], rec.DataFields[min(i+1, len(rec.DataFields)):]...)
-						removeItems(rec) // need to start over, since we mutated the slice we're ranging over
-					default:
-					}
-				}
-			}
-		}
-	}
-}
-
-func setItemType(rec *marc.Record) {
-	for i, f := range rec.DataFields {
-		if f.Tag == "952" {
-			for j, sf := range f.SubFields {
-				if sf.Code == "y" {
-					rec.DataFields[i].SubFields[j].Value = "L"
-				}
-			}
-		}
-	}
-}
-
-// stripStatusCodes remove some status codes from 952$7 and 952$1, namely:
-//   lost: "på vidvanke", "return eieravdeling", "til henteavdeling"
-//   notloan: "ny"
-// It also swaps "påstått ikke lånt" for "ikke på plass":
-func stripStatusCodes(rec *marc.Record) {
-	for i, f := range rec.DataFields {
-		if f.Tag == "952" {
-			for j, sf := range f.SubFields {
-				if sf.Code == "1" {
-					if sf.Value == "9" || sf.Value == "10" || sf.Value == "11" {
-						// remove lost codes for "på vidvanke", "return eieravdeling", "til henteavdeling"
-						rec.DataFields[i].SubFields = append(
-							rec.DataFields[i].SubFields[:j],
-							rec.DataFields[i].SubFields[min(j+1, len(rec.DataFields[i].SubFields)):]...)
-						stripStatusCodes(rec) // need to start over, since we mutated the slice we're ranging over
-					} else if sf.Value == "5" {
-						// påstått ikke lånt => ikke på plass
-						rec.DataFields[i].SubFields[j].Value = "4"
-					}
-				}
-				if sf.Code == "7" && (sf.Value == "2") {
-					// remove notforloan codes for "ny"
-					rec.DataFields[i].SubFields = append(
-						rec.DataFields[i].SubFields[:j],
-						rec.DataFields[i].SubFields[min(j+1, len(rec.DataFields[i].SubFields)):]...)
-					stripStatusCodes(rec) // need to start over, since we mutated the slice we're ranging over
-				}
-
-			}
-		}
-	}
-}
-
-func min(a, b int) int {
-	if a < b {
-		return a
+	if len(fixes) > 0 {
+		marcedit.WriteFixCounts(summary, fixes)
 	}
-	return b
 }
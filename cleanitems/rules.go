@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/boutros/marc"
+	"github.com/digibib/migtools/marcedit"
+)
+
+// itemTag is the tag of item fields.
+const itemTag = "952"
+
+// defaultRules are the rules applied unless -rules is given, for cleaning the
+// items of Nydalen- and Bjørnholt-læremidler; see parseRules for the format.
+const defaultRules = `# action	arguments
+# remove due dates
+delete	q	*
+# remove items lost, billed, or lost and paid for
+remove	1=1,12,8
+# remove lost codes for "på vidvanke", "return eieravdeling", "til henteavdeling"
+delete	1=9,10,11	*
+# "påstått ikke lånt" => "ikke på plass"
+map	1	5	4
+# remove notforloan code for "ny"
+delete	7=2	*
+# item type "L" for "Læremidler"
+set	y	L	y
+`
+
+// itemCond selects items by a subfield.
+type itemCond struct {
+	all    bool            // every item
+	code   string          // subfield code
+	values map[string]bool // any value if empty
+	negate bool
+}
+
+// parseCond parses a condition: * for all items, c for items with subfield c,
+// c=v1,v2 for items with subfield c having one of the values, or c!=v1,v2
+// for items without.
+func parseCond(s string) (itemCond, error) {
+	if s == "*" {
+		return itemCond{all: true}, nil
+	}
+	c := itemCond{code: s}
+	if i := strings.Index(s, "="); i != -1 {
+		c.code = s[:i]
+		if strings.HasSuffix(c.code, "!") {
+			c.code, c.negate = c.code[:len(c.code)-1], true
+		}
+		c.values = make(map[string]bool)
+		for _, v := range strings.Split(s[i+1:], ",") {
+			c.values[v] = true
+		}
+	}
+	if len(c.code) != 1 {
+		return c, fmt.Errorf("invalid condition: %q", s)
+	}
+	return c, nil
+}
+
+func (c itemCond) match(f marc.DField) bool {
+	if c.all {
+		return true
+	}
+	return marcedit.HasSubField(f, c.code, func(sf marc.SubField) bool {
+		return len(c.values) == 0 || c.values[sf.Value]
+	}) != c.negate
+}
+
+// subField reports whether sf is a subfield matching the condition.
+func (c itemCond) subField(sf marc.SubField) bool {
+	return sf.Code == c.code && (len(c.values) == 0 || c.values[sf.Value] != c.negate)
+}
+
+// rule is an operation on items.
+type rule struct {
+	line   int
+	text   string
+	action string
+	code   string   // subfield operated on
+	sub    itemCond // subfields deleted, for delete
+	from   string   // value mapped, for map
+	value  string   // value set, or mapped to
+	cond   itemCond
+}
+
+// parseRules parses rules, one per line, with tab-separated columns:
+//
+//	remove	<cond>	remove items matching the condition
+//	delete	<code>[=v1,v2]	<cond>	delete subfield code of items matching the
+//		condition, only with one of the values if given (or without, for !=)
+//	set	<code>	<value>	<cond>	set subfield code of items matching the condition,
+//		adding it if missing
+//	map	<code>	<from>	<to>	change value from of subfield code to value to
+//
+// See parseCond for conditions. Empty lines and lines starting with # are
+// ignored. Rules are applied in order.
+func parseRules(r io.Reader) ([]rule, error) {
+	var rules []rule
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		cols := strings.Split(line, "\t")
+		ru := rule{line: n, text: strings.Join(cols, " "), action: cols[0]}
+		want := map[string]int{"remove": 2, "delete": 3, "set": 4, "map": 4}[ru.action]
+		if want == 0 {
+			return nil, fmt.Errorf("rules line %d: unknown action: %q", n, ru.action)
+		}
+		if len(cols) != want {
+			return nil, fmt.Errorf("rules line %d: %s takes %d arguments, got %d", n, ru.action, want-1, len(cols)-1)
+		}
+		var err error
+		switch ru.action {
+		case "remove":
+			ru.cond, err = parseCond(cols[1])
+		case "delete":
+			if ru.sub, err = parseCond(cols[1]); err == nil && ru.sub.all {
+				err = fmt.Errorf("invalid subfield: %q", cols[1])
+			}
+			ru.code = ru.sub.code
+			if err == nil {
+				ru.cond, err = parseCond(cols[2])
+			}
+		case "set":
+			ru.code, ru.value = cols[1], cols[2]
+			ru.cond, err = parseCond(cols[3])
+		case "map":
+			ru.code, ru.from, ru.value = cols[1], cols[2], cols[3]
+			ru.cond = itemCond{all: true}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rules line %d: %v", n, err)
+		}
+		if ru.action != "remove" && len(ru.code) != 1 {
+			return nil, fmt.Errorf("rules line %d: invalid subfield code: %q", n, ru.code)
+		}
+		rules = append(rules, ru)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// apply applies the rule to the items of rec, returning the number of items
+// changed or removed.
+func (ru rule) apply(rec *marc.Record) int {
+	items := marcedit.And(marcedit.Tag(itemTag), ru.cond.match)
+	switch ru.action {
+	case "remove":
+		return len(marcedit.Remove(rec, items))
+	case "delete":
+		return marcedit.Edit(rec, items, func(f *marc.DField) bool {
+			return marcedit.FilterSubFields(f, func(sf marc.SubField) bool { return !ru.sub.subField(sf) }) > 0
+		})
+	case "set":
+		return marcedit.Edit(rec, items, func(f *marc.DField) bool {
+			return marcedit.SetSubField(f, ru.code, ru.value)
+		})
+	case "map":
+		return marcedit.Edit(rec, items, func(f *marc.DField) bool {
+			return marcedit.SetSubFields(f, ru.code, marcedit.Value(ru.from), ru.value) > 0
+		})
+	}
+	return 0
+}
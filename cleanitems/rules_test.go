@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/boutros/marc"
+)
+
+func item(sfs ...string) marc.DField {
+	f := marc.DField{Tag: itemTag, Ind1: " ", Ind2: " "}
+	for i := 0; i+1 < len(sfs); i += 2 {
+		f.SubFields = append(f.SubFields, marc.SubField{Code: sfs[i], Value: sfs[i+1]})
+	}
+	return f
+}
+
+func TestDefaultRules(t *testing.T) {
+	rules, err := parseRules(strings.NewReader(defaultRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &marc.Record{
+		DataFields: marc.DFields{
+			{Tag: "245", SubFields: marc.SubFields{{Code: "a", Value: "Tittel"}}},
+			item("p", "1", "q", "2016-09-01", "q", "2016-09-02", "1", "5", "y", "BOK"),
+			item("p", "2", "1", "12"),
+			item("p", "3", "1", "8"),
+			item("p", "4", "1", "9", "7", "2", "y", "BOK"),
+			item("p", "5"),
+			item("p", "6", "1", "10", "1", "3", "7", "1"),
+		},
+	}
+	var counts []int
+	for _, ru := range rules {
+		counts = append(counts, ru.apply(rec))
+	}
+	want := marc.DFields{
+		{Tag: "245", SubFields: marc.SubFields{{Code: "a", Value: "Tittel"}}},
+		item("p", "1", "1", "4", "y", "L"),
+		item("p", "4", "y", "L"),
+		item("p", "5"),
+		item("p", "6", "1", "3", "7", "1"),
+	}
+	if !reflect.DeepEqual(rec.DataFields, want) {
+		t.Errorf("got\n%v\nwant\n%v", rec.DataFields, want)
+	}
+	if want := []int{1, 2, 2, 1, 1, 2}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("got counts %v; want %v", counts, want)
+	}
+}
+
+func TestRules(t *testing.T) {
+	rules, err := parseRules(strings.NewReader("# comment\n\nset\tc\tMAG\ta!=hutl,hbar\nremove\tz\nset\to\tx\t*\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &marc.Record{DataFields: marc.DFields{
+		item("a", "hutl", "c", "Voksen"),
+		item("a", "fsto", "c", "Voksen"),
+		item("a", "fsto", "z", "note"),
+	}}
+	for _, ru := range rules {
+		ru.apply(rec)
+	}
+	want := marc.DFields{
+		item("a", "hutl", "c", "Voksen", "o", "x"),
+		item("a", "fsto", "c", "MAG", "o", "x"),
+	}
+	if !reflect.DeepEqual(rec.DataFields, want) {
+		t.Errorf("got\n%v\nwant\n%v", rec.DataFields, want)
+	}
+
+	for _, config := range []string{
+		"strip\tq\n",
+		"remove\n",
+		"delete\tq\n",
+		"delete\tqq\t*\n",
+		"delete\t*\t*\n",
+		"delete\tq=\n",
+		"set\ty\tL\ty=\tx\n",
+		"remove\tab=1\n",
+		"map\t1\t5\n",
+	} {
+		if _, err := parseRules(strings.NewReader(config)); err == nil {
+			t.Errorf("%q: got no error", config)
+		}
+	}
+}
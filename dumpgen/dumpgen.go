@@ -0,0 +1,605 @@
+// Package dumpgen generates synthetic Bibliofil database dumps, for testing
+// and benchmarking the migration tools without access to real data; see
+// gendumps.
+package dumpgen
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	noDateFormat  = "02/01/2006"
+	isoDateFormat = "2006-01-02"
+	noDate        = "00/00/0000"
+)
+
+var (
+	// branches with weights; includes old and automat branches which are
+	// mapped to new ones, and codes missing from the branch mappings.
+	branches = weighted{
+		{"hutl", 20}, {"hbar", 5}, {"hvmu", 3}, {"fbje", 4}, {"fbol", 4}, {"ffur", 5},
+		{"fgam", 5}, {"fgry", 5}, {"fhol", 4}, {"flam", 5}, {"fmaj", 6}, {"fnor", 2},
+		{"fnyd", 4}, {"fopp", 3}, {"frmm", 3}, {"froa", 4}, {"from", 2}, {"fsme", 2},
+		{"fsto", 4}, {"ftor", 5}, {"hvua", 2}, {"fmaa", 1}, {"fboa", 1}, {"fbli", 1},
+		{"hvkr", 1}, {"xyz", 1},
+	}
+	// item branches; items at dfb, fnyl and fbjl are not migrated.
+	itemBranches = append(weighted{{"dfb", 2}, {"fnyl", 1}, {"fbjl", 1}, {"", 1}}, branches...)
+
+	// media codes (019$b) with weights, see catmassage
+	mediaCodes = weighted{
+		{"l", 60}, {"ab", 4}, {"di", 5}, {"dj", 1}, {"dg", 6}, {"ee", 6}, {"ef", 1},
+		{"ma", 2}, {"mj", 1}, {"j", 3}, {"sm", 1}, {"c", 2}, {"a", 1}, {"h", 1},
+		{"la", 2}, {"dh", 1}, {"ge", 1}, {"xx", 1},
+	}
+
+	// record status (leader position 5) with weights; d, f, e, i, l, t, m and b are skipped by catmassage
+	recordStatus = weighted{{"c", 50}, {"n", 40}, {"d", 5}, {"f", 2}, {"i", 1}, {"e", 1}, {"t", 1}}
+
+	// item status (ex_status) with weights, when not on loan
+	itemStatus = weighted{
+		{"", 90}, {"n", 2}, {"c", 1}, {"o", 1}, {"q", 1}, {"t", 2}, {"i", 1}, {"S", 1}, {"r", 1}, {"v", 1}, {"y", 1},
+	}
+
+	// loan rules (emarc 250$a) with weights
+	loanRules = weighted{{"", 95}, {"Dagslån", 2}, {"Hurtiglån 7 dager", 2}, {"Hurtiglån 14 dager", 1}}
+
+	// adult patron categories (ln_kat) with weights; children are "b"
+	adultCategories = weighted{
+		{"v", 80}, {"u", 5}, {"i", 3}, {"kl", 2}, {"pas", 2}, {"bhg", 1}, {"sko", 2}, {"NB", 1}, {"EU", 1}, {"xx", 1},
+	}
+
+	// hold status (res_stat) with weights: i = waiting for pickup, y = in transit
+	holdStatus = weighted{{"", 85}, {"i", 10}, {"y", 5}}
+
+	// notes on holds (res_merknad)
+	holdNotes = []string{"Ring før henting", " Hentes av mor ", "Kun norsk utgave", "Skal på ferie i juli"}
+
+	// transport of notices (lmarc 270-272) with weights
+	transports = weighted{{"epost", 60}, {"sms", 25}, {"brev", 10}, {"EPost", 5}}
+
+	firstnames = []string{
+		"Anne", "Inger", "Kari", "Marit", "Ingrid", "Liv", "Eva", "Berit", "Astrid", "Bjørg",
+		"Hilde", "Solveig", "Randi", "Ida", "Nina", "Maria", "Jan", "Per", "Bjørn", "Ole",
+		"Lars", "Kjell", "Knut", "Arne", "Svein", "Thomas", "Geir", "Tor", "Morten", "Odd",
+		"Erik", "Martin", "Emma", "Nora", "Sofie", "Sara", "Jakob", "Emil", "Noah", "Filip",
+	}
+	surnames = []string{
+		"Hansen", "Johansen", "Olsen", "Larsen", "Andersen", "Pedersen", "Nilsen", "Kristiansen", "Jensen", "Karlsen",
+		"Johnsen", "Pettersen", "Eriksen", "Berg", "Haugen", "Hagen", "Dahl", "Halvorsen", "Lund", "Sørensen",
+		"Moen", "Strand", "Solberg", "Eide", "Bakken", "Lie", "Ahmed", "Nguyen", "Khan", "Kowalski",
+	}
+	streets = []string{
+		"Storgata", "Kirkeveien", "Skolegata", "Parkveien", "Bakkegata", "Trondheimsveien", "Grønlandsleiret",
+		"Bogstadveien", "Thereses gate", "Waldemar Thranes gate", "Tvetenveien", "Lambertseterveien",
+	}
+	postcodes = []string{
+		"0150 OSLO", "0182 OSLO", "0187 OSLO", "0350 OSLO", "0475 OSLO", "0550 OSLO", "0568 OSLO",
+		"0661 OSLO", "0687 OSLO", "0855 OSLO", "0960 OSLO", "1155 OSLO", "1275 OSLO", "1360 FORNEBU",
+	}
+	titleWords = []string{
+		"natten", "havet", "byen", "mørket", "sommer", "vinter", "hjem", "reisen", "hemmeligheten", "sporet",
+		"stillheten", "brevet", "øya", "skogen", "drømmen", "kampen", "løftet", "arven", "muren", "ilden",
+	}
+	publishers = []string{"Gyldendal", "Cappelen Damm", "Aschehoug", "Oktober", "Pax", "Samlaget", "Vigmostad & Bjørke"}
+)
+
+type weighted []struct {
+	v string
+	w int
+}
+
+func (ws weighted) pick(rnd *rand.Rand) string {
+	total := 0
+	for _, x := range ws {
+		total += x.w
+	}
+	n := rnd.Intn(total)
+	for _, x := range ws {
+		if n < x.w {
+			return x.v
+		}
+		n -= x.w
+	}
+	panic("unreachable")
+}
+
+// Config holds the size and distributions of the generated dumps.
+type Config struct {
+	Titles     int       // number of titles in vmarc
+	Copies     int       // average number of copies per title
+	Patrons    int       // number of patrons in laaner and lmarc
+	LoanRate   float64   // fraction of copies on loan
+	HoldRate   float64   // fraction of titles with holds
+	DefectRate float64   // fraction of records with deliberate defects
+	Date       time.Time // time of dump
+}
+
+// Dumps are the outputs of the generator.
+type Dumps struct {
+	Vmarc, Emarc, Exemp, Laaner, Lmarc, Lnel, Res io.Writer
+
+	Defects io.Writer // CSV report of deliberate defects
+}
+
+// Generator generates synthetic Bibliofil database dumps. Records are written
+// as they are generated, so that the size of the dumps is not limited by memory.
+type Generator struct {
+	cfg Config
+	rnd *rand.Rand
+
+	vmarc, emarc, exemp, laaner, lmarc, lnel, res *bufio.Writer
+	defects                                       *csv.Writer
+
+	borrowers []int // borrower numbers, including deleted patrons
+
+	Counts       map[string]int // dump -> number of records
+	DefectCounts map[string]int // defect -> count
+}
+
+// New returns a generator writing to out. The same seed gives the same dumps.
+func New(cfg Config, seed int64, out Dumps) *Generator {
+	g := &Generator{
+		cfg:          cfg,
+		rnd:          rand.New(rand.NewSource(seed)),
+		vmarc:        bufio.NewWriter(out.Vmarc),
+		emarc:        bufio.NewWriter(out.Emarc),
+		exemp:        bufio.NewWriter(out.Exemp),
+		laaner:       bufio.NewWriter(out.Laaner),
+		lmarc:        bufio.NewWriter(out.Lmarc),
+		lnel:         bufio.NewWriter(out.Lnel),
+		res:          bufio.NewWriter(out.Res),
+		defects:      csv.NewWriter(out.Defects),
+		Counts:       make(map[string]int),
+		DefectCounts: make(map[string]int),
+	}
+	g.defects.Write([]string{"dump", "record", "field", "defect"})
+	return g
+}
+
+// Buffers hold generated dumps in memory.
+type Buffers struct {
+	Vmarc, Emarc, Exemp, Laaner, Lmarc, Lnel, Res, Defects bytes.Buffer
+}
+
+// Generate generates dumps in memory, for tests and benchmarks.
+func Generate(cfg Config, seed int64) (*Buffers, error) {
+	var b Buffers
+	g := New(cfg, seed, Dumps{
+		Vmarc: &b.Vmarc, Emarc: &b.Emarc, Exemp: &b.Exemp, Laaner: &b.Laaner,
+		Lmarc: &b.Lmarc, Lnel: &b.Lnel, Res: &b.Res, Defects: &b.Defects,
+	})
+	if err := g.Run(); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// Run generates all dumps.
+func (g *Generator) Run() error {
+	lnr := 100000
+	for i := 0; i < g.cfg.Patrons; i++ {
+		lnr += 1 + g.rnd.Intn(20)
+		g.patron(lnr)
+	}
+
+	tnr := 100000
+	for i := 0; i < g.cfg.Titles; i++ {
+		tnr += 1 + g.rnd.Intn(50)
+		g.title(tnr)
+	}
+
+	for _, w := range []*bufio.Writer{g.vmarc, g.emarc, g.exemp, g.laaner, g.lmarc, g.lnel, g.res} {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	g.defects.Flush()
+	return g.defects.Error()
+}
+
+// defect reports whether to inject a defect in the given field, and records it if so.
+func (g *Generator) defect(dump string, id int, field, defect string) bool {
+	if g.rnd.Float64() >= g.cfg.DefectRate {
+		return false
+	}
+	g.DefectCounts[defect]++
+	g.defects.Write([]string{dump, fmt.Sprintf("%d", id), field, defect})
+	return true
+}
+
+// patron writes a patron to the laaner, lmarc and lnel dumps.
+func (g *Generator) patron(lnr int) {
+	g.borrowers = append(g.borrowers, lnr)
+	now := g.cfg.Date
+
+	// 25% children, which are sometimes registered as adults and vice versa
+	age := 16 + g.rnd.Intn(75)
+	if g.rnd.Intn(4) == 0 {
+		age = 3 + g.rnd.Intn(13)
+	}
+	dob := now.AddDate(-age, 0, -g.rnd.Intn(365))
+	cat := adultCategories.pick(g.rnd)
+	if age < 16 {
+		cat = "b"
+	}
+	if g.rnd.Intn(20) == 0 {
+		if cat == "b" {
+			cat = "v"
+		} else {
+			cat = "b"
+		}
+	}
+
+	surname := surnames[g.rnd.Intn(len(surnames))]
+	firstname := firstnames[g.rnd.Intn(len(firstnames))]
+	name := surname + ", " + firstname
+	if g.rnd.Intn(50) == 0 {
+		name = "!!" + name // deleted
+	}
+	address := fmt.Sprintf("%s %d", streets[g.rnd.Intn(len(streets))], 1+g.rnd.Intn(120))
+	post := postcodes[g.rnd.Intn(len(postcodes))]
+	mobile := fmt.Sprintf("%d%07d", 4+g.rnd.Intn(2)*5, g.rnd.Intn(10000000))
+	email := ""
+	if g.rnd.Intn(10) < 7 {
+		email = strings.ToLower(fmt.Sprintf("%s.%s%d@example.com", firstname, surname, g.rnd.Intn(100)))
+	}
+	pin := fmt.Sprintf("%04d", g.rnd.Intn(10000))
+	branch := branches.pick(g.rnd)
+
+	enrolled := now.AddDate(0, 0, -g.rnd.Intn(20*365))
+	if enrolled.Before(dob) {
+		enrolled = dob
+	}
+	lastLoan := noDate
+	if g.rnd.Intn(10) > 0 {
+		lastLoan = enrolled.AddDate(0, 0, g.rnd.Intn(int(now.Sub(enrolled).Hours()/24)+1)).Format(noDateFormat)
+	}
+	foedt := dob.Format(noDateFormat)
+	if g.rnd.Intn(30) == 0 {
+		foedt = noDate
+	}
+	sex := "m"
+	if g.rnd.Intn(2) == 0 {
+		sex = "k"
+	}
+	obs := ""
+	switch g.rnd.Intn(40) {
+	case 0:
+		obs = "m" // lost card
+	case 1:
+		obs = "f" // wrong address
+	case 2:
+		obs = "D" // access to self-service library
+	}
+	note := ""
+	if g.rnd.Intn(20) == 0 {
+		note = "Ring før levering"
+	}
+
+	if g.defect("laaner", lnr, "ln_adr1", "pipe in value") {
+		address += "|B"
+	}
+	if g.defect("laaner", lnr, "ln_melding", "broken line") {
+		note = "Skal ha\nstor skrift"
+	}
+	if g.defect("laaner", lnr, "ln_foedt", "bad date") {
+		foedt = fmt.Sprintf("31/02/%d", dob.Year())
+	}
+	if g.defect("laaner", lnr, "ln_sistelaan", "bad date") {
+		lastLoan = "1/13/2015"
+	}
+
+	writeKV(g.laaner,
+		"ln_nr", fmt.Sprintf("%d", lnr),
+		"ln_navn", name,
+		"ln_adr1", address,
+		"ln_adr2", "",
+		"ln_post", post,
+		"ln_land", "no",
+		"ln_sprog", "",
+		"ln_tlf", "",
+		"ln_kat", cat,
+		"ln_arbg", "",
+		"ln_altadr", "",
+		"ln_altpost", "",
+		"ln_foedt", foedt,
+		"ln_kjoenn", sex,
+		"ln_friobs", "",
+		"ln_obs", obs,
+		"ln_regnsendt", noDate,
+		"ln_melding", note,
+		"ln_kortdato", enrolled.Format(noDateFormat),
+		"ln_sistelaan", lastLoan,
+		"ln_sperres", noDate,
+		"ln_antlaan", fmt.Sprintf("%d", g.rnd.Intn(500)),
+		"ln_antpurr", fmt.Sprintf("%d", g.rnd.Intn(3)),
+		"ln_alt_id", "",
+	)
+	g.Counts["laaner"]++
+
+	writeKV(g.lnel,
+		"lnel_nr", fmt.Sprintf("%d", lnr),
+		"lnel_epost", email,
+		"lnel_pin", pin,
+	)
+	g.Counts["lnel"]++
+
+	hashed := fmt.Sprintf("%x", md5.Sum([]byte(pin)))
+	gender := "M"
+	if sex == "k" {
+		gender = "K"
+	}
+	fmt.Fprintf(g.lmarc, "*001%07d\n", lnr)
+	fmt.Fprintf(g.lmarc, "*140  $a%s$b%s\n", branch, branches.pick(g.rnd))
+	fmt.Fprintf(g.lmarc, "*200  $s0\n")
+	fmt.Fprintf(g.lmarc, "*240  $a%s$cmobilsms\n", mobile)
+	fmt.Fprintf(g.lmarc, "*261  $z%s$a%s$b%s\n", hashed, pin, enrolled.Format(noDateFormat))
+	for _, tag := range []string{"270", "271", "272"} {
+		fmt.Fprintf(g.lmarc, "*%s  $a%s\n", tag, transports.pick(g.rnd))
+	}
+	fmt.Fprintf(g.lmarc, "*300  $a%d\n", g.rnd.Intn(3))
+	if g.rnd.Intn(3) > 0 {
+		fmt.Fprintf(g.lmarc, "*600  $aN%09d$k1\n", lnr)
+	}
+	fmt.Fprintf(g.lmarc, "*601  $a%s$b%s$d%s$fno\n", name, address, post[:4])
+	fmt.Fprintf(g.lmarc, "*603  $c%s\n", mobile)
+	if email != "" {
+		fmt.Fprintf(g.lmarc, "*604  $a%s$b0\n", email)
+	}
+	fnr := fnrFor(g.rnd, dob)
+	if g.defect("lmarc", lnr, "606$b", "bad checksum") {
+		fnr = fnr[:10] + string(rune('0'+(fnr[10]-'0'+1)%10))
+	}
+	fmt.Fprintf(g.lmarc, "*606  $a%s$b%s$c%s$z%s$d%s$f0\n", dob.Format(isoDateFormat), fnr, gender, hashed, pin)
+	fmt.Fprintf(g.lmarc, "*607  $a%s$b2100100\n", enrolled.Format("2006-01-02T15:04:05"))
+	fmt.Fprintln(g.lmarc, "^")
+	g.Counts["lmarc"]++
+}
+
+// title writes a title to vmarc, its copies to emarc and exemp, and its holds to res.
+func (g *Generator) title(tnr int) {
+	now := g.cfg.Date
+	year := 1950 + g.rnd.Intn(now.Year()-1949)
+	media := mediaCodes.pick(g.rnd)
+	surname := surnames[g.rnd.Intn(len(surnames))]
+	author := surname + ", " + firstnames[g.rnd.Intn(len(firstnames))]
+	title := capitalize(titleWords[g.rnd.Intn(len(titleWords))]) + " og " + titleWords[g.rnd.Intn(len(titleWords))]
+
+	id := fmt.Sprintf("%07d", tnr)
+	if g.defect("vmarc", tnr, "001", "title number not an integer") {
+		id = "X" + id[1:]
+	}
+	fmt.Fprintf(g.vmarc, "*000     %s\n", recordStatus.pick(g.rnd))
+	fmt.Fprintf(g.vmarc, "*001%s\n", id)
+	fmt.Fprintf(g.vmarc, "*008%02d0101                a          0 nob\n", year%100)
+	if g.rnd.Intn(10) == 0 {
+		fmt.Fprintf(g.vmarc, "*019  $s%d$b%s\n", []int{6, 9, 12, 15, 18}[g.rnd.Intn(5)], media)
+	} else {
+		fmt.Fprintf(g.vmarc, "*019  $b%s\n", media)
+	}
+	fmt.Fprintf(g.vmarc, "*090  $c%03d.%d$d%s\n", g.rnd.Intn(1000), g.rnd.Intn(10), surname[:3])
+	fmt.Fprintf(g.vmarc, "*100 0$a%s$jn.\n", author)
+	fmt.Fprintf(g.vmarc, "*24510$a%s$c%s\n", title, author)
+	fmt.Fprintf(g.vmarc, "*260  $aOslo$b%s$c%d\n", publishers[g.rnd.Intn(len(publishers))], year)
+	fmt.Fprintln(g.vmarc, "^")
+	g.Counts["vmarc"]++
+
+	copies := 1 + g.rnd.Intn(2*g.cfg.Copies)
+	for exnr := 1; exnr <= copies; exnr++ {
+		g.copy(tnr, exnr, year)
+	}
+
+	if g.rnd.Float64() < g.cfg.HoldRate {
+		holds := 1 + g.rnd.Intn(5)
+		for prio := 1; prio <= holds; prio++ {
+			g.hold(tnr, prio, copies)
+		}
+	}
+}
+
+// copy writes a copy of a title to emarc and exemp.
+func (g *Generator) copy(tnr, exnr, year int) {
+	now := g.cfg.Date
+	branch := itemBranches.pick(g.rnd)
+	barcode := fmt.Sprintf("0301%07d%03d", tnr, exnr)
+	status := itemStatus.pick(g.rnd)
+	onLoan := g.rnd.Float64() < g.cfg.LoanRate
+
+	laanr := "0"
+	forfall := noDate
+	laanstat := ""
+	if len(g.borrowers) > 0 {
+		lnr := g.borrowers[g.rnd.Intn(len(g.borrowers))]
+		laanr = fmt.Sprintf("-%d", lnr) // previous borrower
+		if onLoan {
+			status = "u"
+			laanr = fmt.Sprintf("%d", lnr)
+			forfall = now.AddDate(0, 0, g.rnd.Intn(60)-30).Format(noDateFormat)
+			if n := g.rnd.Intn(4); n > 0 {
+				laanstat = string(rune('0' + n))
+			}
+		}
+	}
+	note := ""
+	if g.defect("exemp", tnr, "ex_note", "pipe in value") {
+		note = "Mangler|CD"
+	}
+	if onLoan && g.defect("exemp", tnr, "ex_forfall", "bad date") {
+		forfall = "1/1/2016"
+	}
+
+	writeKV(g.exemp,
+		"ex_titnr", fmt.Sprintf("%d", tnr),
+		"ex_exnr", fmt.Sprintf("%d", exnr),
+		"ex_avd", branch,
+		"ex_plass", "",
+		"ex_hylle", "",
+		"ex_note", note,
+		"ex_bind", "0",
+		"ex_aar", fmt.Sprintf("%d", year),
+		"ex_status", status,
+		"ex_resstat", "",
+		"ex_laanstat", laanstat,
+		"ex_utlkode", []string{"", "", "", "", "", "", "", "", "e", "r"}[g.rnd.Intn(10)],
+		"ex_laanr", laanr,
+		"ex_laantid", "28",
+		"ex_forfall", forfall,
+		"ex_purrdat", noDate,
+		"ex_antpurr", "0",
+		"ex_etikett", "",
+		"ex_antlaan", fmt.Sprintf("%d", g.rnd.Intn(100)),
+		"ex_kl_sett", "0",
+		"ex_strek", "0",
+	)
+	g.Counts["exemp"]++
+
+	registered := excelDate(now.AddDate(-g.rnd.Intn(now.Year()-year+1), 0, 0))
+	fmt.Fprintf(g.emarc, "*001%07d\n", tnr)
+	fmt.Fprintf(g.emarc, "*002%07d\n", exnr)
+	fmt.Fprintf(g.emarc, "*015  $aNO:02030000:10%s ::rfidE0040150%07X ::%s\n", barcode, g.rnd.Intn(1<<28), barcode)
+	fmt.Fprintf(g.emarc, "*017  $a%d\n", registered)
+	if onLoan {
+		fmt.Fprintf(g.emarc, "*100  $a%d$t101613$c%s$fLaanerkategori$lNormal\n", excelDate(now)-g.rnd.Intn(28), branches.pick(g.rnd))
+	}
+	fmt.Fprintf(g.emarc, "*101  $a%s$d%d\n", branches.pick(g.rnd), excelDate(now)-g.rnd.Intn(365))
+	if rule := loanRules.pick(g.rnd); rule != "" {
+		fmt.Fprintf(g.emarc, "*250  $a%s\n", rule)
+	}
+	for i, n := 0, g.rnd.Intn(5); i < n; i++ {
+		fmt.Fprintf(g.emarc, "*301  $a%d$t%02d%02d%02d$v%s\n", registered+g.rnd.Intn(excelDate(now)-registered+1),
+			8+g.rnd.Intn(12), g.rnd.Intn(60), g.rnd.Intn(60), []string{"a", "V", "I", "b"}[g.rnd.Intn(4)])
+	}
+	fmt.Fprintln(g.emarc, "^")
+	g.Counts["emarc"]++
+}
+
+// hold writes a hold on a title to res.
+func (g *Generator) hold(tnr, prio, copies int) {
+	if len(g.borrowers) == 0 {
+		return
+	}
+	now := g.cfg.Date
+	status := ""
+	if prio == 1 {
+		status = holdStatus.pick(g.rnd)
+	}
+	exnr := "0"
+	switch n := g.rnd.Intn(20); {
+	case n == 0 || status != "":
+		exnr = fmt.Sprintf("%d", 1+g.rnd.Intn(copies)) // specific copy, as found holds are
+	case n == 1:
+		exnr = "998" // interlibrary loan
+	}
+	forfall, ankdat := noDate, noDate
+	if status == "i" {
+		expires := now.AddDate(0, 0, g.rnd.Intn(8))
+		forfall = expires.Format(noDateFormat)
+		ankdat = expires.AddDate(0, 0, -7).Format(noDateFormat)
+	}
+	// paused holds, some until further notice
+	pausefra, pausetil := noDate, noDate
+	if status == "" && g.rnd.Intn(10) == 0 {
+		pausefra = now.AddDate(0, 0, 30-g.rnd.Intn(60)).Format(noDateFormat)
+		if g.rnd.Intn(3) > 0 {
+			pausetil = now.AddDate(0, 0, 30+g.rnd.Intn(60)).Format(noDateFormat)
+		}
+	}
+	merknad := ""
+	if g.rnd.Intn(10) == 0 {
+		merknad = holdNotes[g.rnd.Intn(len(holdNotes))]
+	}
+	titnr := fmt.Sprintf("%d", tnr)
+	if g.defect("res", tnr, "res_titnr", "missing biblionumber") {
+		titnr = ""
+	}
+	koenr := fmt.Sprintf("%d", prio)
+	if g.defect("res", tnr, "res_koenr", "missing queue number") {
+		koenr = ""
+	}
+	if g.defect("res", tnr, "res_forfall", "bad date") {
+		forfall = "99/99/9999"
+	}
+
+	writeKV(g.res,
+		"res_titnr", titnr,
+		"res_exnr", exnr,
+		"res_laanr", fmt.Sprintf("%d", g.borrowers[g.rnd.Intn(len(g.borrowers))]),
+		"res_koenr", koenr,
+		"res_hentavd", branches.pick(g.rnd),
+		"res_stat", status,
+		"res_dat", now.AddDate(0, 0, -g.rnd.Intn(120)).Format(noDateFormat),
+		"res_forfall", forfall,
+		"res_ankdat", ankdat,
+		"res_pausefra", pausefra,
+		"res_pausetil", pausetil,
+		"res_merknad", merknad,
+	)
+	g.Counts["res"]++
+}
+
+// writeKV writes a record in the key-value format of Bibliofil, given as
+// alternating keys and values.
+func writeKV(w io.Writer, kvs ...string) {
+	for i := 0; i+1 < len(kvs); i += 2 {
+		fmt.Fprintf(w, "%s |%s|\n", kvs[i], kvs[i+1])
+	}
+	fmt.Fprintln(w, "^")
+}
+
+func capitalize(s string) string {
+	r := []rune(s)
+	return string(unicode.ToUpper(r[0])) + string(r[1:])
+}
+
+// excelDate returns the date as used in emarc, the number of days since 1899-12-30.
+func excelDate(t time.Time) int {
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	return int(t.Sub(epoch).Hours() / 24)
+}
+
+// fnrFor returns a valid Norwegian national identity number for the date of birth.
+func fnrFor(rnd *rand.Rand, dob time.Time) string {
+	lo, hi := 0, 500 // 1900-1999
+	if dob.Year() >= 2000 {
+		lo, hi = 500, 1000
+	}
+	prefix := dob.Format("020106")
+	for {
+		s := prefix + fmt.Sprintf("%03d", lo+rnd.Intn(hi-lo))
+		if k, ok := fnrCheckDigits(s); ok {
+			return s + k
+		}
+	}
+}
+
+// fnrCheckDigits returns the two modulus 11 check digits of the first nine
+// digits of a national identity number, or false if there are none.
+func fnrCheckDigits(s string) (string, bool) {
+	var d [10]int
+	for i := 0; i < 9; i++ {
+		d[i] = int(s[i] - '0')
+	}
+	k1 := 11 - (3*d[0]+7*d[1]+6*d[2]+1*d[3]+8*d[4]+9*d[5]+4*d[6]+5*d[7]+2*d[8])%11
+	if k1 == 11 {
+		k1 = 0
+	}
+	d[9] = k1
+	k2 := 11 - (5*d[0]+4*d[1]+3*d[2]+2*d[3]+7*d[4]+6*d[5]+5*d[6]+4*d[7]+3*d[8]+2*d[9])%11
+	if k2 == 11 {
+		k2 = 0
+	}
+	if k1 == 10 || k2 == 10 {
+		return "", false
+	}
+	return fmt.Sprintf("%d%d", k1, k2), true
+}
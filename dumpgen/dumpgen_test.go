@@ -0,0 +1,205 @@
+package dumpgen
+
+import (
+	"bufio"
+	"encoding/csv"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boutros/marc"
+)
+
+func generate(t testing.TB, cfg Config, seed int64) *Buffers {
+	d, err := Generate(cfg, seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+var testConfig = Config{
+	Titles:   200,
+	Copies:   3,
+	Patrons:  100,
+	LoanRate: 0.2,
+	HoldRate: 0.2,
+	Date:     time.Date(2016, 8, 19, 7, 31, 0, 0, time.UTC),
+}
+
+// values returns the values of the key, in order, from a key-value dump.
+func values(dump, key string) []string {
+	var res []string
+	prefix := key + " |"
+	scanner := bufio.NewScanner(strings.NewReader(dump))
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, prefix) {
+			res = append(res, strings.TrimSuffix(line[len(prefix):], "|"))
+		}
+	}
+	return res
+}
+
+func numRecords(dump string) int {
+	return strings.Count(dump, "\n^\n")
+}
+
+func decodeAll(t *testing.T, r io.Reader) []*marc.Record {
+	var res []*marc.Record
+	dec := marc.NewDecoder(r, marc.LineMARC)
+	for rec, err := dec.Decode(); err != io.EOF; rec, err = dec.Decode() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, rec)
+	}
+	return res
+}
+
+func TestGeneratorConsistency(t *testing.T) {
+	d := generate(t, testConfig, 1)
+
+	borrowers := make(map[string]bool)
+	for _, lnr := range values(d.Laaner.String(), "ln_nr") {
+		borrowers[lnr] = true
+	}
+	if len(borrowers) != testConfig.Patrons {
+		t.Errorf("got %d unique patrons; want %d", len(borrowers), testConfig.Patrons)
+	}
+	if n := numRecords(d.Lnel.String()); n != testConfig.Patrons {
+		t.Errorf("got %d lnel records; want %d", n, testConfig.Patrons)
+	}
+	if n := len(decodeAll(t, &d.Lmarc)); n != testConfig.Patrons {
+		t.Errorf("got %d lmarc records; want %d", n, testConfig.Patrons)
+	}
+	if n := len(decodeAll(t, &d.Vmarc)); n != testConfig.Titles {
+		t.Errorf("got %d vmarc records; want %d", n, testConfig.Titles)
+	}
+
+	// exemp is sorted by title and copy number, and matches emarc
+	titnrs, exnrs := values(d.Exemp.String(), "ex_titnr"), values(d.Exemp.String(), "ex_exnr")
+	copies := make(map[string]int)
+	prev := 0
+	for i, tnr := range titnrs {
+		n, _ := strconv.Atoi(tnr)
+		if n < prev || (n == prev && exnrs[i] != strconv.Itoa(copies[tnr]+1)) || (n > prev && exnrs[i] != "1") {
+			t.Fatalf("exemp not sorted by title and copy number at %s/%s", tnr, exnrs[i])
+		}
+		prev = n
+		copies[tnr]++
+	}
+	if n := len(decodeAll(t, &d.Emarc)); n != len(titnrs) {
+		t.Errorf("got %d emarc records; want %d", n, len(titnrs))
+	}
+
+	loans := 0
+	for _, lnr := range values(d.Exemp.String(), "ex_laanr") {
+		if lnr == "0" {
+			continue
+		}
+		if !strings.HasPrefix(lnr, "-") {
+			loans++
+		}
+		if !borrowers[strings.TrimPrefix(lnr, "-")] {
+			t.Errorf("loan by unknown patron %s", lnr)
+		}
+	}
+	if loans == 0 || loans != count(values(d.Exemp.String(), "ex_status"), "u") {
+		t.Errorf("got %d loans; want ex_status u for every loan", loans)
+	}
+
+	res := d.Res.String()
+	if numRecords(res) == 0 {
+		t.Fatal("no holds generated")
+	}
+	resTitnrs, resExnrs := values(res, "res_titnr"), values(res, "res_exnr")
+	for i, lnr := range values(res, "res_laanr") {
+		if !borrowers[lnr] {
+			t.Errorf("hold by unknown patron %s", lnr)
+		}
+		if _, ok := copies[resTitnrs[i]]; !ok {
+			t.Errorf("hold on unknown title %s", resTitnrs[i])
+		}
+		if exnr, _ := strconv.Atoi(resExnrs[i]); exnr != 998 && exnr > copies[resTitnrs[i]] {
+			t.Errorf("hold on unknown copy %s/%s", resTitnrs[i], resExnrs[i])
+		}
+	}
+
+	if defects, _ := csv.NewReader(&d.Defects).ReadAll(); len(defects) != 1 {
+		t.Errorf("got %d defects; want none", len(defects)-1)
+	}
+}
+
+func count(vals []string, v string) int {
+	n := 0
+	for _, x := range vals {
+		if x == v {
+			n++
+		}
+	}
+	return n
+}
+
+func TestGeneratorDeterministic(t *testing.T) {
+	a, b, c := generate(t, testConfig, 1), generate(t, testConfig, 1), generate(t, testConfig, 2)
+	if a.Laaner.String() != b.Laaner.String() || a.Exemp.String() != b.Exemp.String() || a.Res.String() != b.Res.String() {
+		t.Error("same seed gave different dumps")
+	}
+	if a.Laaner.String() == c.Laaner.String() {
+		t.Error("different seeds gave the same dumps")
+	}
+}
+
+func TestGeneratorDefects(t *testing.T) {
+	cfg := testConfig
+	cfg.DefectRate = 0.1
+	d := generate(t, cfg, 1)
+
+	defects, err := csv.NewReader(&d.Defects).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string]bool)
+	for _, row := range defects[1:] {
+		kinds[row[0]+" "+row[2]+": "+row[3]] = true
+	}
+	for _, want := range []string{
+		"laaner ln_adr1: pipe in value",
+		"laaner ln_melding: broken line",
+		"laaner ln_foedt: bad date",
+		"lmarc 606$b: bad checksum",
+		"vmarc 001: title number not an integer",
+		"exemp ex_note: pipe in value",
+		"exemp ex_forfall: bad date",
+		"res res_titnr: missing biblionumber",
+		"res res_koenr: missing queue number",
+		"res res_forfall: bad date",
+	} {
+		if !kinds[want] {
+			t.Errorf("missing defect %q", want)
+		}
+	}
+	if !strings.Contains(d.Laaner.String(), "|B|\n") || !strings.Contains(d.Laaner.String(), "Skal ha\nstor skrift|") {
+		t.Error("pipe and broken line defects not found in laaner")
+	}
+	if numRecords(d.Laaner.String()) != cfg.Patrons {
+		t.Error("defects changed number of records")
+	}
+}
+
+func BenchmarkGenerator(b *testing.B) {
+	cfg := testConfig
+	cfg.Titles, cfg.Patrons = 1000, 1000
+	for i := 0; i < b.N; i++ {
+		g := New(cfg, int64(i), Dumps{
+			Vmarc: ioutil.Discard, Emarc: ioutil.Discard, Exemp: ioutil.Discard, Laaner: ioutil.Discard,
+			Lmarc: ioutil.Discard, Lnel: ioutil.Discard, Res: ioutil.Discard, Defects: ioutil.Discard,
+		})
+		if err := g.Run(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// gendumps generates synthetic Bibliofil database dumps, for testing and
+// benchmarking the migration tools without access to real data. The
+// generator is package dumpgen, which the end-to-end tests of catmassage,
+// patronmassage and res2sql use directly.
+//
+// output:
+//   data.vmarc.<date>.txt:  catalogue in line-marc
+//   data.emarc.<date>.txt:  exemplar database in line-marc
+//   data.exemp.<date>.txt:  exemplar database key-val, sorted by title and copy number
+//   data.laaner.<date>.txt: patrons key-val
+//   data.lmarc.<date>.txt:  patrons in line-marc
+//   data.lnel.<date>.txt:   patron emails and PINs key-val
+//   data.res.<date>.txt:    holds key-val
+//   defects.csv:            deliberate defects injected in the dumps
+//
+// <date> is the time of the dump (-date), named as in exports from Bibliofil.
+//
+// The dumps are consistent: loans and holds refer to existing patrons and
+// titles, and holds on specific copies to existing copies. Statuses, branches,
+// patron categories and media types follow rough distributions of real data,
+// including deleted records, outdated branch codes and categories without
+// mappings. With -defects, a fraction of the records get deliberate defects:
+// pipes in values, values broken over several lines, bad dates, invalid fnr
+// and missing or non-numeric title numbers. The same seed (-seed) gives the
+// same dumps.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/digibib/migtools/dumpgen"
+)
+
+const dumpDateFormat = "20060102-150405"
+
+func main() {
+	var (
+		titles  = flag.Int("titles", 10000, "number of titles")
+		copies  = flag.Int("copies", 3, "average number of copies per title")
+		patrons = flag.Int("patrons", 5000, "number of patrons")
+		loans   = flag.Float64("loans", 0.1, "fraction of copies on loan")
+		holds   = flag.Float64("holds", 0.05, "fraction of titles with holds")
+		defects = flag.Float64("defects", 0.001, "fraction of records with deliberate defects")
+		seed    = flag.Int64("seed", 1, "random seed")
+		date    = flag.String("date", time.Now().Format(dumpDateFormat), "time of dump (YYYYMMDD-HHMMSS)")
+		outDir  = flag.String("outdir", "", "output directory (default to current working directory)")
+	)
+	flag.Parse()
+
+	if *copies < 1 || *titles < 0 || *patrons < 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	d, err := time.Parse(dumpDateFormat, *date)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var files []*os.File
+	create := func(name string) io.Writer {
+		f := mustCreate(filepath.Join(*outDir, name))
+		files = append(files, f)
+		return f
+	}
+	dumpFile := func(kind string) io.Writer {
+		return create(fmt.Sprintf("data.%s.%s.txt", kind, *date))
+	}
+	out := dumpgen.Dumps{
+		Vmarc:   dumpFile("vmarc"),
+		Emarc:   dumpFile("emarc"),
+		Exemp:   dumpFile("exemp"),
+		Laaner:  dumpFile("laaner"),
+		Lmarc:   dumpFile("lmarc"),
+		Lnel:    dumpFile("lnel"),
+		Res:     dumpFile("res"),
+		Defects: create("defects.csv"),
+	}
+
+	cfg := dumpgen.Config{
+		Titles:     *titles,
+		Copies:     *copies,
+		Patrons:    *patrons,
+		LoanRate:   *loans,
+		HoldRate:   *holds,
+		DefectRate: *defects,
+		Date:       d,
+	}
+	g := dumpgen.New(cfg, *seed, out)
+	if err := g.Run(); err != nil {
+		log.Fatal(err)
+	}
+	for _, f := range files {
+		if err := f.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	fmt.Println("Records:")
+	printCounts(g.Counts)
+	fmt.Println("Defects:")
+	printCounts(g.DefectCounts)
+}
+
+func printCounts(counts map[string]int) {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("%s\t%d\n", k, counts[k])
+	}
+}
+
+func mustCreate(s string) *os.File {
+	f, err := os.Create(s)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func init() {
+	log.SetFlags(0)
+	log.SetPrefix("gendumps: ")
+}
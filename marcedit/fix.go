@@ -0,0 +1,279 @@
+package marcedit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/boutros/marc"
+)
+
+// Fix is a transformation of records, parsed from a fix file by ParseFixes.
+type Fix struct {
+	Line int    // line in the fix file
+	Text string // the fix as written, with columns separated by spaces
+	N    int    // number of changes made by Apply so far
+
+	action         string
+	tag, code      string // field and subfield edited, or copied from
+	toTag, toCode  string // copied to, for copy and move
+	value          string // value set, or replacement for replace
+	rx             *regexp.Regexp
+	cond           *fixCond
+	fieldCondition bool // cond selects the fields edited, not the records
+}
+
+// fixCond matches fields by a subfield.
+type fixCond struct {
+	tag, code string
+	match     SubFieldFilter
+	negate    bool
+}
+
+// parseFixCond parses a condition: 245$a for fields with subfield a,
+// 245$a=v1,v2 for fields where it has one of the values, 245$a~regexp for
+// fields where it matches the regular expression, and 245$a!=v1,v2 or
+// 245$a!~regexp for fields without.
+func parseFixCond(s string) (*fixCond, error) {
+	i := strings.IndexAny(s, "=~")
+	ref := s
+	if i != -1 {
+		ref = s[:i]
+	}
+	c := &fixCond{match: Any}
+	if strings.HasSuffix(ref, "!") && i != -1 {
+		ref, c.negate = ref[:len(ref)-1], true
+	}
+	var err error
+	if c.tag, c.code, err = parseRef(ref); err != nil {
+		return nil, err
+	}
+	if i == -1 {
+		return c, nil
+	}
+	if s[i] == '=' {
+		c.match = Value(strings.Split(s[i+1:], ",")...)
+		return c, nil
+	}
+	rx, err := regexp.Compile(s[i+1:])
+	if err != nil {
+		return nil, err
+	}
+	c.match = func(sf marc.SubField) bool { return rx.MatchString(sf.Value) }
+	return c, nil
+}
+
+func (c *fixCond) field(f marc.DField) bool {
+	return f.Tag == c.tag && HasSubField(f, c.code, c.match) != c.negate
+}
+
+// parseRef parses a subfield reference, as 952$c.
+func parseRef(s string) (tag, code string, err error) {
+	if len(s) != 5 || s[3] != '$' {
+		return "", "", fmt.Errorf("invalid subfield: %q, want as 952$c", s)
+	}
+	return s[:3], s[4:], nil
+}
+
+// ParseFixes parses fixes, one per line, with tab-separated columns:
+//
+//	set	<tag$code>	<value>	[cond]	set the subfield in every field with tag,
+//		adding it if missing, and the field if there is none
+//	delete	<tag$code>	[cond]	delete the subfield, and fields left empty
+//	remove	<tag>	[cond]	remove the fields
+//	copy	<tag$code>	<tag$code>	[cond]	set the second subfield in every
+//		field with its tag to all the values of the first, as CopyFrom;
+//		fields are not added
+//	move	<tag$code>	<tag$code>	[cond]	copy and, if there is a field to copy
+//		to, delete the subfield copied from
+//	replace	<tag$code>	<regexp>	<replacement>	[cond]	replace matches of the
+//		regular expression in the subfield values; $1 in the replacement is
+//		the first submatch
+//
+// See parseFixCond for conditions. A condition on the tag edited (copied from,
+// for copy and move) selects the fields edited; a condition on another tag
+// selects the records edited. Empty lines and lines starting with # are
+// ignored. Fixes are applied in order.
+func ParseFixes(r io.Reader) ([]*Fix, error) {
+	var fixes []*Fix
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fx, err := parseFix(strings.Split(line, "\t"))
+		if err != nil {
+			return nil, fmt.Errorf("fix line %d: %v", n, err)
+		}
+		fx.Line = n
+		fixes = append(fixes, fx)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return fixes, nil
+}
+
+func parseFix(cols []string) (*Fix, error) {
+	fx := &Fix{Text: strings.Join(cols, " "), action: cols[0]}
+	args := map[string]int{"set": 2, "delete": 1, "remove": 1, "copy": 2, "move": 2, "replace": 3}[fx.action]
+	if args == 0 {
+		return nil, fmt.Errorf("unknown action: %q", fx.action)
+	}
+	if len(cols) != args+1 && len(cols) != args+2 {
+		return nil, fmt.Errorf("%s takes %d arguments and a condition, got %d", fx.action, args, len(cols)-1)
+	}
+	var err error
+	if fx.action == "remove" {
+		if len(cols[1]) != 3 {
+			return nil, fmt.Errorf("invalid tag: %q", cols[1])
+		}
+		fx.tag = cols[1]
+	} else if fx.tag, fx.code, err = parseRef(cols[1]); err != nil {
+		return nil, err
+	}
+	switch fx.action {
+	case "set":
+		fx.value = cols[2]
+	case "copy", "move":
+		if fx.toTag, fx.toCode, err = parseRef(cols[2]); err != nil {
+			return nil, err
+		}
+	case "replace":
+		if fx.rx, err = regexp.Compile(cols[2]); err != nil {
+			return nil, err
+		}
+		fx.value = cols[3]
+	}
+	if len(cols) == args+2 {
+		if fx.cond, err = parseFixCond(cols[args+1]); err != nil {
+			return nil, err
+		}
+		fx.fieldCondition = fx.cond.tag == fx.tag
+	}
+	return fx, nil
+}
+
+// LoadFixes parses the fixes in the named file.
+func LoadFixes(name string) ([]*Fix, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseFixes(f)
+}
+
+// fields matches the fields the fix edits, or copies from.
+func (fx *Fix) fields(f marc.DField) bool {
+	return f.Tag == fx.tag && (!fx.fieldCondition || fx.cond.field(f))
+}
+
+// Tags returns the tags the fix edits, copies or has a condition on.
+func (fx *Fix) Tags() []string {
+	tags := []string{fx.tag}
+	if fx.toTag != "" {
+		tags = append(tags, fx.toTag)
+	}
+	if fx.cond != nil {
+		tags = append(tags, fx.cond.tag)
+	}
+	return tags
+}
+
+// Apply applies the fix to rec, returning the number of fields or subfields
+// changed, which is also added to N.
+func (fx *Fix) Apply(rec *marc.Record) int {
+	if fx.cond != nil && !fx.fieldCondition && len(Fields(rec, fx.cond.field)) == 0 {
+		return 0
+	}
+	n := 0
+	switch fx.action {
+	case "set":
+		if len(Fields(rec, Tag(fx.tag))) == 0 && !fx.fieldCondition {
+			n = Set(rec, fx.tag, fx.code, fx.value)
+			break
+		}
+		n = Edit(rec, fx.fields, func(f *marc.DField) bool {
+			return SetSubField(f, fx.code, fx.value)
+		})
+	case "delete":
+		n = fx.deleteSubFields(rec)
+	case "remove":
+		n = len(Remove(rec, fx.fields))
+	case "copy", "move":
+		if len(Fields(rec, Tag(fx.toTag))) == 0 || (fx.tag == fx.toTag && fx.code == fx.toCode) {
+			break
+		}
+		n = CopyFrom(rec, fx.fields, fx.code, fx.toTag, fx.toCode)
+		if fx.action == "move" {
+			fx.deleteSubFields(rec)
+		}
+	case "replace":
+		Edit(rec, fx.fields, func(f *marc.DField) bool {
+			for i, sf := range f.SubFields {
+				if sf.Code != fx.code {
+					continue
+				}
+				if v := fx.rx.ReplaceAllString(sf.Value, fx.value); v != sf.Value {
+					f.SubFields[i].Value = v
+					n++
+				}
+			}
+			return false
+		})
+	}
+	fx.N += n
+	return n
+}
+
+// deleteSubFields deletes subfield code from the fields edited by the fix,
+// removing fields left without subfields, and returns the number of
+// subfields deleted.
+func (fx *Fix) deleteSubFields(rec *marc.Record) int {
+	n := 0
+	var emptied []int
+	for i := range rec.DataFields {
+		if !fx.fields(rec.DataFields[i]) {
+			continue
+		}
+		n += FilterSubFields(&rec.DataFields[i], func(sf marc.SubField) bool { return sf.Code != fx.code })
+		if len(rec.DataFields[i].SubFields) == 0 {
+			emptied = append(emptied, i)
+		}
+	}
+	for j := len(emptied) - 1; j >= 0; j-- {
+		i := emptied[j]
+		rec.DataFields = append(rec.DataFields[:i], rec.DataFields[i+1:]...)
+	}
+	return n
+}
+
+// ApplyFixes applies the fixes to rec in order, returning the number of
+// changes made.
+func ApplyFixes(rec *marc.Record, fixes []*Fix) int {
+	n := 0
+	for _, fx := range fixes {
+		n += fx.Apply(rec)
+	}
+	return n
+}
+
+// WriteFixCounts writes the number of changes made by each fix to w.
+func WriteFixCounts(w io.Writer, fixes []*Fix) error {
+	if _, err := fmt.Fprintln(w, "Changes by fix:"); err != nil {
+		return err
+	}
+	for _, fx := range fixes {
+		if _, err := fmt.Fprintf(w, "%d: %s\t%d\n", fx.Line, fx.Text, fx.N); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package marcedit
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFixes(t *testing.T) {
+	fixes, err := ParseFixes(strings.NewReader(`# shelving from 092 into the items
+move	092$a	952$c
+
+# age restriction
+replace	521$a	^(\d+)$	Aldersgrense $1	019$s
+set	942$y	LAEREMIDDEL	952$a=fbjl,fnyl
+delete	952$q	952$a!=hutl
+replace	090$c	^(\d+)\.(\d+)$	$1,$2
+remove	999
+copy	019$s	521$b	019$s~^1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := record(
+		field("019", "b", "l", "s", "10"),
+		field("090", "c", "641.3", "d", "Gra"),
+		field("092", "a", "MILJØHYLLA"),
+		field("521", "a", "10"),
+		field("952", "a", "hutl", "q", "2016-09-01"),
+		field("952", "a", "fbjl", "q", "2016-09-02"),
+		field("999", "c", "1"),
+	)
+	if n := ApplyFixes(rec, fixes); n != 8 {
+		t.Errorf("ApplyFixes: got %d changes; want 8", n)
+	}
+	want := record(
+		field("019", "b", "l", "s", "10"),
+		field("090", "c", "641,3", "d", "Gra"),
+		field("521", "a", "Aldersgrense 10", "b", "10"),
+		field("942", "y", "LAEREMIDDEL"),
+		field("952", "a", "hutl", "q", "2016-09-01", "c", "MILJØHYLLA"),
+		field("952", "a", "fbjl", "c", "MILJØHYLLA"),
+	)
+	if !reflect.DeepEqual(rec.DataFields, want.DataFields) {
+		t.Errorf("got:\n%v\nwant:\n%v", rec.DataFields, want.DataFields)
+	}
+	var counts []int
+	for _, fx := range fixes {
+		counts = append(counts, fx.N)
+	}
+	if want := []int{2, 1, 1, 1, 1, 1, 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("got counts %v; want %v", counts, want)
+	}
+
+	// conditions on the fields edited
+	rec = record(field("952", "a", "hutl"), field("952", "a", "fbjl"))
+	fixes, err = ParseFixes(strings.NewReader("set\t952$y\tL\t952$a=fbjl\nremove\t952\t952$a~^fb\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ApplyFixes(rec, fixes); len(rec.DataFields) != 1 || First(rec, "952", "y") != "" {
+		t.Errorf("got %v", rec.DataFields)
+	}
+
+	// copy and move take every value, and never add fields
+	fixes, err = ParseFixes(strings.NewReader("move\t092$a\t952$c\ncopy\t019$s\t521$a\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = record(field("019", "s", "10"), field("092", "a", "A", "a", "B"), field("952", "a", "hutl"))
+	if n := ApplyFixes(rec, fixes); n != 1 || !reflect.DeepEqual(Values(rec, "952", "c"), []string{"A", "B"}) || len(Fields(rec, Tag("521"))) != 0 {
+		t.Errorf("got %d changes: %v", n, rec.DataFields)
+	}
+	rec = record(field("092", "a", "A"))
+	if ApplyFixes(rec, fixes); len(rec.DataFields) != 1 || First(rec, "092", "a") != "A" {
+		t.Errorf("move without field to move to: got %v", rec.DataFields)
+	}
+	if got := fixes[0].Tags(); !reflect.DeepEqual(got, []string{"092", "952"}) {
+		t.Errorf("Tags: got %v", got)
+	}
+
+	for _, fix := range []string{
+		"rename\t952$a",
+		"set\t952$a",
+		"set\t952a\tx",
+		"delete\t952$a\t952$a\tx",
+		"remove\t952$a",
+		"copy\t092$a\t952",
+		"replace\t090$c\t(\t",
+		"delete\t952$a\t952$a~(",
+		"delete\t952$a\t952=x",
+	} {
+		if _, err := ParseFixes(strings.NewReader(fix)); err == nil {
+			t.Errorf("%q: got no error", fix)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+// Package marcedit selects and edits the fields and subfields of MARC records
+// by tag, code and predicate.
+//
+// Edits keep the order of the fields and subfields they do not touch, and
+// never mutate a slice while ranging over it, so that consecutive matching
+// fields and subfields are all edited.
+package marcedit
+
+import "github.com/boutros/marc"
+
+// FieldFilter is a predicate on data fields.
+type FieldFilter func(f marc.DField) bool
+
+// SubFieldFilter is a predicate on subfields.
+type SubFieldFilter func(sf marc.SubField) bool
+
+// Tag matches fields with any of the tags.
+func Tag(tags ...string) FieldFilter {
+	return func(f marc.DField) bool {
+		for _, tag := range tags {
+			if f.Tag == tag {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SubField matches fields with a subfield with code, having any of the
+// values, or any value if none are given.
+func SubField(code string, values ...string) FieldFilter {
+	match := Any
+	if len(values) > 0 {
+		match = Value(values...)
+	}
+	return func(f marc.DField) bool {
+		return HasSubField(f, code, match)
+	}
+}
+
+// And matches fields matched by all the filters.
+func And(filters ...FieldFilter) FieldFilter {
+	return func(f marc.DField) bool {
+		for _, match := range filters {
+			if !match(f) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Not matches fields not matched by filter.
+func Not(filter FieldFilter) FieldFilter {
+	return func(f marc.DField) bool {
+		return !filter(f)
+	}
+}
+
+// Any matches any subfield.
+func Any(marc.SubField) bool { return true }
+
+// Value matches subfields with any of the values.
+func Value(values ...string) SubFieldFilter {
+	return func(sf marc.SubField) bool {
+		for _, v := range values {
+			if sf.Value == v {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// HasSubField reports whether f has a subfield with code for which match
+// returns true.
+func HasSubField(f marc.DField, code string, match SubFieldFilter) bool {
+	for _, sf := range f.SubFields {
+		if sf.Code == code && match(sf) {
+			return true
+		}
+	}
+	return false
+}
+
+// Values returns the values of the subfields with code in the fields with tag.
+func Values(rec *marc.Record, tag, code string) []string {
+	var res []string
+	for _, f := range rec.DataFields {
+		if f.Tag != tag {
+			continue
+		}
+		for _, sf := range f.SubFields {
+			if sf.Code == code {
+				res = append(res, sf.Value)
+			}
+		}
+	}
+	return res
+}
+
+// First returns the value of the first subfield with code in a field with
+// tag, or "" if there is none.
+func First(rec *marc.Record, tag, code string) string {
+	for _, f := range rec.DataFields {
+		if f.Tag != tag {
+			continue
+		}
+		for _, sf := range f.SubFields {
+			if sf.Code == code {
+				return sf.Value
+			}
+		}
+	}
+	return ""
+}
+
+// Fields returns the fields matched by match.
+func Fields(rec *marc.Record, match FieldFilter) marc.DFields {
+	var res marc.DFields
+	for _, f := range rec.DataFields {
+		if match(f) {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// Filter keeps the fields for which keep returns true, returning the number
+// of fields removed.
+func Filter(rec *marc.Record, keep FieldFilter) int {
+	return len(Remove(rec, Not(keep)))
+}
+
+// Remove removes the fields matched by match, returning them.
+func Remove(rec *marc.Record, match FieldFilter) marc.DFields {
+	var removed marc.DFields
+	fields := make(marc.DFields, 0, len(rec.DataFields))
+	for _, f := range rec.DataFields {
+		if match(f) {
+			removed = append(removed, f)
+		} else {
+			fields = append(fields, f)
+		}
+	}
+	rec.DataFields = fields
+	return removed
+}
+
+// Edit calls edit with each field matched by match, returning the number of
+// fields for which it reports a change.
+func Edit(rec *marc.Record, match FieldFilter, edit func(f *marc.DField) bool) int {
+	n := 0
+	for i := range rec.DataFields {
+		if match(rec.DataFields[i]) && edit(&rec.DataFields[i]) {
+			n++
+		}
+	}
+	return n
+}
+
+// FilterSubFields keeps the subfields of f for which keep returns true,
+// returning the number of subfields removed.
+func FilterSubFields(f *marc.DField, keep SubFieldFilter) int {
+	sfs := make(marc.SubFields, 0, len(f.SubFields))
+	for _, sf := range f.SubFields {
+		if keep(sf) {
+			sfs = append(sfs, sf)
+		}
+	}
+	n := len(f.SubFields) - len(sfs)
+	f.SubFields = sfs
+	return n
+}
+
+// SetSubFields sets the value of the subfields of f with code for which match
+// returns true, returning the number of subfields changed.
+func SetSubFields(f *marc.DField, code string, match SubFieldFilter, value string) int {
+	n := 0
+	for i, sf := range f.SubFields {
+		if sf.Code == code && match(sf) && sf.Value != value {
+			f.SubFields[i].Value = value
+			n++
+		}
+	}
+	return n
+}
+
+// SetSubField sets the value of the subfields of f with code, adding one if
+// there is none. It reports whether f changed.
+func SetSubField(f *marc.DField, code, value string) bool {
+	if !HasSubField(*f, code, Any) {
+		f.SubFields = append(f.SubFields, marc.SubField{Code: code, Value: value})
+		return true
+	}
+	return SetSubFields(f, code, Any, value) > 0
+}
+
+// Set sets the value of subfield code in every field with tag, appending a
+// new field if there is none. It returns the number of fields changed.
+func Set(rec *marc.Record, tag, code, value string) int {
+	n := Edit(rec, Tag(tag), func(f *marc.DField) bool {
+		return SetSubField(f, code, value)
+	})
+	if len(Fields(rec, Tag(tag))) == 0 {
+		Append(rec, marc.DField{Tag: tag, Ind1: " ", Ind2: " ", SubFields: marc.SubFields{{Code: code, Value: value}}})
+		n++
+	}
+	return n
+}
+
+// Delete deletes the subfields with code from the fields with tag, removing
+// fields left without subfields. It returns the number of subfields deleted.
+func Delete(rec *marc.Record, tag, code string) int {
+	n := 0
+	Edit(rec, Tag(tag), func(f *marc.DField) bool {
+		n += FilterSubFields(f, func(sf marc.SubField) bool { return sf.Code != code })
+		return false
+	})
+	Filter(rec, func(f marc.DField) bool { return f.Tag != tag || len(f.SubFields) > 0 })
+	return n
+}
+
+// SetValues replaces the subfields of f with code by subfields with the
+// values, in place of the first of them, or at the end if there is none. It
+// reports whether f changed.
+func SetValues(f *marc.DField, code string, values []string) bool {
+	var sfs marc.SubFields
+	i, old := -1, subFieldValues(*f, code)
+	for _, sf := range f.SubFields {
+		if sf.Code != code {
+			sfs = append(sfs, sf)
+		} else if i == -1 {
+			i = len(sfs)
+		}
+	}
+	if equal(old, values) {
+		return false
+	}
+	if i == -1 {
+		i = len(sfs)
+	}
+	add := make(marc.SubFields, len(values))
+	for j, v := range values {
+		add[j] = marc.SubField{Code: code, Value: v}
+	}
+	f.SubFields = append(sfs[:i:i], append(add, sfs[i:]...)...)
+	return true
+}
+
+// subFieldValues returns the values of the subfields of f with code.
+func subFieldValues(f marc.DField, code string) []string {
+	var res []string
+	for _, sf := range f.SubFields {
+		if sf.Code == code {
+			res = append(res, sf.Value)
+		}
+	}
+	return res
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Copy sets subfield toCode of the fields with toTag to every value of
+// subfield fromCode in the fields with fromTag, as SetValues; within a tag,
+// each field is copied from itself. No fields are added. It returns the number
+// of fields changed, 0 if there is no value to copy.
+func Copy(rec *marc.Record, fromTag, fromCode, toTag, toCode string) int {
+	return CopyFrom(rec, Tag(fromTag), fromCode, toTag, toCode)
+}
+
+// CopyFrom copies as Copy from the fields matched by from, all with one tag;
+// if it is toTag, each field is copied from itself.
+func CopyFrom(rec *marc.Record, from FieldFilter, fromCode, toTag, toCode string) int {
+	if len(Fields(rec, And(from, Tag(toTag)))) > 0 {
+		return Edit(rec, from, func(f *marc.DField) bool {
+			vals := subFieldValues(*f, fromCode)
+			return len(vals) > 0 && SetValues(f, toCode, vals)
+		})
+	}
+	var vals []string
+	for _, f := range Fields(rec, from) {
+		vals = append(vals, subFieldValues(f, fromCode)...)
+	}
+	if len(vals) == 0 {
+		return 0
+	}
+	return Edit(rec, Tag(toTag), func(f *marc.DField) bool {
+		return SetValues(f, toCode, vals)
+	})
+}
+
+// Move copies a subfield as Copy and, if there is a field to copy to,
+// deletes the subfields copied from.
+func Move(rec *marc.Record, fromTag, fromCode, toTag, toCode string) int {
+	if (fromTag == toTag && fromCode == toCode) || len(Fields(rec, Tag(toTag))) == 0 {
+		return 0
+	}
+	n := Copy(rec, fromTag, fromCode, toTag, toCode)
+	Delete(rec, fromTag, fromCode)
+	return n
+}
+
+// Append adds fields to rec, each after the last field with a tag sorting
+// before or equal to its own, so that the fields of a record sorted by tag
+// stay sorted, without reordering the existing fields.
+func Append(rec *marc.Record, fields ...marc.DField) {
+	for _, f := range fields {
+		i := len(rec.DataFields)
+		for i > 0 && rec.DataFields[i-1].Tag > f.Tag {
+			i--
+		}
+		rec.DataFields = append(rec.DataFields, marc.DField{})
+		copy(rec.DataFields[i+1:], rec.DataFields[i:])
+		rec.DataFields[i] = f
+	}
+}
@@ -0,0 +1,206 @@
+package marcedit
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"testing/quick"
+
+	"github.com/boutros/marc"
+)
+
+func field(tag string, sfs ...string) marc.DField {
+	f := marc.DField{Tag: tag, Ind1: " ", Ind2: " "}
+	for i := 0; i+1 < len(sfs); i += 2 {
+		f.SubFields = append(f.SubFields, marc.SubField{Code: sfs[i], Value: sfs[i+1]})
+	}
+	return f
+}
+
+func record(fields ...marc.DField) *marc.Record {
+	return &marc.Record{DataFields: fields}
+}
+
+func tags(rec *marc.Record) []string {
+	var res []string
+	for _, f := range rec.DataFields {
+		res = append(res, f.Tag)
+	}
+	return res
+}
+
+func TestEdits(t *testing.T) {
+	rec := record(
+		field("090", "c", "641.3", "d", "Gra"),
+		field("019", "b", "l", "s", "10"),
+		field("092", "a", "MILJØHYLLA"),
+		field("521", "a", "Fra 10 år"),
+		field("952", "a", "hutl", "q", "2016-09-01", "q", "2016-09-02"),
+		field("952", "a", "fbjl"),
+		field("999", "c", "1"),
+	)
+	if got := First(rec, "019", "s"); got != "10" {
+		t.Errorf("First: got %q; want 10", got)
+	}
+	if got := Values(rec, "952", "a"); !reflect.DeepEqual(got, []string{"hutl", "fbjl"}) {
+		t.Errorf("Values: got %v", got)
+	}
+	if n := Delete(rec, "952", "q"); n != 2 || len(Values(rec, "952", "q")) != 0 {
+		t.Errorf("Delete: deleted %d; got %v", n, rec.DataFields[4])
+	}
+	if n := Delete(rec, "521", "a"); n != 1 || len(Fields(rec, Tag("521"))) != 0 {
+		t.Error("Delete: field without subfields not removed")
+	}
+	if n := Move(rec, "092", "a", "952", "c"); n != 2 || len(Fields(rec, Tag("092"))) != 0 || !reflect.DeepEqual(Values(rec, "952", "c"), []string{"MILJØHYLLA", "MILJØHYLLA"}) {
+		t.Errorf("Move: got %v", rec.DataFields)
+	}
+	if n := Copy(rec, "019", "s", "521", "a"); n != 0 || len(Fields(rec, Tag("521"))) != 0 {
+		t.Errorf("Copy to missing field: got %v", rec.DataFields)
+	}
+	if n := Move(rec, "019", "s", "521", "a"); n != 0 || First(rec, "019", "s") != "10" {
+		t.Errorf("Move to missing field: got %v", rec.DataFields)
+	}
+	if n := Copy(rec, "245", "a", "521", "a"); n != 0 {
+		t.Errorf("Copy from missing subfield: got %d; want 0", n)
+	}
+	removed := Remove(rec, And(Tag("952"), SubField("a", "fbjl", "fnyl")))
+	if len(removed) != 1 || First(&marc.Record{DataFields: removed}, "952", "a") != "fbjl" {
+		t.Errorf("Remove: got %v", removed)
+	}
+	Append(rec, field("942", "y", "BOK"))
+	if want := []string{"090", "019", "942", "952", "999"}; !reflect.DeepEqual(tags(rec), want) {
+		t.Errorf("got tags %v; want %v", tags(rec), want)
+	}
+	if n := Filter(rec, Not(Tag("999"))); n != 1 {
+		t.Errorf("Filter: removed %d; want 1", n)
+	}
+	if n := Edit(rec, SubField("a", "hutl"), func(f *marc.DField) bool { return SetSubField(f, "b", "hutl") }); n != 1 || First(rec, "952", "b") != "hutl" {
+		t.Errorf("Edit: got %v", rec.DataFields)
+	}
+}
+
+func TestCopyValues(t *testing.T) {
+	// every value is copied, replacing the values copied to
+	rec := record(
+		field("092", "a", "A", "a", "B"),
+		field("952", "a", "hutl", "c", "X", "o", "1"),
+		field("952", "a", "fsto"),
+	)
+	if n := Move(rec, "092", "a", "952", "c"); n != 2 || len(Fields(rec, Tag("092"))) != 0 {
+		t.Errorf("Move: got %d; %v", n, rec.DataFields)
+	}
+	want := record(
+		field("952", "a", "hutl", "c", "A", "c", "B", "o", "1"),
+		field("952", "a", "fsto", "c", "A", "c", "B"),
+	)
+	if !reflect.DeepEqual(rec.DataFields, want.DataFields) {
+		t.Errorf("got:\n%v\nwant:\n%v", rec.DataFields, want.DataFields)
+	}
+
+	// within a tag, each field is copied from itself
+	rec = record(field("952", "a", "hutl", "b", "fsto"), field("952", "a", "fmaj"))
+	if n := Copy(rec, "952", "a", "952", "b"); n != 2 || !reflect.DeepEqual(Values(rec, "952", "b"), []string{"hutl", "fmaj"}) {
+		t.Errorf("Copy within tag: got %d; %v", n, rec.DataFields)
+	}
+	if n := Copy(rec, "952", "a", "952", "b"); n != 0 {
+		t.Errorf("Copy of copied values: got %d changes; want 0", n)
+	}
+}
+
+// testRecord is a random record with few tags, codes and values, so that
+// consecutive matching fields and subfields are common.
+type testRecord struct {
+	rec *marc.Record
+}
+
+func (testRecord) Generate(rnd *rand.Rand, size int) reflect.Value {
+	pick := func(s ...string) string { return s[rnd.Intn(len(s))] }
+	rec := &marc.Record{}
+	for i := rnd.Intn(size + 1); i > 0; i-- {
+		f := marc.DField{Tag: pick("100", "245", "952", "952"), Ind1: " ", Ind2: " "}
+		for j := rnd.Intn(6); j > 0; j-- {
+			f.SubFields = append(f.SubFields, marc.SubField{Code: pick("a", "q"), Value: pick("1", "2")})
+		}
+		rec.DataFields = append(rec.DataFields, f)
+	}
+	return reflect.ValueOf(testRecord{rec})
+}
+
+func (t testRecord) clone() *marc.Record {
+	rec := &marc.Record{}
+	for _, f := range t.rec.DataFields {
+		f.SubFields = append(marc.SubFields(nil), f.SubFields...)
+		rec.DataFields = append(rec.DataFields, f)
+	}
+	return rec
+}
+
+func TestProperties(t *testing.T) {
+	// Delete removes every subfield with the code, and keeps the others in order
+	deletes := func(tr testRecord) bool {
+		rec := tr.clone()
+		n := Delete(rec, "952", "q")
+		var want []marc.SubField
+		deleted := 0
+		for _, f := range tr.rec.DataFields {
+			for _, sf := range f.SubFields {
+				if f.Tag == "952" && sf.Code == "q" {
+					deleted++
+					continue
+				}
+				want = append(want, sf)
+			}
+		}
+		var got []marc.SubField
+		for _, f := range rec.DataFields {
+			got = append(got, f.SubFields...)
+		}
+		return n == deleted && reflect.DeepEqual(got, want)
+	}
+	if err := quick.Check(deletes, nil); err != nil {
+		t.Error(err)
+	}
+
+	// Remove and the fields kept partition the record, in order
+	removes := func(tr testRecord) bool {
+		rec := tr.clone()
+		match := And(Tag("952"), SubField("a", "1"))
+		removed := Remove(rec, match)
+		i, j := 0, 0
+		for _, f := range tr.rec.DataFields {
+			if match(f) {
+				if j >= len(removed) || !reflect.DeepEqual(removed[j], f) {
+					return false
+				}
+				j++
+			} else {
+				if i >= len(rec.DataFields) || !reflect.DeepEqual(rec.DataFields[i], f) {
+					return false
+				}
+				i++
+			}
+		}
+		return i == len(rec.DataFields) && j == len(removed)
+	}
+	if err := quick.Check(removes, nil); err != nil {
+		t.Error(err)
+	}
+
+	// Append keeps a sorted record sorted, and the existing fields in order
+	appends := func(tr testRecord, tag uint16) bool {
+		rec := tr.clone()
+		sort.Stable(rec.DataFields)
+		before := append(marc.DFields(nil), rec.DataFields...)
+		f := field([]string{"001", "245", "500", "952", "999"}[tag%5], "a", "new")
+		Append(rec, f)
+		if !sort.IsSorted(rec.DataFields) || len(rec.DataFields) != len(before)+1 {
+			return false
+		}
+		kept := Remove(rec, func(g marc.DField) bool { return reflect.DeepEqual(g, f) })
+		return len(kept) == 1 && (len(before) == 0 || reflect.DeepEqual(rec.DataFields, before))
+	}
+	if err := quick.Check(appends, nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,198 @@
+// marcfix applies fixes (see marcedit.ParseFixes) to a marcdatabase.
+//
+//	marcfix test -fix <file> <marcdatabase>   preview the changes on a sample of records
+//	marcfix apply -fix <file> <marcdatabase>  dump the fixed records to standard out
+//
+// catmassage and cleanitems run the same fixes with -fix. transformmarc works
+// on records of another MARC library; run marcfix apply on its input instead.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/boutros/marc"
+	"github.com/digibib/migtools/marcedit"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("marcfix: ")
+	if len(os.Args) < 2 || (os.Args[1] != "test" && os.Args[1] != "apply") {
+		fmt.Fprintf(os.Stderr, "Usage: marcfix test|apply [flags] <marcdatabase>\n")
+		os.Exit(1)
+	}
+	cmd := os.Args[1]
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	fixFile := fs.String("fix", "", "fix file")
+	sample := fs.Int("sample", 1000, "test: number of records to read, -1 for all")
+	show := fs.Int("show", 10, "test: number of changed records to show")
+	skip := fs.Int("skip", 0, "skip first n records")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: marcfix %s [flags] <marcdatabase>\n", cmd)
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[2:])
+	if *fixFile == "" || fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	fixes, err := marcedit.LoadFixes(*fixFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	// Detect format
+	sniff := make([]byte, 64)
+	_, err = f.Read(sniff)
+	if err != nil {
+		log.Fatal(err)
+	}
+	format := marc.DetectFormat(sniff)
+	switch format {
+	case marc.MARC, marc.LineMARC, marc.MARCXML:
+		break
+	default:
+		log.Fatal("Unknown MARC format")
+	}
+
+	// rewind reader
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dec := marc.NewDecoder(f, format)
+	if cmd == "test" {
+		if err := test(os.Stdout, dec, fixes, *skip, *sample, *show); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	enc := marc.NewEncoder(os.Stdout, format)
+	c := 0
+	for rec, err := dec.Decode(); err != io.EOF; rec, err = dec.Decode() {
+		if err != nil {
+			log.Fatal(err)
+		}
+		if c++; c <= *skip {
+			continue
+		}
+		marcedit.ApplyFixes(rec, fixes)
+		if err := enc.Encode(rec); err != nil {
+			log.Fatal(err)
+		}
+	}
+	enc.Flush()
+	if err := marcedit.WriteFixCounts(os.Stderr, fixes); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// test applies the fixes to sample records after skipping skip, writing the
+// changes to the first show records changed, and the number of changes by
+// each fix, to w.
+func test(w io.Writer, dec *marc.Decoder, fixes []*marcedit.Fix, skip, sample, show int) error {
+	read, changed := 0, 0
+	c := 0
+	for rec, err := dec.Decode(); err != io.EOF; rec, err = dec.Decode() {
+		if err != nil {
+			return err
+		}
+		if c++; c <= skip {
+			continue
+		}
+		if read == sample {
+			break
+		}
+		read++
+		before := lines(rec)
+		if marcedit.ApplyFixes(rec, fixes) == 0 {
+			continue
+		}
+		changed++
+		if changed > show {
+			continue
+		}
+		fmt.Fprintf(w, "Record %d (001 %s):\n", c, controlField(rec, "001"))
+		for _, l := range diff(before, lines(rec)) {
+			fmt.Fprintln(w, l)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "Records read:\t%d\nRecords changed:\t%d\n", read, changed)
+	return marcedit.WriteFixCounts(w, fixes)
+}
+
+func controlField(rec *marc.Record, tag string) string {
+	for _, f := range rec.CtrlFields {
+		if f.Tag == tag {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// lines returns the data fields of rec in line-marc.
+func lines(rec *marc.Record) []string {
+	var res []string
+	for _, f := range rec.DataFields {
+		l := "*" + f.Tag + f.Ind1 + f.Ind2
+		for _, sf := range f.SubFields {
+			l += "$" + sf.Code + sf.Value
+		}
+		res = append(res, l)
+	}
+	return res
+}
+
+// diff returns the lines of a longest common subsequence of before and
+// after prefixed by "  ", and the others by "- " if only in before and "+ "
+// if only in after.
+func diff(before, after []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of
+	// before[i:] and after[j:]
+	lcs := make([][]int, len(before)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(after)+1)
+	}
+	for i := len(before) - 1; i >= 0; i-- {
+		for j := len(after) - 1; j >= 0; j-- {
+			if before[i] == after[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var res []string
+	i, j := 0, 0
+	for i < len(before) || j < len(after) {
+		switch {
+		case i < len(before) && j < len(after) && before[i] == after[j]:
+			res = append(res, "  "+before[i])
+			i++
+			j++
+		case j == len(after) || (i < len(before) && lcs[i+1][j] >= lcs[i][j+1]):
+			res = append(res, "- "+before[i])
+			i++
+		default:
+			res = append(res, "+ "+after[j])
+			j++
+		}
+	}
+	return res
+}
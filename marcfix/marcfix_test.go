@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/boutros/marc"
+	"github.com/digibib/migtools/marcedit"
+)
+
+func TestDiff(t *testing.T) {
+	got := diff([]string{"*090  $c641.3", "*092  $aX", "*952  $ahutl"}, []string{"*090  $c641,3", "*952  $ahutl$cX"})
+	want := []string{"- *090  $c641.3", "- *092  $aX", "- *952  $ahutl", "+ *090  $c641,3", "+ *952  $ahutl$cX"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	got = diff([]string{"*019  $bl", "*092  $aX", "*245  $aT"}, []string{"*019  $bl", "*245  $aT", "*952  $cX"})
+	want = []string{"  *019  $bl", "- *092  $aX", "  *245  $aT", "+ *952  $cX"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestTest(t *testing.T) {
+	fixes, err := marcedit.ParseFixes(strings.NewReader("move\t092$a\t952$c\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := `*00101
+*092  $aMILJØHYLLA
+*952  $ahutl
+^
+*00102
+*952  $ahutl
+^
+*00103
+*092  $aKRIM
+^
+`
+	var buf bytes.Buffer
+	dec := marc.NewDecoder(strings.NewReader(db), marc.LineMARC)
+	if err := test(&buf, dec, fixes, 0, 2, 10); err != nil {
+		t.Fatal(err)
+	}
+	want := `Record 1 (001 01):
+- *092  $aMILJØHYLLA
+- *952  $ahutl
++ *952  $ahutl$cMILJØHYLLA
+
+Records read:	2
+Records changed:	1
+Changes by fix:
+1: move 092$a 952$c	1
+`
+	if buf.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
@@ -0,0 +1,228 @@
+// Package patrondump reads the laaner, lnel and lmarc patron dumps of
+// Bibliofil, and joins them on borrower number, in memory or by sorting them
+// on disk. Records which cannot be read are given to Rejects, so that the
+// rest of the dumps can be migrated.
+package patrondump
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/boutros/marc"
+)
+
+// Record is a record of a dump, with its borrower number.
+type Record struct {
+	Lnr  int
+	KV   map[string]string // laaner and lnel
+	MARC *marc.Record      // lmarc
+}
+
+// Reader returns the next record of a dump, or io.EOF at the end.
+type Reader func() (Record, error)
+
+// recordWriter writes records of a dump.
+type recordWriter interface {
+	Write(rec Record) error
+	Flush() error
+}
+
+// rejectFunc is given records which cannot be read, with the line they start
+// at. It returns an error if reading should be aborted.
+type rejectFunc func(line int, raw []byte, err error) error
+
+// Format reads and writes the records of a dump.
+type Format struct {
+	Name      string
+	newReader func(raw *rawRecords, reject rejectFunc) Reader
+	newWriter func(w io.Writer) recordWriter
+}
+
+// The formats of the patron dumps.
+var (
+	Laaner = Format{"laaner", newKVReader("ln_nr"), newKVWriter}
+	Lnel   = Format{"lnel", newKVReader("lnel_nr"), newKVWriter}
+	Lmarc  = Format{"lmarc", newLmarcReader, newLmarcWriter}
+)
+
+// Reader returns a reader of the dump in r. Records which cannot be read are
+// given to rej; if rej is nil, reading fails on the first of them.
+func (f Format) Reader(r io.Reader, rej *Rejects) Reader {
+	reject := func(line int, raw []byte, err error) error {
+		return fmt.Errorf("%s: line %d: %v", f.Name, line, err)
+	}
+	if rej != nil {
+		reject = func(line int, raw []byte, err error) error {
+			return rej.Add(f.Name, line, raw, err)
+		}
+	}
+	return f.newReader(&rawRecords{r: bufio.NewReader(r)}, reject)
+}
+
+// rawRecords splits a dump into raw records, each ending with a line
+// starting with '^', so that a bad record does not affect the next.
+type rawRecords struct {
+	r    *bufio.Reader
+	line int // lines read
+}
+
+// Next returns the next raw record, and the line it starts at.
+func (rr *rawRecords) Next() ([]byte, int, error) {
+	start := rr.line + 1
+	var rec []byte
+	for {
+		l, err := rr.r.ReadBytes('\n')
+		if len(l) > 0 {
+			rr.line++
+			rec = append(rec, l...)
+			if l[0] == '^' {
+				return rec, start, nil
+			}
+		}
+		if err == io.EOF && len(bytes.TrimSpace(rec)) > 0 {
+			// last record without end of record marker
+			if rec[len(rec)-1] != '\n' {
+				rec = append(rec, '\n')
+			}
+			return rec, start, nil
+		}
+		if err != nil {
+			return nil, start, err
+		}
+	}
+}
+
+// newKVReader returns a reader of key-value dumps, with the borrower number
+// in key. Records without it are skipped.
+func newKVReader(key string) func(*rawRecords, rejectFunc) Reader {
+	return func(rr *rawRecords, reject rejectFunc) Reader {
+		return func() (Record, error) {
+			for {
+				raw, line, err := rr.Next()
+				if err != nil {
+					return Record{}, err
+				}
+				rec, err := decodeKV(raw)
+				if err == io.EOF || (err == nil && rec[key] == "") {
+					continue
+				}
+				var n int
+				if err == nil {
+					if n, err = strconv.Atoi(rec[key]); err != nil {
+						err = fmt.Errorf("%s: %v", key, err)
+					}
+				}
+				if err != nil {
+					if err := reject(line, raw, err); err != nil {
+						return Record{}, err
+					}
+					continue
+				}
+				return Record{Lnr: n, KV: rec}, nil
+			}
+		}
+	}
+}
+
+// newLmarcReader returns a reader of line-marc dumps.
+func newLmarcReader(rr *rawRecords, reject rejectFunc) Reader {
+	return func() (Record, error) {
+		for {
+			raw, line, err := rr.Next()
+			if err != nil {
+				return Record{}, err
+			}
+			rec, err := decodeLmarc(raw)
+			if err == io.EOF || (err == nil && len(rec.CtrlFields) == 0 && len(rec.DataFields) == 0) {
+				continue
+			}
+			var n int
+			if err == nil {
+				n, err = Borrowernumber(rec)
+			}
+			if err != nil {
+				if err := reject(line, raw, err); err != nil {
+					return Record{}, err
+				}
+				continue
+			}
+			return Record{Lnr: n, MARC: rec}, nil
+		}
+	}
+}
+
+// Borrowernumber returns the borrower number of an lmarc record, in 001.
+func Borrowernumber(r *marc.Record) (int, error) {
+	for _, cf := range r.CtrlFields {
+		if cf.Tag == "001" {
+			return strconv.Atoi(cf.Value)
+		}
+	}
+	return 0, errors.New("no borrowernumber in lmarc record")
+}
+
+// decodeKV decodes a raw key-value record, turning a panic in the
+// decoder on malformed input into an error.
+func decodeKV(raw []byte) (rec map[string]string, err error) {
+	defer recoverMalformed(&err)
+	return NewKVDecoder(bytes.NewReader(raw)).Decode()
+}
+
+// decodeLmarc decodes a raw line-marc record, as decodeKV.
+func decodeLmarc(raw []byte) (rec *marc.Record, err error) {
+	defer recoverMalformed(&err)
+	rec, err = marc.NewDecoder(bytes.NewReader(raw), marc.LineMARC).Decode()
+	if err == nil && rec == nil {
+		err = errors.New("malformed record")
+	}
+	return rec, err
+}
+
+func recoverMalformed(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("malformed record: %v", r)
+	}
+}
+
+type kvWriter struct {
+	enc *KVEncoder
+}
+
+func newKVWriter(w io.Writer) recordWriter {
+	return kvWriter{enc: NewKVEncoder(w)}
+}
+
+func (w kvWriter) Write(rec Record) error {
+	keys := make([]string, 0, len(rec.KV))
+	for k := range rec.KV {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return w.enc.Encode(rec.KV, keys)
+}
+
+func (w kvWriter) Flush() error {
+	return w.enc.Flush()
+}
+
+type lmarcWriter struct {
+	enc *marc.Encoder
+}
+
+func newLmarcWriter(w io.Writer) recordWriter {
+	return lmarcWriter{enc: marc.NewEncoder(w, marc.LineMARC)}
+}
+
+func (w lmarcWriter) Write(rec Record) error {
+	return w.enc.Encode(rec.MARC)
+}
+
+func (w lmarcWriter) Flush() error {
+	w.enc.Flush()
+	return nil
+}
@@ -0,0 +1,145 @@
+package patrondump
+
+import (
+	"container/heap"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// sortDump sorts the dump by borrower number, returning the path of the
+// sorted dump in dir. At most chunk records are held in memory: the dump is
+// split into sorted runs on disk, which are merged. The sort is stable.
+// Records which cannot be read are given to rej.
+func sortDump(f Format, r io.Reader, rej *Rejects, dir string, chunk int) (string, error) {
+	read := f.Reader(r, rej)
+	var runs []string
+	defer func() {
+		for _, run := range runs {
+			os.Remove(run)
+		}
+	}()
+	for eof := false; !eof; {
+		recs := make([]Record, 0, chunk)
+		for len(recs) < chunk {
+			rec, err := read()
+			if err == io.EOF {
+				eof = true
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+			recs = append(recs, rec)
+		}
+		if len(recs) == 0 && len(runs) > 0 {
+			break
+		}
+		sort.SliceStable(recs, func(i, j int) bool { return recs[i].Lnr < recs[j].Lnr })
+		run, err := writeRun(f, dir, func(w recordWriter) error {
+			for _, rec := range recs {
+				if err := w.Write(rec); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		runs = append(runs, run)
+	}
+	if len(runs) == 1 {
+		sorted := runs[0]
+		runs = nil
+		return sorted, nil
+	}
+	return mergeRuns(f, dir, runs)
+}
+
+// writeRun writes records to a new file in dir, returning its path.
+func writeRun(f Format, dir string, write func(recordWriter) error) (string, error) {
+	out, err := ioutil.TempFile(dir, "patrondump-"+f.Name+"-")
+	if err != nil {
+		return "", err
+	}
+	w := f.newWriter(out)
+	if err := write(w); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", err
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), out.Close()
+}
+
+// mergeRuns merges sorted runs into one sorted dump. Of records with the same
+// borrower number, those of earlier runs come first.
+func mergeRuns(f Format, dir string, runs []string) (string, error) {
+	var h runHeap
+	for i, run := range runs {
+		in, err := os.Open(run)
+		if err != nil {
+			return "", err
+		}
+		defer in.Close()
+		read := f.Reader(in, nil)
+		rec, err := read()
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		h = append(h, runHead{rec: rec, run: i, read: read})
+	}
+	heap.Init(&h)
+	return writeRun(f, dir, func(w recordWriter) error {
+		for h.Len() > 0 {
+			if err := w.Write(h[0].rec); err != nil {
+				return err
+			}
+			rec, err := h[0].read()
+			switch err {
+			case nil:
+				h[0].rec = rec
+				heap.Fix(&h, 0)
+			case io.EOF:
+				heap.Pop(&h)
+			default:
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// runHead is the next record of a sorted run.
+type runHead struct {
+	rec  Record
+	run  int
+	read Reader
+}
+
+type runHeap []runHead
+
+func (h runHeap) Len() int { return len(h) }
+func (h runHeap) Less(i, j int) bool {
+	if h[i].rec.Lnr != h[j].rec.Lnr {
+		return h[i].rec.Lnr < h[j].rec.Lnr
+	}
+	return h[i].run < h[j].run
+}
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(runHead)) }
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
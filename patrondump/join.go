@@ -0,0 +1,252 @@
+package patrondump
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/boutros/marc"
+)
+
+// Sources are the source records of a patron, joined on borrower number.
+type Sources struct {
+	Lnr          int
+	Laaner, Lnel map[string]string
+	Lmarc        *marc.Record // nil if none
+}
+
+// Source yields the source records of every patron in laaner.
+type Source interface {
+	Each(fn func(*Sources)) error
+}
+
+// MemSource joins the dumps by indexing them in memory.
+type MemSource struct {
+	laaner, lnel map[int]map[string]string
+	lmarc        map[int]*marc.Record
+}
+
+// NewMemSource indexes the dumps. Of records with the same borrower
+// number, the last is kept. Records which cannot be read are given to rej.
+func NewMemSource(laaner, lmarc, lnel io.Reader, rej *Rejects) (*MemSource, error) {
+	s := &MemSource{
+		laaner: make(map[int]map[string]string),
+		lnel:   make(map[int]map[string]string),
+		lmarc:  make(map[int]*marc.Record),
+	}
+	log.Println("start indexing resources")
+
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	wg.Add(3)
+	go func() {
+		errs[0] = index(Lmarc, lmarc, rej, func(rec Record) { s.lmarc[rec.Lnr] = rec.MARC })
+		wg.Done()
+	}()
+	go func() {
+		errs[1] = index(Laaner, laaner, rej, func(rec Record) { s.laaner[rec.Lnr] = rec.KV })
+		wg.Done()
+	}()
+	go func() {
+		errs[2] = index(Lnel, lnel, rej, func(rec Record) { s.lnel[rec.Lnr] = rec.KV })
+		wg.Done()
+	}()
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Println("done indexing resources")
+	return s, nil
+}
+
+func index(f Format, r io.Reader, rej *Rejects, add func(Record)) error {
+	read := f.Reader(r, rej)
+	for rec, err := read(); err != io.EOF; rec, err = read() {
+		if err != nil {
+			return fmt.Errorf("indexing %s: %v", f.Name, err)
+		}
+		add(rec)
+	}
+	log.Printf("done indexing %s", f.Name)
+	return nil
+}
+
+// Each calls fn with the sources of every patron.
+func (s *MemSource) Each(fn func(*Sources)) error {
+	for lnr, laaner := range s.laaner {
+		fn(&Sources{Lnr: lnr, Laaner: laaner, Lnel: s.lnel[lnr], Lmarc: s.lmarc[lnr]})
+	}
+	return nil
+}
+
+// StreamSource joins dumps sorted by borrower number, reading them
+// record by record, so memory use is bounded regardless of patron count.
+type StreamSource struct {
+	laaner, lmarc, lnel string // paths of sorted dumps
+	temp                []string
+	rej                 *Rejects
+}
+
+// NewStreamSource returns a source joining the dumps at the given paths.
+// Unless sorted is true, the dumps are first sorted by borrower number into
+// temporary files in dir, holding at most chunk records in memory.
+// Records which cannot be read are given to rej.
+func NewStreamSource(laaner, lmarc, lnel string, sorted bool, dir string, chunk int, rej *Rejects) (*StreamSource, error) {
+	s := &StreamSource{laaner: laaner, lmarc: lmarc, lnel: lnel, rej: rej}
+	if sorted {
+		return s, nil
+	}
+	for _, d := range []struct {
+		f    Format
+		path *string
+	}{
+		{Laaner, &s.laaner},
+		{Lmarc, &s.lmarc},
+		{Lnel, &s.lnel},
+	} {
+		log.Printf("sorting %s", d.f.Name)
+		in, err := os.Open(*d.path)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		sorted, err := sortDump(d.f, in, rej, dir, chunk)
+		in.Close()
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("sorting %s: %v", d.f.Name, err)
+		}
+		*d.path = sorted
+		s.temp = append(s.temp, sorted)
+	}
+	log.Println("done sorting resources")
+	return s, nil
+}
+
+// Each joins laaner with lnel and lmarc in one pass over the sorted dumps.
+func (s *StreamSource) Each(fn func(*Sources)) error {
+	var readers []*sortedReader
+	for _, d := range []struct {
+		f    Format
+		path string
+	}{
+		{Laaner, s.laaner},
+		{Lnel, s.lnel},
+		{Lmarc, s.lmarc},
+	} {
+		in, err := os.Open(d.path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		readers = append(readers, &sortedReader{name: d.f.Name, read: d.f.Reader(in, s.rej)})
+	}
+	laaner, lnel, lmarc := readers[0], readers[1], readers[2]
+
+	for {
+		l, err := laaner.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		src := &Sources{Lnr: l.Lnr, Laaner: l.KV}
+		e, err := lnel.seek(l.Lnr)
+		if err != nil {
+			return err
+		}
+		if e != nil {
+			src.Lnel = e.KV
+		}
+		mr, err := lmarc.seek(l.Lnr)
+		if err != nil {
+			return err
+		}
+		if mr != nil {
+			src.Lmarc = mr.MARC
+		}
+		fn(src)
+	}
+}
+
+// Close removes the temporary sorted dumps.
+func (s *StreamSource) Close() error {
+	for _, path := range s.temp {
+		os.Remove(path)
+	}
+	return nil
+}
+
+// sortedReader reads a dump sorted by borrower number. Of records with the
+// same borrower number, only the last is returned, as when indexing in memory.
+type sortedReader struct {
+	name   string
+	read   Reader
+	buf    *Record // read ahead, not yet returned by Next
+	peeked *Record // returned by Next, not yet by seek
+	prev   int     // borrower number of the last record returned by Next
+	eof    bool
+	begun  bool
+}
+
+// Next returns the next record, or an error if the dump is not sorted.
+func (r *sortedReader) Next() (*Record, error) {
+	rec := r.buf
+	r.buf = nil
+	for !r.eof {
+		next, err := r.read()
+		if err == io.EOF {
+			r.eof = true
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", r.name, err)
+		}
+		if rec != nil && next.Lnr != rec.Lnr {
+			r.buf = &next
+			break
+		}
+		rec = &next
+	}
+	if rec == nil {
+		return nil, io.EOF
+	}
+	if r.begun && rec.Lnr <= r.prev {
+		return nil, fmt.Errorf("%s is not sorted by borrower number: %d after %d", r.name, rec.Lnr, r.prev)
+	}
+	r.prev, r.begun = rec.Lnr, true
+	return rec, nil
+}
+
+// seek returns the record with the borrower number, skipping records with
+// lower numbers, or nil if there is none.
+func (r *sortedReader) seek(lnr int) (*Record, error) {
+	for {
+		if r.peeked == nil {
+			rec, err := r.Next()
+			if err == io.EOF {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			r.peeked = rec
+		}
+		switch {
+		case r.peeked.Lnr < lnr:
+			r.peeked = nil
+		case r.peeked.Lnr == lnr:
+			rec := r.peeked
+			r.peeked = nil
+			return rec, nil
+		default:
+			return nil, nil
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package patrondump
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testDumps returns unsorted dumps with n patrons, some of them repeated,
+// and lnel and lmarc records for every other patron.
+func testDumps(n int) (laaner, lmarc, lnel string) {
+	var l, m, e strings.Builder
+	for i := 0; i < n; i++ {
+		lnr := (i*7)%n + 1
+		fmt.Fprintf(&l, "ln_nr |%d|\nln_navn |Testesen, Test %d|\nln_melding |a|b|\n^\n", lnr, i)
+		if lnr%2 == 0 {
+			fmt.Fprintf(&e, "lnel_nr |%d|\nlnel_epost |test%d@example.com|\n^\n", lnr, i)
+			fmt.Fprintf(&m, "*001%07d\n*240  $a%d$cmobilsms\n^\n", lnr, i)
+		}
+		if i%5 == 0 {
+			fmt.Fprintf(&l, "ln_nr |%d|\nln_navn |Testesen, Igjen %d|\n^\n", lnr, i)
+		}
+	}
+	l.WriteString("ln_nr ||\n^\n")
+	return l.String(), m.String(), e.String()
+}
+
+// joined returns the joined sources by borrower number, as strings.
+func joined(t *testing.T, src Source) map[int]string {
+	res := make(map[int]string)
+	err := src.Each(func(s *Sources) {
+		if _, ok := res[s.Lnr]; ok {
+			t.Errorf("borrower %d joined twice", s.Lnr)
+		}
+		var lmarc string
+		if s.Lmarc != nil {
+			lmarc = s.Lmarc.DataFields[0].SubFields[0].Value
+		}
+		res[s.Lnr] = fmt.Sprintf("%s|%s|%s|%s", s.Laaner["ln_navn"], s.Laaner["ln_melding"], s.Lnel["lnel_epost"], lmarc)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestStreamSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "patrondump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	laaner, lmarc, lnel := testDumps(50)
+	for name, dump := range map[string]string{"laaner": laaner, "lmarc": lmarc, "lnel": lnel} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(dump), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	laanerPath, lmarcPath, lnelPath := filepath.Join(dir, "laaner"), filepath.Join(dir, "lmarc"), filepath.Join(dir, "lnel")
+
+	mem, err := NewMemSource(strings.NewReader(laaner), strings.NewReader(lmarc), strings.NewReader(lnel), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := joined(t, mem)
+	if len(want) != 50 || want[36] != "Testesen, Igjen 5||test5@example.com|5" {
+		t.Fatalf("unexpected in-memory join: %d patrons, 36: %q", len(want), want[36])
+	}
+
+	for _, chunk := range []int{1, 3, 1000} {
+		s, err := NewStreamSource(laanerPath, lmarcPath, lnelPath, false, dir, chunk, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := joined(t, s); !reflect.DeepEqual(got, want) {
+			t.Errorf("chunk %d: streaming join differs from in-memory join:\ngot  %v\nwant %v", chunk, got, want)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 3 {
+		t.Errorf("got %d files after closing; want temporary files removed", len(files))
+	}
+
+	s, err := NewStreamSource(laanerPath, lmarcPath, lnelPath, true, dir, 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Each(func(*Sources) {}); err == nil || !strings.Contains(err.Error(), "laaner is not sorted") {
+		t.Errorf("got %v; want error on unsorted laaner", err)
+	}
+}
@@ -0,0 +1,71 @@
+package patrondump
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Rejects records dump records which cannot be read, with the raw record,
+// so that the rest of the dump can be migrated. It is safe for concurrent use.
+type Rejects struct {
+	mu     sync.Mutex
+	max    int // abort when exceeded; negative for no limit
+	n      int
+	seen   map[string]bool // dump:line, as a dump may be read more than once
+	counts map[string]int  // dump -> count
+	report *csv.Writer
+}
+
+// NewRejects returns Rejects writing a CSV report to report, failing when there
+// are more than max rejects; negative for no limit.
+func NewRejects(report io.Writer, max int) *Rejects {
+	r := &Rejects{
+		max:    max,
+		seen:   make(map[string]bool),
+		counts: make(map[string]int),
+		report: csv.NewWriter(report),
+	}
+	r.report.Write([]string{"dump", "line", "error", "record"})
+	return r
+}
+
+// Add records a rejected record. It returns an error when there are more
+// rejects than the threshold.
+func (r *Rejects) Add(dump string, line int, raw []byte, err error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := dump + ":" + strconv.Itoa(line)
+	if r.seen[key] {
+		return nil
+	}
+	r.seen[key] = true
+	r.n++
+	r.counts[dump]++
+	r.report.Write([]string{dump, strconv.Itoa(line), err.Error(), string(raw)})
+	if r.max >= 0 && r.n > r.max {
+		r.report.Flush()
+		return fmt.Errorf("too many rejected records (more than %d); last: %s line %d: %v", r.max, dump, line, err)
+	}
+	return nil
+}
+
+// Flush writes any buffered report rows, and prints a summary to w.
+func (r *Rejects) Flush(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.report.Flush()
+	dumps := make([]string, 0, len(r.counts))
+	for dump := range r.counts {
+		dumps = append(dumps, dump)
+	}
+	sort.Strings(dumps)
+	fmt.Fprintln(w, "Rejected records:")
+	for _, dump := range dumps {
+		fmt.Fprintf(w, "%s\t%d\n", dump, r.counts[dump])
+	}
+	return r.report.Error()
+}
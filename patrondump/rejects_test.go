@@ -0,0 +1,104 @@
+package patrondump
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io"
+	"strings"
+	"testing"
+)
+
+const (
+	badLaaner = `ln_nr |1|
+ln_navn |Testesen, Test|
+^
+ln_nr |12x|
+ln_navn |Feil, Nummer|
+^
+ln_nr ||
+^
+ln_nr |3|
+ln_navn |Testesen, Tre|`
+
+	badLmarc = `*0010000001
+*240  $a99887766$cmobilsms
+^
+*240  $a11223344$cmobilsms
+^
+*001abc
+^
+*0010000003
+*240  $a55667788$cmobilsms
+^
+`
+)
+
+func readAll(t *testing.T, f Format, dump string, rej *Rejects) ([]int, error) {
+	var lnrs []int
+	read := f.Reader(strings.NewReader(dump), rej)
+	for {
+		rec, err := read()
+		if err == io.EOF {
+			return lnrs, nil
+		}
+		if err != nil {
+			return lnrs, err
+		}
+		lnrs = append(lnrs, rec.Lnr)
+	}
+}
+
+func TestRejects(t *testing.T) {
+	var report bytes.Buffer
+	rej := NewRejects(&report, 3)
+
+	for _, test := range []struct {
+		f    Format
+		dump string
+	}{
+		{Laaner, badLaaner},
+		{Lmarc, badLmarc},
+	} {
+		lnrs, err := readAll(t, test.f, test.dump, rej)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lnrs) != 2 || lnrs[0] != 1 || lnrs[1] != 3 {
+			t.Errorf("%s: got borrower numbers %v; want [1 3]", test.f.Name, lnrs)
+		}
+	}
+	// reading again does not reject the same records again
+	if _, err := readAll(t, Laaner, badLaaner, rej); err != nil {
+		t.Fatal(err)
+	}
+
+	var summary bytes.Buffer
+	if err := rej.Flush(&summary); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&report).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 {
+		t.Fatalf("got %d rejected records; want 3:\n%v", len(rows)-1, rows)
+	}
+	if got := rows[1]; got[0] != "laaner" || got[1] != "4" || !strings.Contains(got[2], "ln_nr") || got[3] != "ln_nr |12x|\nln_navn |Feil, Nummer|\n^\n" {
+		t.Errorf("got rejected laaner record %q", got)
+	}
+	if got := rows[2]; got[0] != "lmarc" || got[1] != "4" || got[3] != "*240  $a11223344$cmobilsms\n^\n" {
+		t.Errorf("got rejected lmarc record %q", got)
+	}
+	if want := "Rejected records:\nlaaner\t1\nlmarc\t2\n"; summary.String() != want {
+		t.Errorf("got summary %q; want %q", summary.String(), want)
+	}
+
+	// exceeding the threshold aborts
+	rej = NewRejects(&bytes.Buffer{}, 1)
+	if _, err := readAll(t, Lmarc, badLmarc, rej); err == nil || !strings.Contains(err.Error(), "too many rejected records") {
+		t.Errorf("got %v; want error when exceeding threshold", err)
+	}
+	if _, err := readAll(t, Laaner, badLaaner, nil); err == nil {
+		t.Error("got no error on bad record without rejects")
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/boutros/marc"
+)
+
+// attrType is a Koha borrower attribute type.
+type attrType struct {
+	Code        string
+	Description string
+	Repeatable  bool
+	Unique      bool
+	OpacDisplay bool
+}
+
+// attrTransform transforms a source value into zero or more attribute values.
+type attrTransform func(v string) ([]string, error)
+
+// attrMapping maps a patron source field to a borrower attribute.
+type attrMapping struct {
+	attrType
+	source    string // laaner:<key>, lnel:<key>, lmarc:<tag>$<code> or patron:<field>
+	transform attrTransform
+}
+
+// attrSources holds the source records of a patron.
+type attrSources struct {
+	laaner, lnel map[string]string
+	lmarc        *marc.Record
+	patron       patron
+}
+
+// values returns all values of the source field; lmarc fields may be repeated.
+func (s attrSources) values(source string) []string {
+	i := strings.Index(source, ":")
+	kind, field := source[:i], source[i+1:]
+	var res []string
+	switch kind {
+	case "laaner":
+		res = append(res, s.laaner[field])
+	case "lnel":
+		res = append(res, s.lnel[field])
+	case "lmarc":
+		if s.lmarc == nil {
+			return nil
+		}
+		tag, code := field[:3], field[4:]
+		for _, f := range s.lmarc.DataFields {
+			if f.Tag != tag {
+				continue
+			}
+			for _, sf := range f.SubFields {
+				if sf.Code == code {
+					res = append(res, sf.Value)
+				}
+			}
+		}
+	case "patron":
+		res = append(res, patronAttrFields[field](s.patron))
+	}
+	return res
+}
+
+// patronAttrFields are the fields of the merged patron available as attribute sources.
+var patronAttrFields = map[string]func(patron) string{
+	"fnr":         func(p patron) string { return p.TEMP_personnr }, // validated, see fnrHandler
+	"cardnumber":  func(p patron) string { return p.cardnumber },
+	"nl_lastsync": func(p patron) string { return p.TEMP_nl_lastsync },
+}
+
+// attributes maps patron source fields to Koha borrower attributes
+// (extended patron attributes).
+type attributes struct {
+	mappings []attrMapping
+	tmpl     *template.Template
+	counts   map[string]int // code or problem -> count
+}
+
+// newAttributes parses the attribute configuration from r. The configuration is
+// tab-separated, with lines starting with '#' ignored, one line per attribute:
+//
+//	<code>	<description>	<repeatable>	<unique>	<opac display>	<source>	<transform>
+//
+// repeatable, unique and opac display are 0 or 1. Source is one of:
+//
+//	laaner:<key>       value of key in laaner
+//	lnel:<key>         value of key in lnel
+//	lmarc:<tag>$<code> value of every subfield in lmarc
+//	patron:<field>     fnr (validated), cardnumber or nl_lastsync
+//
+// Transform is one of:
+//
+//	copy               the value, if not empty
+//	fnr                the fnr, as given by -fnrmode
+//	map:<v>=<a>,...    a for value v; other values are dropped
+//	flags:<c>=<a>,...  a for every character c in the value
+//
+// A code may be given several times, to collect values from several sources.
+func newAttributes(config io.Reader, fnr *fnrHandler) (*attributes, error) {
+	r := csv.NewReader(config)
+	r.Comma = '\t'
+	r.Comment = '#'
+	r.FieldsPerRecord = 7
+	r.LazyQuotes = true
+	lines, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("attributes: %v", err)
+	}
+
+	a := &attributes{
+		tmpl:   template.Must(template.New("attribute").Funcs(template.FuncMap{"sql": sqlEscape}).Parse(attributeTmplSQL)),
+		counts: make(map[string]int),
+	}
+	for _, l := range lines {
+		m := attrMapping{
+			attrType: attrType{
+				Code:        l[0],
+				Description: l[1],
+				Repeatable:  l[2] == "1",
+				Unique:      l[3] == "1",
+				OpacDisplay: l[4] == "1",
+			},
+			source: l[5],
+		}
+		if err := validAttrSource(m.source); err != nil {
+			return nil, fmt.Errorf("attributes: %s: %v", m.Code, err)
+		}
+		if m.transform, err = newAttrTransform(l[6], fnr); err != nil {
+			return nil, fmt.Errorf("attributes: %s: %v", m.Code, err)
+		}
+		a.mappings = append(a.mappings, m)
+	}
+	return a, nil
+}
+
+func validAttrSource(source string) error {
+	i := strings.Index(source, ":")
+	if i == -1 {
+		return fmt.Errorf("bad source %q", source)
+	}
+	field := source[i+1:]
+	switch source[:i] {
+	case "laaner", "lnel":
+		if field != "" {
+			return nil
+		}
+	case "lmarc":
+		if len(field) == 5 && field[3] == '$' {
+			return nil
+		}
+	case "patron":
+		if _, ok := patronAttrFields[field]; ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("bad source %q", source)
+}
+
+func newAttrTransform(s string, fnr *fnrHandler) (attrTransform, error) {
+	switch {
+	case s == "copy":
+		return func(v string) ([]string, error) {
+			if v = strings.TrimSpace(v); v == "" {
+				return nil, nil
+			}
+			return []string{v}, nil
+		}, nil
+	case s == "fnr":
+		return func(v string) ([]string, error) {
+			if v == "" {
+				return nil, nil
+			}
+			a, err := fnr.attribute(v)
+			return []string{a}, err
+		}, nil
+	case strings.HasPrefix(s, "map:"), strings.HasPrefix(s, "flags:"):
+		i := strings.Index(s, ":")
+		mapping := make(map[string]string)
+		var order []string
+		for _, kv := range strings.Split(s[i+1:], ",") {
+			j := strings.Index(kv, "=")
+			if j == -1 {
+				return nil, fmt.Errorf("bad transform %q", s)
+			}
+			mapping[kv[:j]] = kv[j+1:]
+			order = append(order, kv[:j])
+		}
+		if s[:i] == "map" {
+			return func(v string) ([]string, error) {
+				if a, ok := mapping[v]; ok {
+					return []string{a}, nil
+				}
+				return nil, nil
+			}, nil
+		}
+		return func(v string) ([]string, error) {
+			var res []string
+			for _, c := range order {
+				if strings.Contains(v, c) {
+					res = append(res, mapping[c])
+				}
+			}
+			return res, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown transform %q", s)
+}
+
+// types returns the attribute types, once for each code.
+func (a *attributes) types() []attrType {
+	var res []attrType
+	seen := make(map[string]bool)
+	for _, m := range a.mappings {
+		if !seen[m.Code] {
+			seen[m.Code] = true
+			res = append(res, m.attrType)
+		}
+	}
+	return res
+}
+
+// WriteTypes writes the SQL creating the attribute types.
+func (a *attributes) WriteTypes(w io.Writer) error {
+	return template.Must(template.New("attrtypes").Funcs(template.FuncMap{"sql": sqlEscape}).Parse(attributeTypesTmplSQL)).Execute(w, a.types())
+}
+
+// Write writes the SQL inserting the patrons attributes. Values for
+// non-repeatable attributes after the first are dropped.
+// It is not safe for concurrent use.
+func (a *attributes) Write(w io.Writer, src attrSources) error {
+	values := make(map[string][]string)
+	var codes []string
+	for _, m := range a.mappings {
+		for _, v := range src.values(m.source) {
+			attrs, err := m.transform(v)
+			if err != nil {
+				return err
+			}
+			for _, attr := range attrs {
+				if _, ok := values[m.Code]; !ok {
+					codes = append(codes, m.Code)
+				}
+				if len(values[m.Code]) > 0 && !m.Repeatable {
+					a.counts[m.Code+": more than one value, dropped"]++
+					continue
+				}
+				if contains(values[m.Code], attr) {
+					continue
+				}
+				values[m.Code] = append(values[m.Code], attr)
+			}
+		}
+	}
+	for _, code := range codes {
+		for _, v := range values[code] {
+			a.counts[code]++
+			if err := a.tmpl.Execute(w, struct {
+				Code                string
+				Attribute           string
+				BibliofilBorrowerNr string
+			}{
+				Code:                code,
+				Attribute:           v,
+				BibliofilBorrowerNr: src.patron.userid,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Flush prints a summary to w.
+func (a *attributes) Flush(w io.Writer) error {
+	keys := make([]string, 0, len(a.counts))
+	for k := range a.counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintln(w, "Extended patron attributes:")
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s\t%d\n", k, a.counts[k])
+	}
+	return nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sqlEscape escapes s for use in a single-quoted SQL string.
+func sqlEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestAttributes(t *testing.T) {
+	fnr, err := newFnrHandler(fnrModeClear, nil, false, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const config = `# test config
+fnr	Fødselsnummer	0	1	0	patron:fnr	fnr
+dooraccess	Meråpent	0	0	0	laaner:ln_obs	flags:D=1,B=B
+phone	Telefon	1	0	1	lmarc:240$a	copy
+nl	Nasjonalt lånekort	0	0	0	lmarc:600$k	map:1=ja
+note	Melding	0	0	0	laaner:ln_melding	copy
+`
+	a, err := newAttributes(strings.NewReader(config), fnr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var types bytes.Buffer
+	if err := a.WriteTypes(&types); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"VALUES ('fnr', 'Fødselsnummer', 0, 1, 0, 1);",
+		"VALUES ('phone', 'Telefon', 1, 0, 1, 1);",
+	} {
+		if !strings.Contains(types.String(), want) {
+			t.Errorf("attribute types missing %q:\n%s", want, types.String())
+		}
+	}
+	if n := strings.Count(types.String(), "INSERT IGNORE INTO borrower_attribute_types"); n != 5 {
+		t.Errorf("got %d attribute types; want 5", n)
+	}
+
+	src := attrSources{
+		laaner: mustParseKeyVal(`ln_nr |808708|
+ln_obs |BD|
+ln_melding |Patron's note|
+^
+`),
+		lmarc: mustParseLmarc(`*0010808708
+*240  $a99887766$cmobilsms
+*240  $a22334455$cjobb
+*600  $aN001600007$k1
+^
+`),
+		patron: patron{userid: "808708", TEMP_personnr: "02031145530"},
+	}
+	var ext bytes.Buffer
+	if err := a.Write(&ext, src); err != nil {
+		t.Fatal(err)
+	}
+	got := ext.String()
+	for _, want := range []string{
+		"'fnr',\n       '02031145530'",
+		"'dooraccess',\n       '1'",
+		"'phone',\n       '99887766'",
+		"'phone',\n       '22334455'",
+		"'nl',\n       'ja'",
+		`'note',` + "\n       'Patron\\'s note'",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("attributes missing %q:\n%s", want, got)
+		}
+	}
+	if n := strings.Count(got, "INSERT IGNORE INTO borrower_attributes"); n != 6 {
+		t.Errorf("got %d attributes; want 6 (dooraccess B dropped as not repeatable):\n%s", n, got)
+	}
+	if a.counts["dooraccess: more than one value, dropped"] != 1 {
+		t.Errorf("dropped dooraccess value not counted: %v", a.counts)
+	}
+
+	for _, bad := range []string{
+		"x	X	0	0	0	laaner:ln_obs	nosuch",
+		"x	X	0	0	0	nosuch:ln_obs	copy",
+		"x	X	0	0	0	patron:nosuch	copy",
+		"x	X	0	0	0	lmarc:240	copy",
+		"x	X	0	0	0	laaner:ln_obs",
+	} {
+		if _, err := newAttributes(strings.NewReader(bad), fnr); err == nil {
+			t.Errorf("newAttributes(%q): want error, got nil", bad)
+		}
+	}
+	if _, err := newAttributes(strings.NewReader(defaultAttributesConfig), fnr); err != nil {
+		t.Errorf("default configuration: %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Koha debarment types.
+var debarmentTypes = map[string]bool{
+	"MANUAL":     true,
+	"OVERDUES":   true,
+	"SUSPENSION": true,
+	"DISCHARGE":  true,
+}
+
+// indefiniteDebarment is the borrowers.debarred date of patrons with a debarment
+// without expiration, as set by Koha.
+const indefiniteDebarment = "9999-12-31"
+
+// maxDebarredComment is the length of borrowers.debarredcomment, varchar(255).
+const maxDebarredComment = 255
+
+// debarmentRule maps a Bibliofil obs flag to a Koha debarment.
+type debarmentRule struct {
+	Type    string // Koha debarment type, empty if the flag is not a debarment
+	Expires bool   // expires at ln_sperres, if set
+	Comment string
+	Message bool // append ln_melding to the comment
+}
+
+// debarment is a row in Koha's borrower_debarments table.
+type debarment struct {
+	Type       string
+	Expiration string // empty for none
+	Comment    string
+}
+
+// debarments maps Bibliofil obs flags (ln_obs and ln_friobs) to Koha borrower
+// debarments. Flags without a mapping are reported.
+type debarments struct {
+	rules map[string]debarmentRule // flag -> rule
+	now   time.Time
+	tmpl  *template.Template
+
+	report *csv.Writer
+	counts map[string]int // type or problem -> count
+}
+
+// newDebarments parses the debarments configuration from r. The configuration is
+// tab-separated, with lines starting with '#' ignored, one line per obs flag:
+//
+//	<flag>	<type or ->	<expiration>	<comment>	<message>
+//
+// Type is a Koha debarment type (MANUAL, OVERDUES, SUSPENSION or DISCHARGE), or
+// "-" for flags migrated otherwise. Expiration is "sperres" to expire at
+// ln_sperres, if set, or "-" for none. Comment is "-" for none. Message is 1 to
+// append ln_melding to the comment. Debarments which have expired by now are not migrated.
+func newDebarments(config io.Reader, now time.Time, report io.Writer) (*debarments, error) {
+	r := csv.NewReader(config)
+	r.Comma = '\t'
+	r.Comment = '#'
+	r.FieldsPerRecord = 5
+	r.LazyQuotes = true
+	lines, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("debarments: %v", err)
+	}
+
+	d := &debarments{
+		rules:  make(map[string]debarmentRule),
+		now:    now,
+		tmpl:   template.Must(template.New("debarment").Funcs(template.FuncMap{"sql": sqlEscape}).Parse(debarmentTmplSQL)),
+		report: csv.NewWriter(report),
+		counts: make(map[string]int),
+	}
+	for _, l := range lines {
+		if len(l[0]) != 1 {
+			return nil, fmt.Errorf("debarments: bad flag %q", l[0])
+		}
+		rule := debarmentRule{Comment: l[3], Message: l[4] == "1"}
+		if rule.Comment == "-" {
+			rule.Comment = ""
+		}
+		if l[1] != "-" {
+			if !debarmentTypes[l[1]] {
+				return nil, fmt.Errorf("debarments: %s: unknown type %q", l[0], l[1])
+			}
+			rule.Type = l[1]
+		}
+		switch l[2] {
+		case "sperres":
+			rule.Expires = true
+		case "-":
+		default:
+			return nil, fmt.Errorf("debarments: %s: bad expiration %q", l[0], l[2])
+		}
+		d.rules[l[0]] = rule
+	}
+
+	d.report.Write([]string{"userid", "flag", "problem"})
+	return d, nil
+}
+
+// forPatron returns the debarments of the patron.
+// It is not safe for concurrent use.
+func (d *debarments) forPatron(p patron) []debarment {
+	var res []debarment
+	seen := make(map[string]bool)
+	for _, c := range p.TEMP_obs {
+		flag := string(c)
+		if seen[flag] {
+			continue
+		}
+		seen[flag] = true
+		rule, ok := d.rules[flag]
+		if !ok {
+			d.record(p, flag, "unmapped flag")
+			continue
+		}
+		if rule.Type == "" {
+			continue
+		}
+		db := debarment{Type: rule.Type, Comment: rule.Comment}
+		if rule.Message && p.borrowernotes != "" {
+			if db.Comment != "" {
+				db.Comment += ": "
+			}
+			db.Comment += p.borrowernotes
+		}
+		if rule.Expires && p.TEMP_sperres != "" {
+			if t, err := time.Parse(mysqlDateFormat, p.TEMP_sperres); err == nil && !t.After(d.now) {
+				d.record(p, flag, "expired")
+				continue
+			}
+			db.Expiration = p.TEMP_sperres
+		}
+		res = append(res, db)
+	}
+	return res
+}
+
+// Write writes the SQL inserting the patrons debarments, and sets debarred
+// and debarredcomment of the patron as Koha does: the latest expiration, and
+// the comments of all debarments, truncated to maxDebarredComment characters
+// and reported if longer.
+// It is not safe for concurrent use.
+func (d *debarments) Write(w io.Writer, p *patron) error {
+	p.debarred, p.debarredcomment = "", ""
+	var comments []string
+	for _, db := range d.forPatron(*p) {
+		d.counts[db.Type]++
+		expiration := db.Expiration
+		if expiration == "" {
+			expiration = indefiniteDebarment
+		}
+		if expiration > p.debarred {
+			p.debarred = expiration
+		}
+		if db.Comment != "" {
+			comments = append(comments, db.Comment)
+		}
+		if err := d.tmpl.Execute(w, struct {
+			Type                string
+			Expiration          string
+			Comment             string
+			BibliofilBorrowerNr string
+		}{
+			Type:                db.Type,
+			Expiration:          db.Expiration,
+			Comment:             db.Comment,
+			BibliofilBorrowerNr: p.userid,
+		}); err != nil {
+			return err
+		}
+	}
+	p.debarredcomment = strings.Join(comments, "\n")
+	if r := []rune(p.debarredcomment); len(r) > maxDebarredComment {
+		p.debarredcomment = string(r[:maxDebarredComment])
+		d.record(*p, "", "debarredcomment truncated")
+	}
+	return nil
+}
+
+func (d *debarments) record(p patron, flag, problem string) {
+	d.counts[fmt.Sprintf("%s: %q", problem, flag)]++
+	d.report.Write([]string{p.userid, flag, problem})
+}
+
+// Flush writes any buffered report rows, and prints a summary to w.
+func (d *debarments) Flush(w io.Writer) error {
+	d.report.Flush()
+	keys := make([]string, 0, len(d.counts))
+	for k := range d.counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintln(w, "Debarments:")
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s\t%d\n", k, d.counts[k])
+	}
+	return d.report.Error()
+}
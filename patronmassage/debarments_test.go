@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDebarments(t *testing.T) {
+	var report bytes.Buffer
+	d, err := newDebarments(strings.NewReader(defaultDebarmentsConfig), time.Date(2016, 8, 19, 0, 0, 0, 0, time.UTC), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		p               patron
+		debarred        string
+		debarredcomment string
+		n               int // debarments
+		sql             []string
+	}{
+		{
+			p: patron{userid: "1", TEMP_obs: "mD"},
+		},
+		{
+			p:               patron{userid: "2", TEMP_obs: "s", TEMP_sperres: "2016-12-24", borrowernotes: "Ta kontakt med O'Hara"},
+			debarred:        "2016-12-24",
+			debarredcomment: "Sperret i Bibliofil: Ta kontakt med O'Hara",
+			n:               1,
+			sql:             []string{"'2016-12-24',\n       'MANUAL',\n       'Sperret i Bibliofil: Ta kontakt med O\\'Hara',"},
+		},
+		{
+			p:               patron{userid: "3", TEMP_obs: "rsx", borrowernotes: "Bør ikke låne"},
+			debarred:        indefiniteDebarment,
+			debarredcomment: "Regning sendt\nSperret i Bibliofil: Bør ikke låne",
+			n:               2,
+			sql:             []string{"NULL,\n       'OVERDUES',", "NULL,\n       'MANUAL',", "userid = '3'"},
+		},
+		{
+			p:               patron{userid: "4", TEMP_obs: "si", TEMP_sperres: "2016-01-01"},
+			debarred:        indefiniteDebarment,
+			debarredcomment: "Sendt til inkasso",
+			n:               1,
+			sql:             []string{"NULL,\n       'OVERDUES',"},
+		},
+		{
+			p:               patron{userid: "5", TEMP_obs: "s", borrowernotes: strings.Repeat("å", 300)},
+			debarred:        indefiniteDebarment,
+			debarredcomment: "Sperret i Bibliofil: " + strings.Repeat("å", maxDebarredComment-len("Sperret i Bibliofil: ")),
+			n:               1,
+			sql:             []string{"'Sperret i Bibliofil: " + strings.Repeat("å", 300) + "',"},
+		},
+	}
+	for _, test := range tests {
+		var sql bytes.Buffer
+		p := test.p
+		if err := d.Write(&sql, &p); err != nil {
+			t.Fatal(err)
+		}
+		if p.debarred != test.debarred || p.debarredcomment != test.debarredcomment {
+			t.Errorf("%s: got debarred %q, %q; want %q, %q", p.userid, p.debarred, p.debarredcomment, test.debarred, test.debarredcomment)
+		}
+		if n := strings.Count(sql.String(), "INSERT INTO borrower_debarments"); n != test.n {
+			t.Errorf("%s: got %d debarments; want %d", p.userid, n, test.n)
+		}
+		for _, want := range test.sql {
+			if !strings.Contains(sql.String(), want) {
+				t.Errorf("%s: debarments missing %q:\n%s", p.userid, want, sql.String())
+			}
+		}
+	}
+
+	var summary bytes.Buffer
+	if err := d.Flush(&summary); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"3,x,unmapped flag\n", "4,s,expired\n", "5,,debarredcomment truncated\n"} {
+		if !strings.Contains(report.String(), want) {
+			t.Errorf("report missing %q:\n%s", want, report.String())
+		}
+	}
+	for _, want := range []string{"MANUAL\t3\n", "OVERDUES\t2\n", "unmapped flag: \"x\"\t1\n"} {
+		if !strings.Contains(summary.String(), want) {
+			t.Errorf("summary missing %q:\n%s", want, summary.String())
+		}
+	}
+}
+
+func TestDebarmentsConfig(t *testing.T) {
+	// "-" is no comment
+	d, err := newDebarments(strings.NewReader("x\tMANUAL\t-\t-\t1\ny\tMANUAL\t-\t-\t0\n"), time.Now(), &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := patron{userid: "1", TEMP_obs: "xy", borrowernotes: "Ring"}
+	if err := d.Write(&bytes.Buffer{}, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.debarredcomment != "Ring" {
+		t.Errorf("got debarredcomment %q; want %q", p.debarredcomment, "Ring")
+	}
+
+	for _, config := range []string{
+		"s\tBLOCKED\t-\tSperret\t0\n",
+		"s\tMANUAL\t2016-01-01\tSperret\t0\n",
+		"sx\tMANUAL\t-\tSperret\t0\n",
+		"s\tMANUAL\t-\tSperret\n",
+	} {
+		if _, err := newDebarments(strings.NewReader(config), time.Now(), &bytes.Buffer{}); err == nil {
+			t.Errorf("newDebarments(%q) = nil error; want error", config)
+		}
+	}
+}
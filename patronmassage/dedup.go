@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Duplicate detection
+//
+// Patrons registered several times in Bibliofil are detected by comparing
+// fnr, national card number (600$a), and fuzzy matching of name, date of
+// birth, address and email. Every pair of patrons scoring above a report
+// threshold is written to a report; pairs scoring above a merge threshold
+// are clustered, and all patrons in a cluster are merged into one surviving
+// borrower: the one who has been most recently active.
+
+// dupCandidate holds the patron information used for duplicate detection.
+type dupCandidate struct {
+	userid   string
+	fnr      string
+	card     string // national card number
+	name     string // normalised name, tokens sorted
+	dob      string
+	address  string // normalised address, including zipcode
+	email    string
+	lastloan string
+}
+
+func newDupCandidate(p patron) dupCandidate {
+	c := dupCandidate{
+		userid:   p.userid,
+		name:     normaliseForMatch(p.surname + " " + p.firstname),
+		dob:      p.dateofbirth,
+		address:  normaliseForMatch(p.address + " " + p.address2 + " " + p.zipcode),
+		email:    strings.ToLower(strings.TrimSpace(p.email)),
+		lastloan: p.TEMP_sistelaan,
+	}
+	if _, err := parseFnr(p.TEMP_personnr); err == nil {
+		c.fnr = p.TEMP_personnr
+	}
+	if p.cardnumber != p.userid {
+		// cardnumber is only set to userid if there is no national card number
+		c.card = p.cardnumber
+	}
+	return c
+}
+
+// dupMatch is a pair of patrons which are likely duplicates.
+type dupMatch struct {
+	a, b    string // borrower numbers
+	score   float64
+	reasons []string
+}
+
+// score returns the likelihood, between 0 and 1, that a and b are
+// the same person, and the reasons for it.
+func (a dupCandidate) score(b dupCandidate) (float64, []string) {
+	if a.fnr != "" && a.fnr == b.fnr {
+		return 1, []string{"fnr"}
+	}
+	if a.card != "" && a.card == b.card {
+		return 0.95, []string{"cardnumber"}
+	}
+	if a.fnr != "" && b.fnr != "" {
+		// different valid fnrs; not the same person
+		return 0, nil
+	}
+
+	var score float64
+	var reasons []string
+	if s := similarity(a.name, b.name); s > 0.8 {
+		score += 0.5 * s
+		reasons = append(reasons, fmt.Sprintf("name %.2f", s))
+	}
+	if a.dob != "" && a.dob == b.dob {
+		score += 0.2
+		reasons = append(reasons, "dateofbirth")
+	}
+	if a.address != "" && b.address != "" {
+		if s := similarity(a.address, b.address); s > 0.8 {
+			score += 0.2 * s
+			reasons = append(reasons, fmt.Sprintf("address %.2f", s))
+		}
+	}
+	if a.email != "" && a.email == b.email {
+		score += 0.1
+		reasons = append(reasons, "email")
+	}
+	return score, reasons
+}
+
+// dupDetector finds likely duplicate patrons.
+type dupDetector struct {
+	reportThreshold float64 // report pairs scoring at least this
+	mergeThreshold  float64 // merge pairs scoring at least this; 0 to disable merging
+	cands           []dupCandidate
+	skipped         int // blocks larger than maxDupBlock, not compared
+}
+
+func newDupDetector(reportThreshold, mergeThreshold float64) *dupDetector {
+	return &dupDetector{
+		reportThreshold: reportThreshold,
+		mergeThreshold:  mergeThreshold,
+	}
+}
+
+func (d *dupDetector) add(p patron) {
+	d.cands = append(d.cands, newDupCandidate(p))
+}
+
+// maxDupBlock is the largest number of patrons sharing a blocking key that
+// are compared pairwise; larger blocks (a shared family email, say) are
+// skipped, so that detection does not go quadratic.
+const maxDupBlock = 1000
+
+// isPlaceholderDate reports whether the date of birth is a placeholder
+// rather than a birthday: missing, before 1901, or January 1st, which is
+// recorded when only the year is known.
+func isPlaceholderDate(dob string) bool {
+	return len(dob) != 10 || dob < "1901" || strings.HasSuffix(dob, "-01-01")
+}
+
+// blockKeys returns the keys of the blocks the candidate is compared in.
+func (c dupCandidate) blockKeys() []string {
+	var keys []string
+	if c.fnr != "" {
+		keys = append(keys, "fnr:"+c.fnr)
+	}
+	if c.card != "" {
+		keys = append(keys, "card:"+c.card)
+	}
+	if !isPlaceholderDate(c.dob) {
+		keys = append(keys, "dob:"+c.dob)
+	}
+	if c.email != "" {
+		keys = append(keys, "email:"+c.email)
+	}
+	return keys
+}
+
+// detect returns all pairs of candidates scoring at least the report threshold.
+// To avoid comparing every pair of patrons, only patrons sharing fnr,
+// card number, date of birth (unless a placeholder) or email are compared,
+// in blocks of at most maxDupBlock patrons.
+func (d *dupDetector) detect() []dupMatch {
+	blocks := make(map[string][]int)
+	for i, c := range d.cands {
+		for _, key := range c.blockKeys() {
+			blocks[key] = append(blocks[key], i)
+		}
+	}
+	// a pair sharing several keys is compared in the first block compared
+	firstShared := func(a, b dupCandidate) string {
+		for _, ka := range a.blockKeys() {
+			if len(blocks[ka]) > maxDupBlock {
+				continue
+			}
+			for _, kb := range b.blockKeys() {
+				if ka == kb {
+					return ka
+				}
+			}
+		}
+		return ""
+	}
+
+	var res []dupMatch
+	for key, block := range blocks {
+		if len(block) > maxDupBlock {
+			d.skipped++
+			continue
+		}
+		for x := 0; x < len(block); x++ {
+			for y := x + 1; y < len(block); y++ {
+				a, b := d.cands[block[x]], d.cands[block[y]]
+				if firstShared(a, b) != key {
+					continue
+				}
+				if score, reasons := a.score(b); score >= d.reportThreshold {
+					res = append(res, dupMatch{a: a.userid, b: b.userid, score: score, reasons: reasons})
+				}
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].score != res[j].score {
+			return res[i].score > res[j].score
+		}
+		if res[i].a != res[j].a {
+			return res[i].a < res[j].a
+		}
+		return res[i].b < res[j].b
+	})
+	return res
+}
+
+// survivors clusters the matches scoring at least the merge threshold, and returns
+// a map of duplicate borrower number to the surviving borrower number in its cluster.
+// The survivor is the patron with the most recent loan, or the lowest borrower number.
+func (d *dupDetector) survivors(matches []dupMatch) map[string]string {
+	res := make(map[string]string)
+	if d.mergeThreshold <= 0 {
+		return res
+	}
+
+	// union-find
+	parent := make(map[string]string)
+	var find func(string) string
+	find = func(s string) string {
+		p, ok := parent[s]
+		if !ok || p == s {
+			return s
+		}
+		root := find(p)
+		parent[s] = root
+		return root
+	}
+	for _, m := range matches {
+		if m.score < d.mergeThreshold {
+			continue
+		}
+		ra, rb := find(m.a), find(m.b)
+		if ra != rb {
+			parent[ra] = rb
+		}
+		parent[m.a], parent[m.b] = find(m.a), find(m.b)
+	}
+
+	byUserid := make(map[string]dupCandidate)
+	for _, c := range d.cands {
+		if _, ok := parent[c.userid]; ok {
+			byUserid[c.userid] = c
+		}
+	}
+	clusters := make(map[string][]dupCandidate)
+	for userid := range parent {
+		root := find(userid)
+		clusters[root] = append(clusters[root], byUserid[userid])
+	}
+	for _, cluster := range clusters {
+		sort.Slice(cluster, func(i, j int) bool {
+			if cluster[i].lastloan != cluster[j].lastloan {
+				return cluster[i].lastloan > cluster[j].lastloan
+			}
+			return lessBorrowernumber(cluster[i].userid, cluster[j].userid)
+		})
+		for _, c := range cluster[1:] {
+			res[c.userid] = cluster[0].userid
+		}
+	}
+	return res
+}
+
+// writeDupReport writes the matches as CSV, including the surviving
+// borrower number of merged patrons.
+func writeDupReport(w io.Writer, matches []dupMatch, survivors map[string]string) error {
+	enc := csv.NewWriter(w)
+	enc.Write([]string{"userid", "duplicate userid", "score", "reasons", "merged into"})
+	root := func(userid string) string {
+		if s, ok := survivors[userid]; ok {
+			return s
+		}
+		return userid
+	}
+	for _, m := range matches {
+		merged := ""
+		if root(m.a) == root(m.b) {
+			merged = root(m.a)
+		}
+		enc.Write([]string{m.a, m.b, fmt.Sprintf("%.2f", m.score), strings.Join(m.reasons, "; "), merged})
+	}
+	enc.Flush()
+	return enc.Error()
+}
+
+// writeBorrowerMap writes the mapping of duplicate to surviving borrower numbers,
+// to be used by catmassage and res2sql to re-point issues and holds.
+func writeBorrowerMap(w io.Writer, survivors map[string]string) error {
+	dups := make([]string, 0, len(survivors))
+	for dup := range survivors {
+		dups = append(dups, dup)
+	}
+	sort.Slice(dups, func(i, j int) bool { return lessBorrowernumber(dups[i], dups[j]) })
+	enc := csv.NewWriter(w)
+	for _, dup := range dups {
+		enc.Write([]string{dup, survivors[dup]})
+	}
+	enc.Flush()
+	return enc.Error()
+}
+
+// normaliseForMatch lowercases s, strips punctuation and sorts its words,
+// so that "Testesen, Test" and "test testesen" are equal.
+func normaliseForMatch(s string) string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	sort.Strings(words)
+	return strings.Join(words, " ")
+}
+
+// similarity returns the normalised Levenshtein similarity of a and b,
+// between 0 (completely different) and 1 (equal).
+func similarity(a, b string) float64 {
+	if a == b {
+		if a == "" {
+			return 0
+		}
+		return 1
+	}
+	ra, rb := []rune(a), []rune(b)
+	max := len(ra)
+	if len(rb) > max {
+		max = len(rb)
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(max)
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func lessBorrowernumber(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
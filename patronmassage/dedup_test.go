@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestDuplicateDetection(t *testing.T) {
+	patrons := []patron{
+		{userid: "1", cardnumber: "N001", surname: "Testesen", firstname: "Test", dateofbirth: "1981-03-02",
+			TEMP_personnr: "02031145530", TEMP_sistelaan: "2016-06-08"},
+		// same fnr
+		{userid: "2", cardnumber: "2", surname: "Testesen", firstname: "Test", dateofbirth: "1911-03-02",
+			TEMP_personnr: "02031145530", TEMP_sistelaan: "2010-01-01"},
+		// same national card number
+		{userid: "3", cardnumber: "N001", surname: "Testsen", firstname: "T.", TEMP_sistelaan: "2012-01-01"},
+		// fuzzy: similar name, same date of birth, address and email
+		{userid: "10", cardnumber: "10", surname: "Hansen", firstname: "Kari", dateofbirth: "1970-05-17",
+			address: "Storgata 1", zipcode: "0155", email: "kari@example.com"},
+		{userid: "11", cardnumber: "11", surname: "Hansen", firstname: "Karí", dateofbirth: "1970-05-17",
+			address: "Storgata 1", zipcode: "0155", email: "KARI@example.com"},
+		// same email, different person
+		{userid: "12", cardnumber: "12", surname: "Hansen", firstname: "Ola", dateofbirth: "1968-01-01",
+			email: "kari@example.com"},
+	}
+
+	d := newDupDetector(0.75, 0.95)
+	for _, p := range patrons {
+		d.add(p)
+	}
+	matches := d.detect()
+
+	got := make(map[[2]string]float64)
+	for _, m := range matches {
+		got[[2]string{m.a, m.b}] = m.score
+	}
+	for _, pair := range [][2]string{{"1", "2"}, {"1", "3"}, {"10", "11"}} {
+		if _, ok := got[pair]; !ok {
+			t.Errorf("pair %v not detected as duplicates; got %v", pair, matches)
+		}
+	}
+	for _, pair := range [][2]string{{"10", "12"}, {"11", "12"}} {
+		if _, ok := got[pair]; ok {
+			t.Errorf("pair %v detected as duplicates", pair)
+		}
+	}
+
+	survivors := d.survivors(matches)
+	want := map[string]string{
+		"2":  "1", // patron 1 has the most recent loan
+		"3":  "1",
+		"11": "10",
+	}
+	if !reflect.DeepEqual(survivors, want) {
+		t.Errorf("got survivors %v; want %v", survivors, want)
+	}
+
+	var b bytes.Buffer
+	if err := writeBorrowerMap(&b, survivors); err != nil {
+		t.Fatal(err)
+	}
+	if want := "2,1\n3,1\n11,10\n"; b.String() != want {
+		t.Errorf("got borrower map:\n%s\nwant:\n%s", b.String(), want)
+	}
+
+	// no merging
+	if s := newDupDetector(0.75, 0).survivors(matches); len(s) != 0 {
+		t.Errorf("merging disabled; got survivors %v", s)
+	}
+}
+
+func TestDuplicateBlocks(t *testing.T) {
+	// placeholder dates of birth are not blocked on
+	for _, dob := range []string{"", "1900-01-01", "1975-01-01", "0000-00-00"} {
+		if keys := newDupCandidate(patron{userid: "1", cardnumber: "1", dateofbirth: dob}).blockKeys(); len(keys) != 0 {
+			t.Errorf("dateofbirth %q: got block keys %v", dob, keys)
+		}
+	}
+
+	// blocks larger than maxDupBlock are skipped
+	d := newDupDetector(0.1, 0)
+	for i := 0; i <= maxDupBlock; i++ {
+		id := strconv.Itoa(i)
+		d.add(patron{userid: id, cardnumber: id, surname: "Hansen", email: "familien@example.com"})
+	}
+	d.add(patron{userid: "a", cardnumber: "a", surname: "Olsen", dateofbirth: "1970-05-17", email: "familien@example.com"})
+	d.add(patron{userid: "b", cardnumber: "b", surname: "Olsen", dateofbirth: "1970-05-17"})
+	matches := d.detect()
+	if d.skipped != 1 || len(matches) != 1 || matches[0].a != "a" || matches[0].b != "b" {
+		t.Errorf("got %d skipped blocks, matches %v; want 1, [a b]", d.skipped, matches)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digibib/migtools/dumpgen"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var e2eConfig = dumpgen.Config{
+	Titles:   50,
+	Copies:   2,
+	Patrons:  300,
+	LoanRate: 0.2,
+	HoldRate: 0.1,
+	Date:     time.Date(2016, 8, 19, 7, 31, 0, 0, time.UTC),
+}
+
+// writeDumps writes the laaner, lmarc and lnel dumps to dir.
+func writeDumps(t testing.TB, d *dumpgen.Buffers, dir string) (laaner, lmarc, lnel string) {
+	paths := make([]string, 3)
+	for i, dump := range []struct {
+		name string
+		b    []byte
+	}{{"laaner", d.Laaner.Bytes()}, {"lmarc", d.Lmarc.Bytes()}, {"lnel", d.Lnel.Bytes()}} {
+		paths[i] = filepath.Join(dir, "data."+dump.name+".20160819-073100.txt")
+		if err := ioutil.WriteFile(paths[i], dump.b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return paths[0], paths[1], paths[2]
+}
+
+// runGenerated runs patronmassage with the built-in configuration on the
+// dumps in dir, writing the outputs to dir; from sorted files if stream,
+// otherwise indexed in memory.
+func runGenerated(t testing.TB, dir string, stream bool) {
+	cfg := config{
+		laaner:     filepath.Join(dir, "data.laaner.20160819-073100.txt"),
+		lmarc:      filepath.Join(dir, "data.lmarc.20160819-073100.txt"),
+		lnel:       filepath.Join(dir, "data.lnel.20160819-073100.txt"),
+		numWorkers: 4,
+		kohaVer:    defaultKohaVersion,
+		pinAlgo:    pinAlgoCarry,
+		pinCost:    bcrypt.MinCost,
+		pinWorkers: 2,
+		normalise:  true,
+		countryTel: "47",
+		fnrMode:    fnrModeClear,
+		inactive:   inactiveFlag,
+		stream:     stream,
+		sortChunk:  100,
+		tmpDir:     dir,
+		maxRejects: -1,
+		outDir:     dir,
+	}
+	if err := run(cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readCSV(t *testing.T, name string) [][]string {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+// TestGeneratedDumps runs patronmassage on dumps from dumpgen, both indexed in
+// memory and streamed, checking that every patron not deleted is migrated,
+// the same way.
+func TestGeneratedDumps(t *testing.T) {
+	d, err := dumpgen.Generate(e2eConfig, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := strings.Count(d.Laaner.String(), "ln_navn |!!")
+
+	var outputs [][]string
+	for _, stream := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "patronmassage")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		writeDumps(t, d, dir)
+		runGenerated(t, dir, stream)
+
+		rows := readCSV(t, filepath.Join(dir, "patrons.csv"))
+		if got, want := len(rows)-1, e2eConfig.Patrons-deleted; got != want {
+			t.Errorf("stream=%v: got %d patrons; want %d", stream, got, want)
+		}
+		if rejects := readCSV(t, filepath.Join(dir, "rejects.csv")); len(rejects) > 1 {
+			t.Errorf("stream=%v: got rejects %v", stream, rejects[1:])
+		}
+		col := make(map[string]int)
+		for i, c := range rows[0] {
+			col[c] = i
+		}
+		kohaCategories := make(map[string]bool)
+		for _, c := range categoryCodes {
+			kohaCategories[c] = true
+		}
+		var lines []string
+		for _, row := range rows[1:] {
+			if !kohaCategories[row[col["categorycode"]]] {
+				t.Errorf("patron %s in unknown category %q", row[col["userid"]], row[col["categorycode"]])
+			}
+			if row[col["password"]] == "" {
+				t.Errorf("patron %s without password", row[col["userid"]])
+			}
+			lines = append(lines, strings.Join(row, ","))
+		}
+		sort.Strings(lines)
+		outputs = append(outputs, lines)
+	}
+	if !reflect.DeepEqual(outputs[0], outputs[1]) {
+		t.Error("streamed patrons.csv differs from patrons.csv indexed in memory")
+	}
+}
+
+func BenchmarkGeneratedDumps(b *testing.B) {
+	cfg := e2eConfig
+	cfg.Patrons = 5000
+	d, err := dumpgen.Generate(cfg, 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "patronmassage")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeDumps(b, d, dir)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runGenerated(b, dir, false)
+	}
+}
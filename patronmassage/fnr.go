@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Output modes for the fnr borrower attribute.
+const (
+	fnrModeClear   = "clear"   // write fnr in clear text
+	fnrModeHash    = "hash"    // write keyed hash (HMAC-SHA256) of fnr
+	fnrModeEncrypt = "encrypt" // write fnr encrypted with AES-GCM
+)
+
+var (
+	errFnrLength   = errors.New("not 11 digits")
+	errFnrChecksum = errors.New("invalid check digits")
+	errFnrDate     = errors.New("invalid date of birth")
+)
+
+// fnrInfo holds information extracted from a valid Norwegian national identity
+// number (fødselsnummer or D-number).
+type fnrInfo struct {
+	DateOfBirth time.Time
+	DNumber     bool // D-number, assigned to foreign nationals
+	HNumber     bool // H-number, temporary number assigned by health services
+}
+
+// parseFnr validates a Norwegian national identity number: its check digits
+// (modulus 11) and that it encodes a valid date of birth.
+func parseFnr(s string) (fnrInfo, error) {
+	var info fnrInfo
+	if len(s) != 11 {
+		return info, errFnrLength
+	}
+	var d [11]int
+	for i := 0; i < 11; i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return info, errFnrLength
+		}
+		d[i] = int(s[i] - '0')
+	}
+
+	k1 := 11 - (3*d[0]+7*d[1]+6*d[2]+1*d[3]+8*d[4]+9*d[5]+4*d[6]+5*d[7]+2*d[8])%11
+	if k1 == 11 {
+		k1 = 0
+	}
+	k2 := 11 - (5*d[0]+4*d[1]+3*d[2]+2*d[3]+7*d[4]+6*d[5]+5*d[6]+4*d[7]+3*d[8]+2*k1)%11
+	if k2 == 11 {
+		k2 = 0
+	}
+	if k1 == 10 || k2 == 10 || k1 != d[9] || k2 != d[10] {
+		return info, errFnrChecksum
+	}
+
+	day := d[0]*10 + d[1]
+	month := d[2]*10 + d[3]
+	year := d[4]*10 + d[5]
+	ind := d[6]*100 + d[7]*10 + d[8]
+
+	if day > 40 {
+		day -= 40
+		info.DNumber = true
+	}
+	if month > 40 {
+		month -= 40
+		info.HNumber = true
+	}
+
+	// century is given by the individual number
+	switch {
+	case ind < 500:
+		year += 1900
+	case ind < 750 && year >= 54:
+		year += 1800
+	case year < 40:
+		year += 2000
+	case ind >= 900:
+		year += 1900
+	default:
+		return info, errFnrDate
+	}
+
+	dob := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if dob.Day() != day || int(dob.Month()) != month {
+		// time.Date normalizes overflowing dates, ex: 31/02
+		return info, errFnrDate
+	}
+	info.DateOfBirth = dob
+	return info, nil
+}
+
+// fnrHandler validates the patrons national identity numbers, and encodes
+// them for the fnr borrower attribute according to the output mode.
+type fnrHandler struct {
+	mode        string
+	key         []byte
+	keepInvalid bool // keep fnr which fail validation
+	aead        cipher.AEAD
+
+	mu     sync.Mutex
+	report *csv.Writer
+	counts map[string]int // problem -> count
+}
+
+func newFnrHandler(mode string, key []byte, keepInvalid bool, report io.Writer) (*fnrHandler, error) {
+	h := &fnrHandler{
+		mode:        mode,
+		key:         key,
+		keepInvalid: keepInvalid,
+		report:      csv.NewWriter(report),
+		counts:      make(map[string]int),
+	}
+	switch mode {
+	case fnrModeClear:
+	case fnrModeHash, fnrModeEncrypt:
+		if len(key) == 0 {
+			return nil, fmt.Errorf("fnr output mode %q requires a key", mode)
+		}
+	default:
+		return nil, fmt.Errorf("unknown fnr output mode: %q", mode)
+	}
+	if mode == fnrModeEncrypt {
+		// derive a 256-bit AES key from the supplied key
+		k := sha256.Sum256(key)
+		block, err := aes.NewCipher(k[:])
+		if err != nil {
+			return nil, err
+		}
+		h.aead, err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+	}
+	h.report.Write([]string{"userid", "fnr", "dateofbirth", "fnr dateofbirth", "problem"})
+	return h, nil
+}
+
+// check validates the patrons fnr, and compares it with the date of birth.
+// Invalid fnrs are removed from the patron, unless keepInvalid is set. A missing
+// date of birth is taken from the fnr.
+func (h *fnrHandler) check(p *patron) {
+	if p.TEMP_personnr == "" {
+		return
+	}
+	info, err := parseFnr(p.TEMP_personnr)
+	if err != nil {
+		h.record(p, err.Error(), "")
+		if !h.keepInvalid {
+			p.TEMP_personnr = ""
+		}
+		return
+	}
+	dob := info.DateOfBirth.Format(mysqlDateFormat)
+	switch p.dateofbirth {
+	case dob:
+	case "":
+		h.record(p, "date of birth missing, taken from fnr", dob)
+		p.dateofbirth = dob
+	default:
+		h.record(p, "date of birth does not match fnr", dob)
+	}
+}
+
+// attribute returns the value to be written as the fnr borrower attribute.
+func (h *fnrHandler) attribute(fnr string) (string, error) {
+	switch h.mode {
+	case fnrModeHash:
+		mac := hmac.New(sha256.New, h.key)
+		mac.Write([]byte(fnr))
+		return hex.EncodeToString(mac.Sum(nil)), nil
+	case fnrModeEncrypt:
+		nonce := make([]byte, h.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(h.aead.Seal(nonce, nonce, []byte(fnr), nil)), nil
+	}
+	return fnr, nil
+}
+
+// record reports a problem with a patrons fnr, along with the date of birth
+// encoded in it, if valid. Only the date part of the fnr is included, so that
+// the report can be shared without disclosing the numbers.
+func (h *fnrHandler) record(p *patron, problem, fnrDOB string) {
+	masked := p.TEMP_personnr
+	if len(masked) > 6 {
+		masked = masked[:6] + "*****"
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[problem]++
+	h.report.Write([]string{p.userid, masked, p.dateofbirth, fnrDOB, problem})
+}
+
+// Flush writes any buffered report rows, and prints a summary to w.
+func (h *fnrHandler) Flush(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.report.Flush()
+	problems := make([]string, 0, len(h.counts))
+	for problem := range h.counts {
+		problems = append(problems, problem)
+	}
+	sort.Strings(problems)
+	fmt.Fprintln(w, "Fødselsnummer validation:")
+	for _, problem := range problems {
+		fmt.Fprintf(w, "%s\t%d\n", problem, h.counts[problem])
+	}
+	return h.report.Error()
+}
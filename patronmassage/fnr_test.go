@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestParseFnr(t *testing.T) {
+	tests := []struct {
+		fnr     string
+		dob     string
+		dnumber bool
+		err     error
+	}{
+		{"02031145530", "1911-03-02", false, nil},
+		{"42031145524", "1911-03-02", true, nil},
+		{"01010550048", "2005-01-01", false, nil},
+		{"02031145555", "", false, errFnrChecksum},
+		{"0203114553", "", false, errFnrLength},
+		{"0203114553X", "", false, errFnrLength},
+		{"29020145518", "", false, errFnrDate}, // 1901 is not a leap year
+		{"30020145567", "", false, errFnrDate},
+	}
+	for _, test := range tests {
+		info, err := parseFnr(test.fnr)
+		if err != test.err {
+			t.Errorf("parseFnr(%q) error => %v; want %v", test.fnr, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := info.DateOfBirth.Format(mysqlDateFormat); got != test.dob {
+			t.Errorf("parseFnr(%q) date of birth => %s; want %s", test.fnr, got, test.dob)
+		}
+		if info.DNumber != test.dnumber {
+			t.Errorf("parseFnr(%q) D-number => %v; want %v", test.fnr, info.DNumber, test.dnumber)
+		}
+	}
+}
+
+func TestFnrHandler(t *testing.T) {
+	var report bytes.Buffer
+	h, err := newFnrHandler(fnrModeClear, nil, false, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		in, want patron
+	}{
+		{
+			patron{TEMP_personnr: "02031145530", dateofbirth: "1911-03-02"},
+			patron{TEMP_personnr: "02031145530", dateofbirth: "1911-03-02"},
+		},
+		{
+			patron{TEMP_personnr: "02031145530"},
+			patron{TEMP_personnr: "02031145530", dateofbirth: "1911-03-02"},
+		},
+		{
+			patron{TEMP_personnr: "02031145530", dateofbirth: "1912-03-02"},
+			patron{TEMP_personnr: "02031145530", dateofbirth: "1912-03-02"},
+		},
+		{
+			patron{TEMP_personnr: "02031145555", dateofbirth: "1911-03-02"},
+			patron{dateofbirth: "1911-03-02"},
+		},
+	}
+	for _, test := range tests {
+		got := test.in
+		h.check(&got)
+		if got != test.want {
+			t.Errorf("check(%+v) =>\n%+v; want:\n%+v", test.in, got, test.want)
+		}
+	}
+	if err := h.Flush(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(report.String(), "02031145530") {
+		t.Errorf("report discloses fnr:\n%s", report.String())
+	}
+	for _, problem := range []string{"date of birth missing, taken from fnr", "date of birth does not match fnr", errFnrChecksum.Error()} {
+		if !strings.Contains(report.String(), problem) {
+			t.Errorf("report missing problem %q:\n%s", problem, report.String())
+		}
+	}
+
+	if _, err := newFnrHandler(fnrModeHash, nil, false, ioutil.Discard); err == nil {
+		t.Error("newFnrHandler in hash mode without key: want error, got nil")
+	}
+}
+
+func TestFnrAttribute(t *testing.T) {
+	key := []byte("secret")
+	const fnr = "02031145530"
+
+	h, err := newFnrHandler(fnrModeHash, key, false, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a1, _ := h.attribute(fnr)
+	a2, _ := h.attribute(fnr)
+	if a1 != a2 || a1 == fnr || len(a1) != 64 {
+		t.Errorf("hash mode: got %q and %q; want equal HMAC-SHA256 hex digests", a1, a2)
+	}
+
+	h, err = newFnrHandler(fnrModeEncrypt, key, false, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := h.attribute(fnr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := sha256.Sum256(key)
+	block, _ := aes.NewCipher(k[:])
+	aead, _ := cipher.NewGCM(block)
+	plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != fnr {
+		t.Errorf("encrypt mode: decrypted %q; want %q", plain, fnr)
+	}
+}
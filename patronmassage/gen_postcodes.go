@@ -0,0 +1,87 @@
+//go:build ignore
+// +build ignore
+
+// gen_postcodes generates postcodes.go, the postcode register bundled with
+// patronmassage, from Posten's register (Postnummerregister-ansi.txt, from
+// https://www.bring.no/tjenester/adressetjenester/postnummer):
+//
+//	go run gen_postcodes.go -in Postnummerregister-ansi.txt
+//
+// The register is tab-separated postcode, city, municipality number,
+// municipality and category, encoded in ISO-8859-1.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("gen_postcodes: ")
+	in := flag.String("in", "Postnummerregister-ansi.txt", "Posten's postcode register")
+	out := flag.String("out", "postcodes.go", "Go file to write")
+	latin1 := flag.Bool("latin1", true, "register is encoded in ISO-8859-1")
+	flag.Parse()
+
+	f, err := os.Open(*in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	postcodes := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if *latin1 {
+			runes := make([]rune, len(line))
+			for i := 0; i < len(line); i++ {
+				runes[i] = rune(line[i])
+			}
+			line = string(runes)
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 || len(fields[0]) != 4 {
+			continue
+		}
+		postcodes[fields[0]] = strings.TrimSpace(fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+	if len(postcodes) == 0 {
+		log.Fatalf("no postcodes in %s", *in)
+	}
+	zips := make([]string, 0, len(postcodes))
+	for zip := range postcodes {
+		zips = append(zips, zip)
+	}
+	sort.Strings(zips)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by gen_postcodes.go from %s; DO NOT EDIT.\n\n", filepath.Base(*in))
+	fmt.Fprintf(&buf, "package main\n\n")
+	fmt.Fprintf(&buf, "// bundledPostcodes is Posten's postcode register: postcode -> city.\n")
+	fmt.Fprintf(&buf, "var bundledPostcodes = map[string]string{\n")
+	for _, zip := range zips {
+		fmt.Fprintf(&buf, "\t%q: %q,\n", zip, postcodes[zip])
+	}
+	fmt.Fprintf(&buf, "}\n")
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(*out, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Actions on patrons inactive beyond the retention period.
+const (
+	inactiveKeep    = "keep"    // migrate as any other patron
+	inactiveFlag    = "flag"    // migrate, but mark in sort1 for later review
+	inactiveExclude = "exclude" // do not migrate
+)
+
+// inactiveSort1 is the sort1 value of flagged inactive patrons.
+const inactiveSort1 = "inaktiv"
+
+// lifecyclePolicy derives patron category and expiry date from age and activity,
+// and applies the retention policy to long-inactive patrons. All calculations are
+// relative to a reference date.
+type lifecyclePolicy struct {
+	now            time.Time
+	childMaxAge    int    // oldest age in category B (Barn), see categories.sql
+	adultMinAge    int    // youngest age in category V (Voksen), see categories.sql
+	expiryYears    int    // expiry is last activity plus this; 0 to keep default expiry
+	retentionYears int    // patrons inactive this long are subject to inactiveAction; 0 to disable
+	inactiveAction string // inactiveKeep, inactiveFlag or inactiveExclude
+
+	mu     sync.Mutex
+	report *csv.Writer
+	counts map[string]int // change -> count
+}
+
+func newLifecyclePolicy(now time.Time, expiryYears, retentionYears int, inactiveAction string, report io.Writer) (*lifecyclePolicy, error) {
+	switch inactiveAction {
+	case inactiveKeep, inactiveFlag, inactiveExclude:
+	default:
+		return nil, fmt.Errorf("unknown action on inactive patrons: %q", inactiveAction)
+	}
+	lp := &lifecyclePolicy{
+		now:            now,
+		childMaxAge:    15,
+		adultMinAge:    16,
+		expiryYears:    expiryYears,
+		retentionYears: retentionYears,
+		inactiveAction: inactiveAction,
+		report:         csv.NewWriter(report),
+		counts:         make(map[string]int),
+	}
+	lp.report.Write([]string{"userid", "field", "value", "new value", "reason"})
+	return lp, nil
+}
+
+// apply applies the policy to the patron, which must have its category mapped
+// to a Koha category. It returns true if the patron should be excluded from migration.
+func (lp *lifecyclePolicy) apply(p *patron) bool {
+	if dob, err := time.Parse(mysqlDateFormat, p.dateofbirth); err == nil {
+		age := yearsBetween(dob, lp.now)
+		switch {
+		case p.categorycode == "B" && age > lp.childMaxAge:
+			lp.record(p, "categorycode", p.categorycode, "V", fmt.Sprintf("age %d", age))
+			p.categorycode = "V"
+		case p.categorycode == "V" && age < lp.adultMinAge:
+			lp.record(p, "categorycode", p.categorycode, "B", fmt.Sprintf("age %d", age))
+			p.categorycode = "B"
+		}
+	}
+
+	last, ok := lp.lastActivity(p)
+	if !ok {
+		return false
+	}
+
+	if lp.retentionYears > 0 && last.AddDate(lp.retentionYears, 0, 0).Before(lp.now) {
+		reason := fmt.Sprintf("inactive since %s", last.Format(mysqlDateFormat))
+		switch lp.inactiveAction {
+		case inactiveExclude:
+			lp.record(p, "", "", "", reason+"; excluded")
+			return true
+		case inactiveFlag:
+			lp.record(p, "sort1", p.sort1, inactiveSort1, reason)
+			p.sort1 = inactiveSort1
+		}
+	}
+
+	if lp.expiryYears > 0 {
+		p.dateexpiry = last.AddDate(lp.expiryYears, 0, 0).Format(mysqlDateFormat)
+	}
+	return false
+}
+
+// lastActivity returns the most recent of the patrons last loan and enrolment date.
+func (lp *lifecyclePolicy) lastActivity(p *patron) (time.Time, bool) {
+	var last time.Time
+	for _, s := range []string{p.TEMP_sistelaan, p.dateenrolled} {
+		if t, err := time.Parse(mysqlDateFormat, s); err == nil && t.After(last) {
+			last = t
+		}
+	}
+	return last, !last.IsZero()
+}
+
+func (lp *lifecyclePolicy) record(p *patron, field, old, newVal, reason string) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if field == "" {
+		lp.counts["excluded as inactive"]++
+	} else {
+		lp.counts[field+" changed"]++
+	}
+	lp.report.Write([]string{p.userid, field, old, newVal, reason})
+}
+
+// Flush writes any buffered report rows, and prints a summary to w.
+func (lp *lifecyclePolicy) Flush(w io.Writer) error {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	lp.report.Flush()
+	changes := make([]string, 0, len(lp.counts))
+	for change := range lp.counts {
+		changes = append(changes, change)
+	}
+	sort.Strings(changes)
+	fmt.Fprintln(w, "Category, expiry and retention policy:")
+	for _, change := range changes {
+		fmt.Fprintf(w, "%s\t%d\n", change, lp.counts[change])
+	}
+	return lp.report.Error()
+}
+
+// yearsBetween returns the number of whole years from a to b,
+// i.e. the age at b of someone born at a.
+func yearsBetween(a, b time.Time) int {
+	years := b.Year() - a.Year()
+	if b.Month() < a.Month() || (b.Month() == a.Month() && b.Day() < a.Day()) {
+		years--
+	}
+	return years
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestLifecyclePolicy(t *testing.T) {
+	now := time.Date(2016, 8, 19, 0, 0, 0, 0, time.UTC)
+	lp, err := newLifecyclePolicy(now, 3, 5, inactiveFlag, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		in, want patron
+		exclude  bool
+	}{
+		{
+			// child grown up
+			patron{categorycode: "B", dateofbirth: "2000-08-18", TEMP_sistelaan: "2016-06-08"},
+			patron{categorycode: "V", dateofbirth: "2000-08-18", TEMP_sistelaan: "2016-06-08", dateexpiry: "2019-06-08"},
+			false,
+		},
+		{
+			// turns 16 tomorrow
+			patron{categorycode: "B", dateofbirth: "2000-08-20", dateenrolled: "2014-01-01", TEMP_sistelaan: "2013-01-01"},
+			patron{categorycode: "B", dateofbirth: "2000-08-20", dateenrolled: "2014-01-01", TEMP_sistelaan: "2013-01-01", dateexpiry: "2017-01-01"},
+			false,
+		},
+		{
+			// child registered as adult
+			patron{categorycode: "V", dateofbirth: "2006-01-01", TEMP_sistelaan: "2016-06-08"},
+			patron{categorycode: "B", dateofbirth: "2006-01-01", TEMP_sistelaan: "2016-06-08", dateexpiry: "2019-06-08"},
+			false,
+		},
+		{
+			// inactive
+			patron{categorycode: "V", TEMP_sistelaan: "2009-01-01", dateenrolled: "2002-01-11"},
+			patron{categorycode: "V", TEMP_sistelaan: "2009-01-01", dateenrolled: "2002-01-11", dateexpiry: "2012-01-01", sort1: inactiveSort1},
+			false,
+		},
+		{
+			// no activity known; default expiry kept
+			patron{categorycode: "I", dateexpiry: "2099-01-01"},
+			patron{categorycode: "I", dateexpiry: "2099-01-01"},
+			false,
+		},
+	}
+	for _, test := range tests {
+		got := test.in
+		if exclude := lp.apply(&got); exclude != test.exclude {
+			t.Errorf("apply(%+v) exclude => %v; want %v", test.in, exclude, test.exclude)
+		}
+		if got != test.want {
+			t.Errorf("apply(%+v) =>\n%+v; want:\n%+v", test.in, got, test.want)
+		}
+	}
+
+	lp, _ = newLifecyclePolicy(now, 3, 5, inactiveExclude, ioutil.Discard)
+	if p := (patron{TEMP_sistelaan: "2009-01-01"}); !lp.apply(&p) {
+		t.Error("inactive patron not excluded")
+	}
+	if p := (patron{TEMP_sistelaan: "2012-01-01"}); lp.apply(&p) {
+		t.Error("active patron excluded")
+	}
+}
@@ -19,23 +19,56 @@ VALUES
   ("SKO","Skole","I", "2999-12-31",\N,\N),
   ("V","Voksen","A","2999-12-31",\N,16);`
 
-	fnrTemplSQL = `
+	// Extended patron attribute
+	attributeTmplSQL = `
 INSERT IGNORE INTO borrower_attributes (borrowernumber, code, attribute)
 SELECT borrowers.borrowernumber,
-       'fnr',
-       '{{.Fnr}}'
+       '{{sql .Code}}',
+       '{{sql .Attribute}}'
 FROM borrowers
 WHERE borrowers.userid = '{{.BibliofilBorrowerNr}}';
 `
 
-	meråpentTemplSQL = `
-INSERT IGNORE INTO borrower_attributes (borrowernumber, code, attribute)
+	// Extended patron attribute types
+	attributeTypesTmplSQL = `{{range .}}
+INSERT IGNORE INTO borrower_attribute_types (code, description, repeatable, unique_id, opac_display, staff_searchable)
+VALUES ('{{sql .Code}}', '{{sql .Description}}', {{if .Repeatable}}1{{else}}0{{end}}, {{if .Unique}}1{{else}}0{{end}}, {{if .OpacDisplay}}1{{else}}0{{end}}, 1);
+{{end}}`
+
+	// defaultAttributesConfig maps patron source fields to extended patron
+	// attributes, see newAttributes for the format.
+	defaultAttributesConfig = `
+# code	description	repeatable	unique	opac	source	transform
+fnr	Fødselsnummer	0	1	0	patron:fnr	fnr
+dooraccess	Meråpent	0	0	0	laaner:ln_obs	flags:D=1,B=B
+`
+
+	// Patron debarment
+	debarmentTmplSQL = `
+INSERT INTO borrower_debarments (borrowernumber, expiration, type, comment, created)
 SELECT borrowers.borrowernumber,
-       'dooraccess',
-       '{{.Code}}'
+       {{if .Expiration}}'{{.Expiration}}'{{else}}NULL{{end}},
+       '{{.Type}}',
+       '{{sql .Comment}}',
+       NOW()
 FROM borrowers
 WHERE borrowers.userid = '{{.BibliofilBorrowerNr}}';
 `
+
+	// defaultDebarmentsConfig maps Bibliofil obs flags to patron debarments,
+	// see newDebarments for the format. m (lost card), f (wrong address),
+	// D and B (Meråpent) are migrated as lost, gonenoaddress and dooraccess.
+	defaultDebarmentsConfig = `
+# flag	type	expiration	comment	message
+s	MANUAL	sperres	Sperret i Bibliofil	1
+r	OVERDUES	-	Regning sendt	0
+i	OVERDUES	-	Sendt til inkasso	0
+m	-	-	-	0
+f	-	-	-	0
+D	-	-	-	0
+B	-	-	-	0
+`
+
 	borrwersyncTemplSQL = `
 INSERT IGNORE INTO borrower_sync (borrowernumber, synctype, sync, syncstatus, lastsync, hashed_pin)
 SELECT borrowers.borrowernumber,
@@ -240,42 +273,34 @@ VALUES
 		"ukjent": "Ukjent avdeling",
 	}
 
-	msgPrefsInit = `
--- item due:
-INSERT INTO borrower_message_preferences (borrowernumber, message_attribute_id)
-  SELECT borrowernumber,1 FROM borrowers;
-
--- advance notice:
-INSERT INTO borrower_message_preferences (borrowernumber, message_attribute_id, days_in_advance)
-  SELECT borrowernumber,2,2 FROM borrowers;
+	// Message preferences for all borrowers, one for each configured message type
+	msgPrefsInitTmplSQL = `{{range .}}
+-- {{.Name}}:
+INSERT INTO borrower_message_preferences (borrowernumber, message_attribute_id, days_in_advance, wants_digest)
+  SELECT borrowernumber,{{.AttributeID}},{{if .DaysInAdvance}}{{.DaysInAdvance}}{{else}}NULL{{end}},{{if .Digest}}1{{else}}0{{end}} FROM borrowers;
+{{end}}`
 
--- hold filled:
-INSERT INTO borrower_message_preferences (borrowernumber, message_attribute_id)
-  SELECT borrowernumber,4 FROM borrowers;
-`
-
-	// Message for Item due
-	msgDue = `
+	// Message transport of a borrowers message preference
+	msgTransportTmplSQL = `
 INSERT INTO borrower_message_transport_preferences (borrower_message_preference_id, message_transport_type)
-SELECT borrower_message_preferences.borrower_message_preference_id,%q FROM borrower_message_preferences
+SELECT borrower_message_preferences.borrower_message_preference_id,'{{sql .Transport}}' FROM borrower_message_preferences
   INNER JOIN borrowers ON borrower_message_preferences.borrowernumber = borrowers.borrowernumber
-  AND message_attribute_id = 1
-  WHERE borrowers.userid=%q;`
+  AND message_attribute_id = {{.AttributeID}}
+  WHERE borrowers.userid='{{sql .BibliofilBorrowerNr}}';
+`
 
-	// Message for advance notice
-	msgNotice = `
-INSERT INTO borrower_message_transport_preferences (borrower_message_preference_id, message_transport_type)
-SELECT borrower_message_preferences.borrower_message_preference_id,%q FROM borrower_message_preferences
-  INNER JOIN borrowers ON borrower_message_preferences.borrowernumber = borrowers.borrowernumber
-  AND message_attribute_id = 2
-  WHERE borrowers.userid=%q;`
+	// defaultMsgPrefsConfig maps Bibliofil notifications to Koha message
+	// preferences, see newMsgPrefs for the format.
+	defaultMsgPrefsConfig = `
+# message	notification	message_attribute_id	days_in_advance	digest
+message	due	1	-	0
+message	advance	2	2	0
+message	hold	4	-	0
 
-	// Message for hold filled
-	msgHold = `
-INSERT INTO borrower_message_transport_preferences (borrower_message_preference_id, message_transport_type)
-SELECT borrower_message_preferences.borrower_message_preference_id,%q FROM borrower_message_preferences
-  INNER JOIN borrowers ON borrower_message_preferences.borrowernumber = borrowers.borrowernumber
-  AND message_attribute_id = 4
-  WHERE borrowers.userid=%q;
+# transport	notification	Bibliofil transport	Koha transport types
+transport	*	epost	email
+transport	*	sms	sms
+transport	*	post	print
+transport	*	brev	print
 `
 )
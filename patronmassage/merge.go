@@ -2,14 +2,12 @@ package main
 
 import (
 	"bytes"
-	"log"
 	"strings"
 	"time"
 	"unicode"
 
-	"golang.org/x/crypto/bcrypt"
-
 	"github.com/boutros/marc"
+	"github.com/digibib/migtools/patrondump"
 )
 
 const (
@@ -47,8 +45,6 @@ type patron struct {
 		altcontactzipcode           string    // `altcontactzipcode` varchar(50) DEFAULT NULL,
 		altcontactcountry           string    // `altcontactcountry` text
 		altcontactphone             string    // `altcontactphone` varchar(50) DEFAULT NULL,
-		debarred                    time.Time // `debarred` date DEFAULT NULL,
-		debarredcomment             string    // `debarredcomment` varchar(255) DEFAULT NULL,
 		relationship                string    // `relationship` varchar(100) DEFAULT NULL,
 		contactname                 string    // `contactname` mediumtext
 		contactfirstname            string    // `contactfirstname` text
@@ -58,7 +54,6 @@ type patron struct {
 		opacnote                    string    // `opacnote` mediumtext
 		updated_on                  time.Time // `updated_on` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
 		contactnote                 string    // `contactnote` varchar(255) DEFAULT NULL,
-		sort1                       string    // `sort1` varchar(80) DEFAULT NULL,
 		sort2                       string    // `sort2` varchar(80) DEFAULT NULL,
 		mobile                      string    // `mobile` varchar(50) DEFAULT NULL,
 		flags                       int       // `flags` int(11) DEFAULT NULL,
@@ -88,25 +83,37 @@ type patron struct {
 	password          string // `password` varchar(60) DEFAULT NULL,
 	privacy           int    // `privacy` int(11) NOT NULL DEFAULT '1',
 	altcontactsurname string // `altcontactsurname` varchar(255) DEFAULT NULL,
+	sort1             string // `sort1` varchar(80) DEFAULT NULL,
+	debarred          string // `debarred` date DEFAULT NULL,
+	debarredcomment   string // `debarredcomment` varchar(255) DEFAULT NULL,
 
 	// Temporary variables that have no matching column in the borrowers table,
 	// but we need the information for further processing or populating borrower-connected tables.
 	TEMP_sistelaan         string
 	TEMP_personnr          string
+	TEMP_pin               string
 	TEMP_pinhashed         string
 	TEMP_nl                bool
 	TEMP_nl_lastsync       string
 	TEMP_hjemmebibnr       string
-	TEMP_res_transport     string
+	TEMP_res_transport     string // comma-separated, see patron.transports
 	TEMP_pur_transport     string
 	TEMP_fvarsel_transport string
-	TEMP_meråpent_tilgang  bool
-	TEMP_meråpent_sperret  bool
+	TEMP_obs               string // ln_obs and ln_friobs flags, see debarments
+	TEMP_sperres           string
+	TEMP_src               *patrondump.Sources // source records, for mappings done when writing
 }
 
 // splitZipCity splits string into zip code and city. If there is no
 // match in zipcode, the whole input string will be returned as the second return value.
+// A country prefix ("N-" or "NO-") before the zip code is ignored.
 func splitZipCity(s string) (string, string) {
+	for _, prefix := range []string{"N-", "NO-"} {
+		if len(s) > len(prefix) && strings.HasPrefix(s, prefix) && '0' <= s[len(prefix)] && s[len(prefix)] <= '9' {
+			s = s[len(prefix):]
+			break
+		}
+	}
 	i := 0
 	for ; i < len(s); i++ {
 		if !('0' <= s[i] && s[i] <= '9') {
@@ -130,11 +137,11 @@ func firstSub(s marc.SubFields, code string) string {
 	return ""
 }
 
-// onlyDigits strip all characters from string except digits and '+' sign
+// onlyDigits strip all characters from string except digits and a leading '+' sign
 func onlyDigits(s string) string {
 	var r bytes.Buffer
-	for _, c := range s {
-		if unicode.IsDigit(c) || c == '+' {
+	for i, c := range strings.TrimSpace(s) {
+		if unicode.IsDigit(c) || (c == '+' && i == 0) {
 			r.WriteRune(c)
 		}
 	}
@@ -198,6 +205,15 @@ func merge(lmarc *marc.Record, laaner, lnel map[string]string) patron {
 		}
 	}
 
+	if laaner["ln_sperres"] != "00/00/0000" {
+		d, err := time.Parse(noDateFormat, laaner["ln_sperres"])
+		if err == nil {
+			p.TEMP_sperres = d.Format(mysqlDateFormat)
+		}
+	}
+
+	p.TEMP_obs = laaner["ln_obs"] + laaner["ln_friobs"]
+
 	if strings.Contains(laaner["ln_obs"]+laaner["ln_friobs"], "m") {
 		p.lost = true
 	}
@@ -206,13 +222,6 @@ func merge(lmarc *marc.Record, laaner, lnel map[string]string) patron {
 		p.gonenoaddress = true
 	}
 
-	// Meråpent
-	if strings.Contains(laaner["ln_obs"], "D") {
-		p.TEMP_meråpent_tilgang = true
-	} else if strings.Contains(laaner["ln_obs"], "B") {
-		p.TEMP_meråpent_sperret = true
-	}
-
 	// 3) information from lnel
 	if lnel != nil {
 		p.email = strings.TrimSpace(lnel["lnel_epost"])
@@ -269,22 +278,17 @@ func merge(lmarc *marc.Record, laaner, lnel map[string]string) patron {
 				p.smsalertnumber = v
 			}
 		case "261":
-			if v := firstSub(f.SubFields, "a"); v != "" {
-				pin, err := bcrypt.GenerateFromPassword([]byte(v), 8)
-				if err != nil {
-					log.Fatal(err)
-				}
-				p.password = string(pin)
-			}
+			// PIN is hashed into p.password in a separate stage, see pinHasher
+			p.TEMP_pin = firstSub(f.SubFields, "a")
 			if v := firstSub(f.SubFields, "z"); v != "" {
 				p.TEMP_pinhashed = v
 			}
-		case "270": // transporttype reserveringsbrev
-			p.TEMP_res_transport = strings.ToLower(firstSub(f.SubFields, "a"))
-		case "271": // transporttype purring
-			p.TEMP_pur_transport = strings.ToLower(firstSub(f.SubFields, "a"))
-		case "272": // transporttype forhåndsvarsel
-			p.TEMP_fvarsel_transport = strings.ToLower(firstSub(f.SubFields, "a"))
+		case "270": // transporttype reserveringsbrev (repeterbart felt)
+			p.TEMP_res_transport = addTransport(p.TEMP_res_transport, firstSub(f.SubFields, "a"))
+		case "271": // transporttype purring (repeterbart felt)
+			p.TEMP_pur_transport = addTransport(p.TEMP_pur_transport, firstSub(f.SubFields, "a"))
+		case "272": // transporttype forhåndsvarsel (repeterbart felt)
+			p.TEMP_fvarsel_transport = addTransport(p.TEMP_fvarsel_transport, firstSub(f.SubFields, "a"))
 		case "300": // Lagre historikk
 			if firstSub(f.SubFields, "a") == "1" {
 				// 0 = forever, 1 = default, 2 = never
@@ -309,3 +313,15 @@ func merge(lmarc *marc.Record, laaner, lnel map[string]string) patron {
 
 	return p
 }
+
+// addTransport adds a transport to a comma-separated list of transports.
+func addTransport(transports, t string) string {
+	t = strings.ToLower(strings.TrimSpace(t))
+	switch {
+	case t == "":
+		return transports
+	case transports == "":
+		return t
+	}
+	return transports + "," + t
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Bibliofil notifications, with the transports chosen by the patron in lmarc 270-272.
+const (
+	notificationHold    = "hold"    // 270: hold filled
+	notificationDue     = "due"     // 271: item overdue (purring)
+	notificationAdvance = "advance" // 272: advance notice (forhåndsvarsel)
+)
+
+// transports returns the transports chosen by the patron for the notification.
+func (p patron) transports(notification string) []string {
+	var v string
+	switch notification {
+	case notificationHold:
+		v = p.TEMP_res_transport
+	case notificationDue:
+		v = p.TEMP_pur_transport
+	case notificationAdvance:
+		v = p.TEMP_fvarsel_transport
+	}
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+// msgType is a Koha message type, which a Bibliofil notification is mapped to.
+type msgType struct {
+	Name          string // Bibliofil notification
+	AttributeID   int    // Koha message_attribute_id
+	DaysInAdvance int    // 0 for none
+	Digest        bool
+}
+
+// msgPrefs maps the Bibliofil notification preferences of patrons to Koha
+// message preferences and transports. Patrons with a transport they lack
+// contact data for, and transports without a mapping, are reported.
+type msgPrefs struct {
+	types      []msgType
+	transports map[string]map[string][]string // notification ("*" for any) -> Bibliofil transport -> Koha transport types
+
+	initTmpl, transportTmpl *template.Template
+
+	report *csv.Writer
+	counts map[string]int // problem -> count
+}
+
+// newMsgPrefs parses the configuration from r. The configuration is tab-separated,
+// with lines starting with '#' ignored. Message lines map a Bibliofil notification
+// (hold, due or advance) to a Koha message type:
+//
+//	message	<notification>	<message_attribute_id>	<days_in_advance or ->	<digest: 0 or 1>
+//
+// Transport lines map a Bibliofil transport to a comma-separated list of Koha
+// transport types, or "-" to not migrate it. The notification "*" gives the
+// default mapping, used when there is none for the given notification:
+//
+//	transport	<notification or *>	<Bibliofil transport>	<Koha transport types or ->
+func newMsgPrefs(config io.Reader, report io.Writer) (*msgPrefs, error) {
+	mp := &msgPrefs{
+		transports:    make(map[string]map[string][]string),
+		initTmpl:      template.Must(template.New("msgprefs").Parse(msgPrefsInitTmplSQL)),
+		transportTmpl: template.Must(template.New("msgtransport").Funcs(template.FuncMap{"sql": sqlEscape}).Parse(msgTransportTmplSQL)),
+		report:        csv.NewWriter(report),
+		counts:        make(map[string]int),
+	}
+
+	r := csv.NewReader(config)
+	r.Comma = '\t'
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	lines, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range lines {
+		switch {
+		case l[0] == "message" && len(l) == 5:
+			mt := msgType{Name: l[1], Digest: l[4] == "1"}
+			switch mt.Name {
+			case notificationHold, notificationDue, notificationAdvance:
+			default:
+				return nil, fmt.Errorf("message preferences: unknown notification %q", mt.Name)
+			}
+			if mt.AttributeID, err = strconv.Atoi(l[2]); err != nil {
+				return nil, fmt.Errorf("message preferences: %q: bad message_attribute_id: %v", mt.Name, err)
+			}
+			if l[3] != "-" {
+				if mt.DaysInAdvance, err = strconv.Atoi(l[3]); err != nil {
+					return nil, fmt.Errorf("message preferences: %q: bad days_in_advance: %v", mt.Name, err)
+				}
+			}
+			mp.types = append(mp.types, mt)
+		case l[0] == "transport" && len(l) == 4:
+			if mp.transports[l[1]] == nil {
+				mp.transports[l[1]] = make(map[string][]string)
+			}
+			var kohaTypes []string
+			if l[3] != "-" {
+				for _, t := range strings.Split(l[3], ",") {
+					kohaTypes = append(kohaTypes, strings.TrimSpace(t))
+				}
+			}
+			mp.transports[l[1]][strings.ToLower(l[2])] = kohaTypes
+		default:
+			return nil, fmt.Errorf("message preferences: bad line: %q", strings.Join(l, "\t"))
+		}
+	}
+
+	mp.report.Write([]string{"userid", "notification", "transport", "problem"})
+	return mp, nil
+}
+
+// WriteInit writes the SQL to create the message preferences of all borrowers.
+func (mp *msgPrefs) WriteInit(w io.Writer) error {
+	return mp.initTmpl.Execute(w, mp.types)
+}
+
+// kohaTransports returns the Koha transport types of a Bibliofil transport for
+// the notification, and false if there is no mapping.
+func (mp *msgPrefs) kohaTransports(notification, transport string) ([]string, bool) {
+	if ts, ok := mp.transports[notification][transport]; ok {
+		return ts, true
+	}
+	ts, ok := mp.transports["*"][transport]
+	return ts, ok
+}
+
+// Write writes the SQL setting the patrons message transports.
+// It is not safe for concurrent use.
+func (mp *msgPrefs) Write(w io.Writer, p patron) error {
+	for _, mt := range mp.types {
+		seen := make(map[string]bool)
+		for _, t := range p.transports(mt.Name) {
+			kohaTypes, ok := mp.kohaTransports(mt.Name, t)
+			if !ok {
+				mp.record(p, mt.Name, t, "no mapping for transport")
+				continue
+			}
+			if len(kohaTypes) == 0 {
+				mp.record(p, mt.Name, t, "transport not migrated")
+				continue
+			}
+			for _, kt := range kohaTypes {
+				if seen[kt] {
+					continue
+				}
+				seen[kt] = true
+				switch {
+				case kt == "sms" && p.smsalertnumber == "":
+					mp.record(p, mt.Name, kt, "sms without smsalertnumber")
+				case kt == "email" && p.email == "":
+					mp.record(p, mt.Name, kt, "email without email address")
+				case kt == "print" && p.address == "":
+					mp.record(p, mt.Name, kt, "print without address")
+				}
+				if err := mp.transportTmpl.Execute(w, struct {
+					Transport           string
+					AttributeID         int
+					BibliofilBorrowerNr string
+				}{
+					Transport:           kt,
+					AttributeID:         mt.AttributeID,
+					BibliofilBorrowerNr: p.userid,
+				}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (mp *msgPrefs) record(p patron, notification, transport, problem string) {
+	mp.counts[problem]++
+	mp.report.Write([]string{p.userid, notification, transport, problem})
+}
+
+// Flush writes any buffered report rows, and prints a summary to w.
+func (mp *msgPrefs) Flush(w io.Writer) error {
+	mp.report.Flush()
+	problems := make([]string, 0, len(mp.counts))
+	for problem := range mp.counts {
+		problems = append(problems, problem)
+	}
+	sort.Strings(problems)
+	fmt.Fprintln(w, "Message preferences:")
+	for _, problem := range problems {
+		fmt.Fprintf(w, "%s\t%d\n", problem, mp.counts[problem])
+	}
+	return mp.report.Error()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMsgPrefs(t *testing.T) {
+	const config = `# test config
+message	due	1	-	0
+message	advance	2	3	1
+message	hold	4	-	0
+transport	*	epost	email
+transport	*	sms	sms
+transport	*	post	print
+transport	advance	post	-
+transport	hold	epost+sms	email,sms
+`
+	var report bytes.Buffer
+	mp, err := newMsgPrefs(strings.NewReader(config), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var init bytes.Buffer
+	if err := mp.WriteInit(&init); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"SELECT borrowernumber,1,NULL,0 FROM borrowers;", "SELECT borrowernumber,2,3,1 FROM borrowers;", "SELECT borrowernumber,4,NULL,0 FROM borrowers;"} {
+		if !strings.Contains(init.String(), want) {
+			t.Errorf("message preferences missing %q:\n%s", want, init.String())
+		}
+	}
+
+	p := patron{
+		userid:                 "808708",
+		email:                  "test@example.com",
+		TEMP_res_transport:     addTransport(addTransport("", "EPost+SMS"), "epost"),
+		TEMP_pur_transport:     "post",
+		TEMP_fvarsel_transport: "post,telefon",
+	}
+	var sql bytes.Buffer
+	if err := mp.Write(&sql, p); err != nil {
+		t.Fatal(err)
+	}
+	if err := mp.Flush(&bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := sql.String()
+	for _, want := range []string{
+		"'email' FROM borrower_message_preferences\n  INNER JOIN borrowers ON borrower_message_preferences.borrowernumber = borrowers.borrowernumber\n  AND message_attribute_id = 4",
+		"'sms' FROM borrower_message_preferences\n  INNER JOIN borrowers ON borrower_message_preferences.borrowernumber = borrowers.borrowernumber\n  AND message_attribute_id = 4",
+		"'print' FROM borrower_message_preferences\n  INNER JOIN borrowers ON borrower_message_preferences.borrowernumber = borrowers.borrowernumber\n  AND message_attribute_id = 1",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("transports missing %q:\n%s", want, got)
+		}
+	}
+	if n := strings.Count(got, "INSERT INTO"); n != 3 {
+		t.Errorf("got %d transports; want 3 (hold: email, sms; due: print):\n%s", n, got)
+	}
+	if !strings.Contains(got, "WHERE borrowers.userid='808708';") {
+		t.Errorf("transports not for borrower 808708:\n%s", got)
+	}
+
+	// userids are escaped
+	sql.Reset()
+	p.userid = "8087'08"
+	if err := mp.Write(&sql, p); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(sql.String(), `WHERE borrowers.userid='8087\'08';`) {
+		t.Errorf("userid not escaped:\n%s", sql.String())
+	}
+	p.userid = "808708"
+
+	for _, want := range []string{
+		"808708,hold,sms,sms without smsalertnumber",
+		"808708,due,print,print without address",
+		"808708,advance,post,transport not migrated",
+		"808708,advance,telefon,no mapping for transport",
+	} {
+		if !strings.Contains(report.String(), want) {
+			t.Errorf("report missing %q:\n%s", want, report.String())
+		}
+	}
+
+	for _, bad := range []string{"message	nosuch	1	-	0", "message	due	x	-	0", "transport	*	epost"} {
+		if _, err := newMsgPrefs(strings.NewReader(bad), &bytes.Buffer{}); err == nil {
+			t.Errorf("newMsgPrefs(%q): want error, got nil", bad)
+		}
+	}
+	if _, err := newMsgPrefs(strings.NewReader(defaultMsgPrefsConfig), &bytes.Buffer{}); err != nil {
+		t.Errorf("default configuration: %v", err)
+	}
+}
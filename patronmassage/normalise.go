@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// normaliser validates and normalises patron contact data: Norwegian postcodes,
+// phone numbers and email addresses. Values which cannot be normalised are
+// cleared, so that garbage is not migrated, and every change is written to
+// a report.
+type normaliser struct {
+	postcodes   map[string]string // postcode -> city, from Posten's register
+	countryCode string            // default country calling code, without '+'
+
+	mu     sync.Mutex
+	report *csv.Writer
+	counts map[string]int // problem -> count
+}
+
+func newNormaliser(postcodes map[string]string, countryCode string, report io.Writer) *normaliser {
+	n := &normaliser{
+		postcodes:   postcodes,
+		countryCode: countryCode,
+		report:      csv.NewWriter(report),
+		counts:      make(map[string]int),
+	}
+	n.report.Write([]string{"userid", "field", "value", "problem", "new value"})
+	return n
+}
+
+// loadPostcodes reads Posten's postcode register (UTF-8, tab-separated:
+// postnummer, poststed, kommunenummer, kommune, kategori), returning a
+// map of postcode to city.
+func loadPostcodes(r io.Reader) (map[string]string, error) {
+	res := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 2 || len(fields[0]) != 4 {
+			continue
+		}
+		res[fields[0]] = strings.TrimSpace(fields[1])
+	}
+	return res, scanner.Err()
+}
+
+// normalise normalises the patrons postcode, city, phone, smsalertnumber and email
+// in place, reporting any problems found.
+func (n *normaliser) normalise(p *patron) {
+	if p.country == "" || strings.EqualFold(p.country, "no") {
+		n.normaliseZipCity(p)
+	}
+
+	if p.phone != "" {
+		v, problem := n.e164(p.phone)
+		n.record(p, "phone", p.phone, problem, v)
+		p.phone = v
+	}
+
+	if p.smsalertnumber != "" {
+		v, problem := n.e164(p.smsalertnumber)
+		if problem == "" && strings.HasPrefix(v, "+47") && !isNorwegianMobile(v) {
+			problem = "not a Norwegian mobile number"
+			if p.phone == "" {
+				p.phone = v
+			}
+			v = ""
+		}
+		n.record(p, "smsalertnumber", p.smsalertnumber, problem, v)
+		p.smsalertnumber = v
+	}
+
+	if p.email != "" {
+		v, problem := normaliseEmail(p.email)
+		n.record(p, "email", p.email, problem, v)
+		p.email = v
+	}
+}
+
+func (n *normaliser) normaliseZipCity(p *patron) {
+	if p.zipcode == "" {
+		if p.city != "" {
+			n.record(p, "zipcode", p.zipcode, "missing postcode", "")
+		}
+		return
+	}
+	zip := p.zipcode
+	if len(zip) == 3 {
+		// leading zero lost, ex: "475 OSLO"
+		zip = "0" + zip
+	}
+	if len(zip) != 4 {
+		n.record(p, "zipcode", p.zipcode, "malformed postcode", "")
+		p.zipcode = ""
+		return
+	}
+	city, ok := n.city(zip)
+	if !ok {
+		n.record(p, "zipcode", p.zipcode, "unknown postcode", "")
+		p.zipcode = ""
+		return
+	}
+	if zip != p.zipcode {
+		n.record(p, "zipcode", p.zipcode, "missing leading zero", zip)
+		p.zipcode = zip
+	}
+	if city != "" && !strings.EqualFold(city, p.city) {
+		n.record(p, "city", p.city, "city does not match postcode", city)
+		p.city = city
+	}
+}
+
+// city returns the city of the given postcode. When no postcode
+// register is loaded (neither -postnr nor bundledPostcodes), only Oslo
+// postcodes (0001-1299) are resolved to a city; other postcodes are accepted
+// as is.
+func (n *normaliser) city(zip string) (string, bool) {
+	if len(n.postcodes) > 0 {
+		city, ok := n.postcodes[zip]
+		return city, ok
+	}
+	if i, err := strconv.Atoi(zip); err == nil && i >= 1 && i <= 1299 {
+		return "OSLO", true
+	}
+	return "", true
+}
+
+// e164 formats a phone number in E.164 format, assuming the default country
+// code unless the number has an international prefix ('+' or "00").
+func (n *normaliser) e164(s string) (string, string) {
+	v := onlyDigits(s)
+	switch {
+	case strings.HasPrefix(v, "+"):
+		v = v[1:]
+	case strings.HasPrefix(v, "00"):
+		v = v[2:]
+	case n.countryCode == "47" && len(v) == 10 && strings.HasPrefix(v, "47"):
+		// country code without international prefix
+	default:
+		v = n.countryCode + strings.TrimPrefix(v, "0")
+	}
+	if len(v) < 8 || len(v) > 15 || v[0] == '0' {
+		return "", "invalid phone number"
+	}
+	if strings.HasPrefix(v, "47") && len(v) != 10 {
+		return "", "invalid Norwegian phone number"
+	}
+	return "+" + v, ""
+}
+
+// isNorwegianMobile reports whether s, in E.164 format, is a Norwegian
+// mobile number; these start with 4 or 9.
+func isNorwegianMobile(s string) bool {
+	return len(s) == 11 && (s[3] == '4' || s[3] == '9')
+}
+
+// normaliseEmail validates the email address syntactically and lowercases its domain.
+func normaliseEmail(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	a, err := mail.ParseAddress(s)
+	if err != nil || a.Name != "" || a.Address != s {
+		return "", "invalid email address"
+	}
+	i := strings.LastIndex(s, "@")
+	domain := strings.ToLower(s[i+1:])
+	if !strings.Contains(domain, ".") || strings.HasSuffix(domain, ".") || strings.Contains(domain, "_") {
+		return "", "invalid email domain"
+	}
+	return s[:i+1] + domain, ""
+}
+
+// record reports a change of a patron field. Nothing is reported
+// if the value is unchanged.
+func (n *normaliser) record(p *patron, field, old, problem, newVal string) {
+	if problem == "" && old == newVal {
+		return
+	}
+	if problem == "" {
+		problem = "normalised"
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.counts[problem]++
+	n.report.Write([]string{p.userid, field, old, problem, newVal})
+}
+
+// Flush writes any buffered report rows, and prints a summary to w.
+func (n *normaliser) Flush(w io.Writer) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.report.Flush()
+	problems := make([]string, 0, len(n.counts))
+	for problem := range n.counts {
+		problems = append(problems, problem)
+	}
+	sort.Strings(problems)
+	fmt.Fprintln(w, "Data quality normalisations:")
+	for _, problem := range problems {
+		fmt.Fprintf(w, "%s\t%d\n", problem, n.counts[problem])
+	}
+	return n.report.Error()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestNormalise(t *testing.T) {
+	postcodes, err := loadPostcodes(strings.NewReader(
+		"0475\tOSLO\t0301\tOSLO\tG\n4622\tKRISTIANSAND S\t1001\tKRISTIANSAND\tG\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		in, want patron
+	}{
+		{
+			patron{zipcode: "0475", city: "Oslo", phone: "22 33 44 55", smsalertnumber: "99887766", email: "Test.Testesen@GMail.COM"},
+			patron{zipcode: "0475", city: "Oslo", phone: "+4722334455", smsalertnumber: "+4799887766", email: "Test.Testesen@gmail.com"},
+		},
+		{
+			patron{zipcode: "475", city: "OSLO", smsalertnumber: "0047 998 87 766"},
+			patron{zipcode: "0475", city: "OSLO", smsalertnumber: "+4799887766"},
+		},
+		{
+			patron{zipcode: "4622", city: "KRISTIANSAND", smsalertnumber: "4799887766"},
+			patron{zipcode: "4622", city: "KRISTIANSAND S", smsalertnumber: "+4799887766"},
+		},
+		{
+			patron{zipcode: "9999", city: "NOWHERE", phone: "+46 8 123 456 78", email: "test@localhost"},
+			patron{zipcode: "", city: "NOWHERE", phone: "+46812345678", email: ""},
+		},
+		{
+			patron{zipcode: "0475", city: "OSLO", phone: "123", smsalertnumber: "22334455", email: "Test <test@example.com>"},
+			patron{zipcode: "0475", city: "OSLO", phone: "+4722334455"},
+		},
+		{
+			// foreign addresses are left untouched
+			patron{country: "se", zipcode: "11", city: "STOCKHOLM", smsalertnumber: "+46701234567"},
+			patron{country: "se", zipcode: "11", city: "STOCKHOLM", smsalertnumber: "+46701234567"},
+		},
+	}
+
+	var report bytes.Buffer
+	n := newNormaliser(postcodes, "47", &report)
+	for _, test := range tests {
+		got := test.in
+		n.normalise(&got)
+		if got != test.want {
+			t.Errorf("normalise(%+v) =>\n%+v; want:\n%+v", test.in, got, test.want)
+		}
+	}
+	if err := n.Flush(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	for _, problem := range []string{"missing leading zero", "city does not match postcode", "unknown postcode", "invalid email address", "invalid email domain", "not a Norwegian mobile number"} {
+		if !strings.Contains(report.String(), problem) {
+			t.Errorf("report missing problem %q:\n%s", problem, report.String())
+		}
+	}
+}
+
+func TestSplitZipCity(t *testing.T) {
+	tests := []struct {
+		in, zip, city string
+	}{
+		{"0475 OSLO", "0475", "OSLO"},
+		{"N-0475 OSLO", "0475", "OSLO"},
+		{"NORDSTRAND", "", "NORDSTRAND"},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		zip, city := splitZipCity(test.in)
+		if zip != test.zip || city != test.city {
+			t.Errorf("splitZipCity(%q) => %q, %q; want %q, %q", test.in, zip, city, test.zip, test.city)
+		}
+	}
+}
@@ -6,17 +6,51 @@
 //   lnel: database export from Bibliofil
 //
 // output:
-//   patrons.csv:      patrons to be imported into Koha MySQL borrowers table
+//   patrons.csv:      patrons to be imported into Koha MySQL borrowers table, with a header row
+//                     naming the borrowers columns (selectable by Koha version or explicit list)
 //   categories.sql    patron categories to be inserted into MySQL
 //   branches.sql      branches to be inserted into MySQL
-//   ext.sql           extended patron attributes (fnr, dooraccess) to be inserted into MySQL
-//   msgprefs.sql      message preferenses to be inserted into MySQL
+//   ext.sql           extended patron attributes to be inserted into MySQL, mapped from
+//                     patron source fields by configuration (-attributes; default fnr and
+//                     dooraccess); fnr is validated, and optionally hashed or encrypted (-fnrmode)
+//   borrower_attribute_types.sql
+//                     extended patron attribute types to be inserted into MySQL
+//   msgprefs.sql      message preferenses to be inserted into MySQL, mapped from Bibliofil
+//                     notifications by a configurable matrix (-msgprefs)
+//   msgprefs.csv      report of message transports without mapping or contact data
+//   debarments.sql    debarments to be inserted into MySQL, mapped from Bibliofil obs flags
+//                     by a configurable table (-debarments)
+//   debarments.csv    report of unmapped obs flags, and expired debarments
 //   borrowersync.sql  rows to be innserted into borrower_sync in MySQL
+//   normalisation.csv report of normalised and rejected postcodes, phone numbers and emails
+//   fnr.csv           report of invalid fnrs, and fnrs not matching date of birth
+//   lifecycle.csv     report of patron categories derived from age, and inactive patrons
+//   rejects.csv       dump records which could not be read, with the raw record; the
+//                     run is aborted when there are more than -maxrejects
+//   duplicates.csv    report of likely duplicate patrons, with confidence scores (-duplicates)
+//   borrowermerge.csv duplicate and surviving borrower numbers of merged patrons (-mergedups),
+//                     to be given to catmassage and res2sql to re-point issues and holds
+//
+// Patron categories B (Barn) and V (Voksen) are corrected from date of birth, and
+// expiry dates are set from last loan and enrolment; patrons inactive beyond the
+// retention period can be flagged or excluded (-expiryyears, -retentionyears, -inactive).
+// Ages, expiry and inactivity are calculated relative to the export timestamp in
+// the dump filenames (or -refdate), so reruns of the same dumps give the same output.
+//
+// By default the dumps are indexed in memory. With -stream, they are sorted by
+// borrower number on disk (unless -sorted) and joined in one pass, so memory
+// use stays bounded regardless of patron count; the outputs are the same.
+// Duplicate detection (-duplicates) and the PIN cache still keep a small
+// record per patron.
+//
+// PINs are hashed in a separate stage with its own pool of workers
+// (see -pinalgo, -pincost, -pinworkers, -pindryrun, -pincache and
+// -pincachekey).
 
 package main
 
 import (
-	"encoding/csv"
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
@@ -25,126 +59,78 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"strconv"
+	"runtime"
 	"strings"
 	"sync"
 	"text/template"
 
-	"github.com/boutros/marc"
+	"github.com/digibib/migtools/patrondump"
 )
 
-var outDir *string
-
 type Main struct {
-	laanerIn, lmarcIn, lnelIn io.Reader
-	laaner, lnel              map[int]map[string]string
-	lmarc                     map[int]*marc.Record
-	numWorkers                int
-	branches                  map[string]string
+	src        patrondump.Source
+	outDir     string
+	numWorkers int
+	branches   map[string]string
+	patronCols []string
+	pins       *pinHasher
+	norm       *normaliser // optional; nil if no normalisation is done
+	fnr        *fnrHandler
+	dups       *dupDetector      // optional; nil if no duplicate detection is done
+	merged     map[string]string // duplicate borrower nr -> surviving borrower nr
+	lifecycle  *lifecyclePolicy
+	msgPrefs   *msgPrefs
+	attrs      *attributes
+	debarments *debarments
+	rejects    *patrondump.Rejects
 }
 
-func newMain(laaner, lmarc, lnel io.Reader, nw int) *Main {
+func newMain(src patrondump.Source, nw int, patronCols []string, pins *pinHasher) *Main {
 	return &Main{
-		laanerIn:   laaner,
-		lmarcIn:    lmarc,
-		lnelIn:     lnel,
-		laaner:     make(map[int]map[string]string),
-		lnel:       make(map[int]map[string]string),
-		lmarc:      make(map[int]*marc.Record),
+		src:        src,
 		numWorkers: nw,
 		branches:   make(map[string]string),
+		patronCols: patronCols,
+		pins:       pins,
 	}
 }
 
-func (m *Main) indexLmarc(wg *sync.WaitGroup) {
-	dec := marc.NewDecoder(m.lmarcIn, marc.LineMARC)
-	for rec, err := dec.Decode(); err != io.EOF; rec, err = dec.Decode() {
-		if err != nil {
-			log.Fatal(err)
-			// TODO continue?
-		}
-		n, err := borrowernumber(rec)
-		if err != nil {
-			log.Println(err)
-			rec.DumpTo(os.Stderr, true)
-			continue
-		}
-		m.lmarc[n] = rec
-	}
-	wg.Done()
-	log.Println("done indexing lmarc")
-}
-
-func (m *Main) indexLaaner(wg *sync.WaitGroup) {
-	dec := NewKVDecoder(m.laanerIn)
-	for rec, err := dec.Decode(); err != io.EOF; rec, err = dec.Decode() {
-		if err != nil {
-			log.Fatal(err)
-			// TODO continue?
-		}
-		if rec["ln_nr"] == "" {
-			continue
-		}
-		n, err := strconv.Atoi(rec["ln_nr"])
-		if err != nil {
-			log.Fatal(err)
-		}
-		m.laaner[n] = rec
-	}
-	log.Println("done indexing laaner")
-	wg.Done()
-}
-
-func (m *Main) indexLnel(wg *sync.WaitGroup) {
-	dec := NewKVDecoder(m.lnelIn)
-	for rec, err := dec.Decode(); err != io.EOF; rec, err = dec.Decode() {
-		if err != nil {
-			log.Fatal(err)
-			// TODO continue?
-		}
-		if rec["lnel_nr"] == "" {
-			continue
-		}
-		n, err := strconv.Atoi(rec["lnel_nr"])
-		if err != nil {
-			log.Fatal(err)
-		}
-		m.lnel[n] = rec
-	}
-	log.Println("done indexing lnel")
-	wg.Done()
-}
-
 func (m *Main) Run() {
-	log.Println("start indexing resources")
+	if m.dups != nil {
+		m.findDuplicates()
+	}
 
 	var wg sync.WaitGroup
-	wg.Add(3)
-	go m.indexLmarc(&wg)
-	go m.indexLaaner(&wg)
-	go m.indexLnel(&wg)
-	wg.Wait()
-
-	log.Println("done indexing resources")
-
-	jobs := make(chan int)
+	jobs := make(chan *patrondump.Sources)
+	unhashed := make(chan patron)
 	patrons := make(chan patron)
-	patronsF := mustCreate(filepath.Join(*outDir, "patrons.csv"))
+	m.pins.run(unhashed, patrons)
+	patronsF := mustCreate(filepath.Join(m.outDir, "patrons.csv"))
 	defer patronsF.Close()
-	enc := csv.NewWriter(patronsF)
-	defer enc.Flush()
-	outExt := mustCreate(filepath.Join(*outDir, "ext.sql"))
-	fnrTempl := template.Must(template.New("fnr").Parse(fnrTemplSQL))
-	doorTempl := template.Must(template.New("fnr").Parse(meråpentTemplSQL))
+	enc := newPatronCSVWriter(patronsF, m.patronCols)
+	defer func() {
+		if err := enc.Flush(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	outExt := mustCreate(filepath.Join(m.outDir, "ext.sql"))
 	defer outExt.Close()
-	outMsgPrefs := mustCreate(filepath.Join(*outDir, "msgprefs.sql"))
+	outAttrTypes := mustCreate(filepath.Join(m.outDir, "borrower_attribute_types.sql"))
+	defer outAttrTypes.Close()
+	if err := m.attrs.WriteTypes(outAttrTypes); err != nil {
+		log.Fatal(err)
+	}
+	outMsgPrefs := mustCreate(filepath.Join(m.outDir, "msgprefs.sql"))
 	defer outMsgPrefs.Close()
-	if _, err := outMsgPrefs.WriteString(msgPrefsInit); err != nil {
+	if err := m.msgPrefs.WriteInit(outMsgPrefs); err != nil {
 		log.Fatal(err)
 	}
 
+	outDebarments := mustCreate(filepath.Join(m.outDir, "debarments.sql"))
+	defer outDebarments.Close()
+
 	bsyncTempl := template.Must(template.New("bsync").Parse(borrwersyncTemplSQL))
-	outBranchSync := mustCreate(filepath.Join(*outDir, "borrowersync.sql"))
+	outBranchSync := mustCreate(filepath.Join(m.outDir, "borrowersync.sql"))
 	defer outBranchSync.Close()
 
 	missingBranches := make(map[string]int)
@@ -158,28 +144,21 @@ func (m *Main) Run() {
 				p.branchcode = "ukjent"
 			}
 
-			catCode, ok := categoryCodes[p.categorycode]
-			if ok {
-				p.categorycode = catCode
-			} else {
-				log.Printf("missing mapping for patron category: %q; fallback to \"V\"", p.categorycode)
-				p.categorycode = "V"
+			if err := m.debarments.Write(outDebarments, &p); err != nil {
+				log.Fatal(err)
 			}
 
-			if err := enc.Write(patronCSVRow(p)); err != nil {
+			if err := enc.Write(p); err != nil {
 				log.Fatal(err)
 			}
 
-			if p.TEMP_personnr != "" {
-				if err := fnrTempl.Execute(outExt, struct {
-					Fnr                 string
-					BibliofilBorrowerNr string
-				}{
-					BibliofilBorrowerNr: p.userid,
-					Fnr:                 p.TEMP_personnr,
-				}); err != nil {
-					log.Fatal(err)
-				}
+			if err := m.attrs.Write(outExt, attrSources{
+				laaner: p.TEMP_src.Laaner,
+				lnel:   p.TEMP_src.Lnel,
+				lmarc:  p.TEMP_src.Lmarc,
+				patron: p,
+			}); err != nil {
+				log.Fatal(err)
 			}
 
 			if p.TEMP_pinhashed != "" {
@@ -196,86 +175,8 @@ func (m *Main) Run() {
 				}
 			}
 
-			if p.TEMP_meråpent_tilgang {
-				if err := doorTempl.Execute(outExt, struct {
-					Code                string
-					BibliofilBorrowerNr string
-				}{
-					Code:                "1",
-					BibliofilBorrowerNr: p.userid,
-				}); err != nil {
-					log.Fatal(err)
-				}
-			}
-			if p.TEMP_meråpent_sperret {
-				if err := doorTempl.Execute(outExt, struct {
-					Code                string
-					BibliofilBorrowerNr string
-				}{
-					Code:                "B",
-					BibliofilBorrowerNr: p.userid,
-				}); err != nil {
-					log.Fatal(err)
-				}
-			}
-
-			/*
-				TEMP_sistelaan         string
-				TEMP_personnr          string
-				TEMP_nl                bool
-				TEMP_hjemmebibnr       string
-				TEMP_res_transport     string
-				TEMP_pur_transport     string
-				TEMP_fvarsel_transport string
-			*/
-			var msgTmpl, transport string
-			msgTmpl = msgHold
-			switch p.TEMP_res_transport {
-			case "epost":
-				transport = "email"
-			case "post":
-				transport = "print"
-			case "sms":
-				transport = "sms"
-			default:
-				msgTmpl = ""
-			}
-			if msgTmpl != "" {
-				if _, err := outMsgPrefs.WriteString(fmt.Sprintf(msgTmpl, transport, p.userid)); err != nil {
-					log.Fatal(err)
-				}
-			}
-
-			msgTmpl = msgDue
-			switch p.TEMP_pur_transport {
-			case "epost":
-				transport = "email"
-			case "post":
-				transport = "print"
-			case "sms":
-				transport = "sms"
-			default:
-				msgTmpl = ""
-			}
-			if msgTmpl != "" {
-				if _, err := outMsgPrefs.WriteString(fmt.Sprintf(msgTmpl, transport, p.userid)); err != nil {
-					log.Fatal(err)
-				}
-			}
-
-			msgTmpl = msgNotice
-			switch p.TEMP_fvarsel_transport {
-			case "epost":
-				transport = "email"
-			case "sms":
-				transport = "sms"
-			default:
-				msgTmpl = ""
-			}
-			if msgTmpl != "" {
-				if _, err := outMsgPrefs.WriteString(fmt.Sprintf(msgTmpl, transport, p.userid)); err != nil {
-					log.Fatal(err)
-				}
+			if err := m.msgPrefs.Write(outMsgPrefs, p); err != nil {
+				log.Fatal(err)
 			}
 
 			wg.Done()
@@ -284,27 +185,67 @@ func (m *Main) Run() {
 	wg.Add(m.numWorkers)
 	for i := 0; i < m.numWorkers; i++ {
 		go func() {
-			for lnr := range jobs {
-				p := merge(m.lmarc[lnr], m.laaner[lnr], m.lnel[lnr])
+			for src := range jobs {
+				p := merge(src.Lmarc, src.Laaner, src.Lnel)
+				p.TEMP_src = src
 
+				if _, ok := m.merged[p.userid]; ok {
+					// duplicate merged into another patron
+					continue
+				}
 				if !strings.HasPrefix(p.surname, "!!") {
 					// deleted patrons are prefixed with !!
-					wg.Add(1)
 					if p.cardnumber == "" {
 						p.cardnumber = p.userid
 					}
-					patrons <- p
+					p.categorycode = kohaCategory(p.categorycode)
+					if m.norm != nil {
+						m.norm.normalise(&p)
+					}
+					m.fnr.check(&p)
+					if m.lifecycle.apply(&p) {
+						// excluded by retention policy
+						continue
+					}
+					wg.Add(1)
+					unhashed <- p
 				}
 			}
 			wg.Done()
 		}()
 	}
-	for lnr, _ := range m.laaner {
-		jobs <- lnr
+	if err := m.src.Each(func(src *patrondump.Sources) { jobs <- src }); err != nil {
+		log.Fatal(err)
 	}
 	close(jobs)
 	wg.Wait()
+	close(unhashed)
 	close(patrons)
+	log.Printf("done hashing PINs: %s", m.pins.stats())
+
+	if m.norm != nil {
+		if err := m.norm.Flush(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := m.fnr.Flush(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+	if err := m.lifecycle.Flush(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+	if err := m.msgPrefs.Flush(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+	if err := m.attrs.Flush(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+	if err := m.debarments.Flush(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+	if err := m.rejects.Flush(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
 
 	fmt.Println("Unmapped branch counts:")
 	for branch, count := range missingBranches {
@@ -312,47 +253,312 @@ func (m *Main) Run() {
 	}
 }
 
+// kohaCategory maps a Bibliofil patron category to a Koha category.
+func kohaCategory(code string) string {
+	catCode, ok := categoryCodes[code]
+	if !ok {
+		log.Printf("missing mapping for patron category: %q; fallback to \"V\"", code)
+		return "V"
+	}
+	return catCode
+}
+
+// findDuplicates detects likely duplicate patrons, writing them to duplicates.csv.
+// If merging is enabled, the duplicates to be merged into a surviving
+// patron are written to borrowermerge.csv, for use by catmassage and res2sql.
+func (m *Main) findDuplicates() {
+	err := m.src.Each(func(src *patrondump.Sources) {
+		p := merge(src.Lmarc, src.Laaner, src.Lnel)
+		if strings.HasPrefix(p.surname, "!!") {
+			return
+		}
+		if p.cardnumber == "" {
+			p.cardnumber = p.userid
+		}
+		m.dups.add(p)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	matches := m.dups.detect()
+	m.merged = m.dups.survivors(matches)
+
+	dupF := mustCreate(filepath.Join(m.outDir, "duplicates.csv"))
+	defer dupF.Close()
+	if err := writeDupReport(dupF, matches, m.merged); err != nil {
+		log.Fatal(err)
+	}
+	if m.dups.mergeThreshold > 0 {
+		mapF := mustCreate(filepath.Join(m.outDir, "borrowermerge.csv"))
+		defer mapF.Close()
+		if err := writeBorrowerMap(mapF, m.merged); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if m.dups.skipped > 0 {
+		log.Printf("skipped %d duplicate detection blocks of more than %d patrons", m.dups.skipped, maxDupBlock)
+	}
+	log.Printf("found %d likely duplicate patron pairs; merging %d patrons", len(matches), len(m.merged))
+}
+
+// config is the configuration of a run, as given by the command line flags.
+type config struct {
+	laaner     string
+	lmarc      string
+	lnel       string
+	numWorkers int
+	kohaVer    string
+	columns    string
+	pinAlgo    string
+	pinCost    int
+	pinWorkers int
+	pinDryRun  bool
+	pinCache   string
+	pinKey     string
+	normalise  bool
+	postnr     string
+	countryTel string
+	fnrMode    string
+	fnrKey     string
+	fnrInvalid bool
+	findDups   bool
+	dupScore   float64
+	mergeDups  bool
+	mergeScore float64
+	expiry     int
+	retention  int
+	inactive   string
+	attrConf   string
+	msgConf    string
+	debarConf  string
+	stream     bool
+	sorted     bool
+	sortChunk  int
+	tmpDir     string
+	maxRejects int
+	refDate    string
+	outDir     string
+}
+
 func main() {
-	var (
-		laaner     = flag.String("laaner", "/home/boutros/src/github.com/digibib/ls.ext/migration/example_data/data.laaner.20141020-085311.txt", "laaner dump")
-		lmarc      = flag.String("lmarc", "/home/boutros/src/github.com/digibib/ls.ext/migration/example_data/data.lmarc.20141020-085326.txt", "lmarc dump")
-		lnel       = flag.String("lnel", "/home/boutros/src/github.com/digibib/ls.ext/migration/example_data/data.lnel.20141020-085323.txt", "lnel dump")
-		numWorkers = flag.Int("n", 8, "number of concurrent workers")
-	)
-	outDir = flag.String("outdir", "", "output directory (default to current working directory)")
+	var cfg config
+	flag.StringVar(&cfg.laaner, "laaner", "", "laaner dump")
+	flag.StringVar(&cfg.lmarc, "lmarc", "", "lmarc dump")
+	flag.StringVar(&cfg.lnel, "lnel", "", "lnel dump")
+	flag.IntVar(&cfg.numWorkers, "n", 8, "number of concurrent workers")
+	flag.StringVar(&cfg.kohaVer, "koha", defaultKohaVersion, "Koha version whose borrowers import columns are written to patrons.csv")
+	flag.StringVar(&cfg.columns, "columns", "", "comma-separated list of borrowers columns to write to patrons.csv (overrides -koha)")
+	flag.StringVar(&cfg.pinAlgo, "pinalgo", pinAlgoBcrypt, "PIN hashing: \"bcrypt\" or \"carry\" (carry over hash from 261$z if it is the MD5 of the PIN, fallback to bcrypt)")
+	flag.IntVar(&cfg.pinCost, "pincost", 8, "bcrypt cost")
+	flag.IntVar(&cfg.pinWorkers, "pinworkers", runtime.NumCPU(), "number of concurrent PIN hashing workers")
+	flag.BoolVar(&cfg.pinDryRun, "pindryrun", false, "skip PIN hashing, leaving passwords empty (for rehearsals)")
+	flag.StringVar(&cfg.pinCache, "pincache", "", "file to cache hashed PINs in across reruns (disabled if empty)")
+	flag.StringVar(&cfg.pinKey, "pincachekey", "", "file containing secret key for -pincache, kept apart from the cache")
+	flag.BoolVar(&cfg.normalise, "normalise", true, "normalise postcodes, phone numbers and emails, reporting invalid values to normalisation.csv")
+	flag.StringVar(&cfg.postnr, "postnr", "", "Posten's postcode register (tab-separated, UTF-8) to validate postcodes against (default: bundled register in postcodes.go, empty until generated)")
+	flag.StringVar(&cfg.countryTel, "countrycode", "47", "default country calling code for phone numbers")
+	flag.StringVar(&cfg.fnrMode, "fnrmode", fnrModeClear, "how to write the fnr attribute: \"clear\", \"hash\" (HMAC-SHA256) or \"encrypt\" (AES-GCM)")
+	flag.StringVar(&cfg.fnrKey, "fnrkey", "", "file containing key for -fnrmode hash or encrypt")
+	flag.BoolVar(&cfg.fnrInvalid, "keepinvalidfnr", false, "migrate fnrs failing validation")
+	flag.BoolVar(&cfg.findDups, "duplicates", false, "detect likely duplicate patrons, reporting them to duplicates.csv (implied by -mergedups)")
+	flag.Float64Var(&cfg.dupScore, "dupthreshold", 0.75, "minimum score (0-1) of patrons reported as duplicates")
+	flag.BoolVar(&cfg.mergeDups, "mergedups", false, "merge duplicates scoring at least -mergethreshold into one patron")
+	flag.Float64Var(&cfg.mergeScore, "mergethreshold", 0.95, "minimum score (0-1) of duplicates to be merged")
+	flag.IntVar(&cfg.expiry, "expiryyears", 0, "set expiry date to this many years after last loan or enrolment (0 = expire 2099-01-01)")
+	flag.IntVar(&cfg.retention, "retentionyears", 0, "patrons without loans or enrolment this many years are inactive (0 = no retention policy)")
+	flag.StringVar(&cfg.inactive, "inactive", inactiveFlag, "action on inactive patrons: \"keep\", \"flag\" (sort1=inaktiv) or \"exclude\"")
+	flag.StringVar(&cfg.attrConf, "attributes", "", "extended patron attributes configuration (default: built-in mapping, see defaultAttributesConfig)")
+	flag.StringVar(&cfg.msgConf, "msgprefs", "", "message preferences configuration (default: built-in mapping, see defaultMsgPrefsConfig)")
+	flag.StringVar(&cfg.debarConf, "debarments", "", "obs flag to debarment mapping (default: built-in mapping, see defaultDebarmentsConfig)")
+	flag.BoolVar(&cfg.stream, "stream", false, "join dumps sorted by borrower number on disk instead of indexing them in memory")
+	flag.BoolVar(&cfg.sorted, "sorted", false, "dumps are already sorted by borrower number (with -stream; skips sorting)")
+	flag.IntVar(&cfg.sortChunk, "sortchunk", 100000, "records held in memory when sorting dumps (with -stream)")
+	flag.StringVar(&cfg.tmpDir, "tmpdir", "", "directory for sorted dumps (with -stream; default system temp directory)")
+	flag.IntVar(&cfg.maxRejects, "maxrejects", 1000, "abort when more dump records than this cannot be read (-1 = no limit)")
+	flag.StringVar(&cfg.refDate, "refdate", "", "date activity, age and expiry are calculated relative to, YYYY-MM-DD (default: export timestamp in dump filenames)")
+	flag.StringVar(&cfg.outDir, "outdir", "", "output directory (default to current working directory)")
 
 	flag.Parse()
 
-	if *laaner == "" || *lmarc == "" || *lnel == "" {
+	if cfg.laaner == "" || cfg.lmarc == "" || cfg.lnel == "" || cfg.sortChunk < 1 {
 		flag.Usage()
 		os.Exit(1)
 	}
+	if err := run(cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run migrates the patrons of the dumps as configured, writing the outputs
+// to cfg.outDir and summaries to stdout.
+func run(cfg config) error {
+	now, err := referenceDate(cfg.refDate, cfg.laaner, cfg.lmarc, cfg.lnel)
+	if err != nil {
+		return err
+	}
+
+	patronCols, err := patronColumns(cfg.kohaVer, cfg.columns)
+	if err != nil {
+		return err
+	}
+
+	pins, err := newPinHasher(cfg.pinAlgo, cfg.pinCost, cfg.pinWorkers, cfg.pinDryRun)
+	if err != nil {
+		return err
+	}
+	if cfg.pinCache != "" {
+		if cfg.pinKey == "" {
+			return errors.New("-pincache requires -pincachekey")
+		}
+		if pins.cacheKey, err = ioutil.ReadFile(cfg.pinKey); err != nil {
+			return err
+		}
+		if len(pins.cacheKey) == 0 {
+			return errors.New("empty -pincachekey")
+		}
+		if f, err := os.Open(cfg.pinCache); err == nil {
+			if err := pins.loadCache(f); err != nil {
+				return err
+			}
+			f.Close()
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
 
-	laanerF := mustOpen(*laaner)
-	defer laanerF.Close()
-	lmarcF := mustOpen(*lmarc)
-	defer lmarcF.Close()
-	lnelF := mustOpen(*lnel)
-	defer lnelF.Close()
+	rejectsF := mustCreate(filepath.Join(cfg.outDir, "rejects.csv"))
+	defer rejectsF.Close()
+	rej := patrondump.NewRejects(rejectsF, cfg.maxRejects)
+
+	var src patrondump.Source
+	if cfg.stream {
+		s, err := patrondump.NewStreamSource(cfg.laaner, cfg.lmarc, cfg.lnel, cfg.sorted, cfg.tmpDir, cfg.sortChunk, rej)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		src = s
+	} else {
+		laanerF := mustOpen(cfg.laaner)
+		lmarcF := mustOpen(cfg.lmarc)
+		lnelF := mustOpen(cfg.lnel)
+		mem, err := patrondump.NewMemSource(laanerF, lmarcF, lnelF, rej)
+		if err != nil {
+			return err
+		}
+		src = mem
+		laanerF.Close()
+		lmarcF.Close()
+		lnelF.Close()
+	}
 
-	m := newMain(laanerF, lmarcF, lnelF, *numWorkers)
+	var key []byte
+	if cfg.fnrKey != "" {
+		key, err = ioutil.ReadFile(cfg.fnrKey)
+		if err != nil {
+			return err
+		}
+		key = bytes.TrimSpace(key)
+	}
+	fnrF := mustCreate(filepath.Join(cfg.outDir, "fnr.csv"))
+	defer fnrF.Close()
+	fnr, err := newFnrHandler(cfg.fnrMode, key, cfg.fnrInvalid, fnrF)
+	if err != nil {
+		return err
+	}
+
+	m := newMain(src, cfg.numWorkers, patronCols, pins)
+	m.outDir = cfg.outDir
+	m.rejects = rej
+	m.fnr = fnr
+	lifecycleF := mustCreate(filepath.Join(cfg.outDir, "lifecycle.csv"))
+	defer lifecycleF.Close()
+	m.lifecycle, err = newLifecyclePolicy(now, cfg.expiry, cfg.retention, cfg.inactive, lifecycleF)
+	if err != nil {
+		return err
+	}
+	var attrConfig io.Reader = strings.NewReader(defaultAttributesConfig)
+	if cfg.attrConf != "" {
+		attrConfF := mustOpen(cfg.attrConf)
+		defer attrConfF.Close()
+		attrConfig = attrConfF
+	}
+	m.attrs, err = newAttributes(attrConfig, fnr)
+	if err != nil {
+		return err
+	}
+
+	var msgConfig io.Reader = strings.NewReader(defaultMsgPrefsConfig)
+	if cfg.msgConf != "" {
+		msgConfF := mustOpen(cfg.msgConf)
+		defer msgConfF.Close()
+		msgConfig = msgConfF
+	}
+	msgReportF := mustCreate(filepath.Join(cfg.outDir, "msgprefs.csv"))
+	defer msgReportF.Close()
+	m.msgPrefs, err = newMsgPrefs(msgConfig, msgReportF)
+	if err != nil {
+		return err
+	}
+
+	var debarConfig io.Reader = strings.NewReader(defaultDebarmentsConfig)
+	if cfg.debarConf != "" {
+		debarConfF := mustOpen(cfg.debarConf)
+		defer debarConfF.Close()
+		debarConfig = debarConfF
+	}
+	debarReportF := mustCreate(filepath.Join(cfg.outDir, "debarments.csv"))
+	defer debarReportF.Close()
+	m.debarments, err = newDebarments(debarConfig, now, debarReportF)
+	if err != nil {
+		return err
+	}
+	if cfg.findDups || cfg.mergeDups {
+		mergeAt := 0.0
+		if cfg.mergeDups {
+			mergeAt = cfg.mergeScore
+		}
+		m.dups = newDupDetector(cfg.dupScore, mergeAt)
+	}
+	if cfg.normalise {
+		postcodes := bundledPostcodes
+		if cfg.postnr != "" {
+			postnrF := mustOpen(cfg.postnr)
+			postcodes, err = loadPostcodes(postnrF)
+			if err != nil {
+				return err
+			}
+			postnrF.Close()
+		} else if len(postcodes) == 0 {
+			log.Println("no postcode register bundled (see gen_postcodes.go) and no -postnr; only Oslo postcodes are validated")
+		}
+		normF := mustCreate(filepath.Join(cfg.outDir, "normalisation.csv"))
+		defer normF.Close()
+		m.norm = newNormaliser(postcodes, cfg.countryTel, normF)
+	}
 	m.Run()
 
+	if cfg.pinCache != "" && !cfg.pinDryRun {
+		cacheF := mustCreate(cfg.pinCache)
+		if err := pins.saveCache(cacheF); err != nil {
+			return err
+		}
+		cacheF.Close()
+	}
+
 	fns := template.FuncMap{
 		"plus1": func(x int) int {
 			return x + 1
 		},
 	}
 	templ := template.Must(template.New("branches").Funcs(fns).Parse(branchesSQLtmpl))
-	branchF := mustCreate(filepath.Join(*outDir, "homebranches.sql"))
+	branchF := mustCreate(filepath.Join(cfg.outDir, "homebranches.sql"))
 	defer branchF.Close()
 	if err := templ.Execute(branchF, branchesToSlice(m.branches)); err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	if err := ioutil.WriteFile(filepath.Join(*outDir, "categories.sql"), []byte(categoriesSQL), os.ModePerm); err != nil {
-		log.Fatal(err)
-	}
+	return ioutil.WriteFile(filepath.Join(cfg.outDir, "categories.sql"), []byte(categoriesSQL), os.ModePerm)
 }
 
 func mustOpen(s string) *os.File {
@@ -371,15 +577,6 @@ func mustCreate(s string) *os.File {
 	return f
 }
 
-func borrowernumber(r *marc.Record) (int, error) {
-	for _, cf := range r.CtrlFields {
-		if cf.Tag == "001" {
-			return strconv.Atoi(cf.Value)
-		}
-	}
-	return 0, errors.New("no borrowernumber in lmarc record")
-}
-
 type Branch struct {
 	Code, Label string
 }
@@ -397,30 +594,6 @@ func branchesToSlice(branches map[string]string) []Branch {
 	return res
 }
 
-func patronCSVRow(p patron) []string {
-	row := make([]string, 19)
-	row[0] = p.userid // bibliofil lånernr
-	row[1] = p.cardnumber
-	row[2] = p.surname
-	row[3] = p.firstname
-	row[4] = p.address
-	row[5] = p.address2
-	row[6] = p.zipcode
-	row[7] = p.city
-	row[8] = p.country
-	row[9] = p.phone
-	row[10] = p.smsalertnumber
-	row[11] = p.email
-	row[12] = p.categorycode
-	row[13] = strconv.Itoa(p.privacy)
-	row[14] = p.branchcode
-	row[15] = p.sex
-	row[16] = p.password
-	row[17] = p.dateofbirth
-	row[18] = p.altcontactsurname
-	return row
-}
-
 func init() {
 	log.SetFlags(0)
 	log.SetPrefix("patronmassage: ")
@@ -2,10 +2,13 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/boutros/marc"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -94,6 +97,7 @@ func TestPatronMerge(t *testing.T) {
 		categorycode:           "v", // mapped to "V" in Main.Run()
 		altcontactsurname:      "Furukneika 2",
 		TEMP_personnr:          "02031145555",
+		TEMP_pin:               "1234",
 		TEMP_pinhashed:         "9a925d1cebb962b1629f75f2540bbde0",
 		TEMP_nl:                true,
 		TEMP_nl_lastsync:       "2015-06-30T13:24:45",
@@ -108,12 +112,81 @@ func TestPatronMerge(t *testing.T) {
 	lnelRec := mustParseKeyVal(lnelDump)
 
 	got := merge(lmarcRec, laanerRec, lnelRec)
-	got.password = "" // bcrypt hash is different each time, so don't use in comparing
 	if got != want {
 		t.Errorf("got:\n%+v; want:\n%+v", got, want)
 	}
 }
 
+func TestPatronCSVWriter(t *testing.T) {
+	cols, err := patronColumns("16.05", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []string{"dateenrolled", "dateexpiry", "gonenoaddress", "lost", "borrowernotes"} {
+		found := false
+		for _, col := range cols {
+			if col == c {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("column %q missing from Koha 16.05 column set", c)
+		}
+	}
+
+	for version, want := range map[string][]string{
+		"3.22":  {"privacy"},
+		"16.05": {"privacy", "privacy_guarantor_checkouts"},
+		"16.11": {"privacy", "privacy_guarantor_checkouts", "checkprevcheckout"},
+	} {
+		cols, err := patronColumns(version, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		w := newPatronCSVWriter(&b, cols[len(cols)-len(want):])
+		if err := w.Write(patron{privacy: 1}); err != nil {
+			t.Fatal(err)
+		}
+		w.Flush()
+		row := map[string]string{"3.22": "1", "16.05": "1,0", "16.11": "1,0,inherit"}[version]
+		if got := b.String(); got != strings.Join(want, ",")+"\n"+row+"\n" {
+			t.Errorf("Koha %s: got last columns:\n%s", version, got)
+		}
+	}
+
+	if _, err := patronColumns("1.0", ""); err == nil {
+		t.Error("patronColumns with unknown Koha version: want error, got nil")
+	}
+	if _, err := patronColumns("", "cardnumber,nosuchcolumn"); err == nil {
+		t.Error("patronColumns with unknown column: want error, got nil")
+	}
+
+	cols, err = patronColumns("", "userid, surname,lost,dateexpiry,borrowernotes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	w := newPatronCSVWriter(&b, cols)
+	p := patron{
+		userid:        "808708",
+		surname:       "Testesen",
+		lost:          true,
+		dateexpiry:    "2099-01-01",
+		borrowernotes: "Har flyttet, ny adresse?",
+	}
+	if err := w.Write(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := "userid,surname,lost,dateexpiry,borrowernotes\n808708,Testesen,1,2099-01-01,\"Har flyttet, ny adresse?\"\n"
+	if got := b.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
 func mustParseKeyVal(s string) map[string]string {
 	dec := NewKVDecoder(bytes.NewBufferString(s))
 	rec, err := dec.Decode()
@@ -134,3 +207,93 @@ func mustParseLmarc(s string) *marc.Record {
 	}
 	return recs[0]
 }
+
+func TestPinHasher(t *testing.T) {
+	h, err := newPinHasher(pinAlgoBcrypt, bcrypt.MinCost, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.cacheKey = []byte("secret")
+	p := patron{userid: "808708", TEMP_pin: "1234"}
+	if err := h.hash(&p); err != nil {
+		t.Fatal(err)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(p.password), []byte("1234")); err != nil {
+		t.Fatalf("password is not a bcrypt hash of PIN: %v", err)
+	}
+
+	// rerun with cache from previous run
+	var cache bytes.Buffer
+	if err := h.saveCache(&cache); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(cache.Bytes(), []byte(fmt.Sprintf("%x", sha256.Sum256([]byte("bcrypt|4|1234"))))) {
+		t.Error("cache holds an unkeyed digest of the PIN")
+	}
+	h2, _ := newPinHasher(pinAlgoBcrypt, bcrypt.MinCost, 1, false)
+	h2.cacheKey = []byte("secret")
+	if err := h2.loadCache(&cache); err != nil {
+		t.Fatal(err)
+	}
+	p2 := patron{userid: "808708", TEMP_pin: "1234"}
+	if err := h2.hash(&p2); err != nil {
+		t.Fatal(err)
+	}
+	if p2.password != p.password || h2.cached != 1 {
+		t.Errorf("expected cached hash %q to be reused; got %q", p.password, p2.password)
+	}
+
+	// changed PIN invalidates cache
+	p3 := patron{userid: "808708", TEMP_pin: "4321"}
+	if err := h2.hash(&p3); err != nil {
+		t.Fatal(err)
+	}
+	if p3.password == p.password {
+		t.Error("cached hash reused for changed PIN")
+	}
+
+	// a cache with another key is not used
+	h3, _ := newPinHasher(pinAlgoBcrypt, bcrypt.MinCost, 1, false)
+	h3.cacheKey = []byte("other")
+	h3.cache = h2.cache
+	p4 := patron{userid: "808708", TEMP_pin: "4321"}
+	if err := h3.hash(&p4); err != nil {
+		t.Fatal(err)
+	}
+	if h3.cached != 0 {
+		t.Error("cached hash reused with another key")
+	}
+
+	// carry over existing hash if it is the MD5 of the PIN
+	hc, _ := newPinHasher(pinAlgoCarry, bcrypt.MinCost, 1, false)
+	pc := patron{userid: "1", TEMP_pin: "1234", TEMP_pinhashed: "81dc9bdb52d04dc20036dbd8313ed055"}
+	if err := hc.hash(&pc); err != nil {
+		t.Fatal(err)
+	}
+	if want := "gdyb21LQTcIANtvYMT7QVQ"; pc.password != want {
+		t.Errorf("carried over hash: got %q; want %q", pc.password, want)
+	}
+
+	// 261$z of the fixture patron is not the MD5 of its PIN: fall back to bcrypt
+	pf := merge(mustParseLmarc(lmarcDump), mustParseKeyVal(laanerDump), mustParseKeyVal(lnelDump))
+	if err := hc.hash(&pf); err != nil {
+		t.Fatal(err)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(pf.password), []byte(pf.TEMP_pin)); err != nil || hc.carried != 1 {
+		t.Errorf("unverified 261$z carried over: got password %q", pf.password)
+	}
+
+	// dry-run
+	hd, _ := newPinHasher(pinAlgoBcrypt, bcrypt.MinCost, 1, true)
+	pd := patron{userid: "1", TEMP_pin: "1234"}
+	if err := hd.hash(&pd); err != nil {
+		t.Fatal(err)
+	}
+	if pd.password != "" {
+		t.Errorf("dry-run: got password %q; want none", pd.password)
+	}
+
+	if _, err := newPinHasher("md5", 8, 1, false); err == nil {
+		t.Error("newPinHasher with unknown algorithm: want error, got nil")
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	pinAlgoBcrypt = "bcrypt" // hash PIN from 261$a with bcrypt
+	pinAlgoCarry  = "carry"  // carry over existing hash from 261$z if it is the MD5 of the PIN, falling back to bcrypt
+
+	// log progress every n patrons passing through the hashing stage
+	pinProgressEvery = 50000
+)
+
+// pinHasher populates the borrowers password column from patron PINs.
+// Hashing is run as a separate stage with its own pool of workers, since
+// bcrypt dominates the running time on a full patron base.
+//
+// Hashes can be cached by Bibliofil borrower number, so that reruns only
+// hash PINs that have changed. Cached hashes are identified by an HMAC of
+// the PIN with a secret key, since a plain digest of a 4-digit PIN is
+// reversed by trying all 10000. The cache file holds the hashes to be
+// migrated and must be treated as confidentially as patrons.csv; the key
+// must be kept apart from it.
+type pinHasher struct {
+	algo       string
+	cost       int
+	dryRun     bool // skip hashing entirely, leaving password empty
+	numWorkers int
+	cacheKey   []byte // HMAC key of fingerprints; caching is disabled without one
+
+	mu    sync.Mutex
+	cache map[string]pinCacheEntry // keyed by Bibliofil borrower number
+
+	seen, hashed, cached, carried uint64 // progress counters
+}
+
+type pinCacheEntry struct {
+	fingerprint string // identifies PIN, algorithm and cost the hash was made with
+	hash        string
+}
+
+func newPinHasher(algo string, cost int, nw int, dryRun bool) (*pinHasher, error) {
+	switch algo {
+	case pinAlgoBcrypt, pinAlgoCarry:
+	default:
+		return nil, fmt.Errorf("unknown PIN hashing algorithm: %q", algo)
+	}
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("bcrypt cost must be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, cost)
+	}
+	if nw < 1 {
+		nw = 1
+	}
+	return &pinHasher{
+		algo:       algo,
+		cost:       cost,
+		dryRun:     dryRun,
+		numWorkers: nw,
+		cache:      make(map[string]pinCacheEntry),
+	}, nil
+}
+
+// run starts the hashing workers, reading patrons from in and sending them
+// on to out with the password set. The workers exit when in is closed.
+func (h *pinHasher) run(in <-chan patron, out chan<- patron) {
+	for i := 0; i < h.numWorkers; i++ {
+		go func() {
+			for p := range in {
+				if err := h.hash(&p); err != nil {
+					log.Printf("failed to hash PIN of patron %s: %v", p.userid, err)
+				}
+				if n := atomic.AddUint64(&h.seen, 1); n%pinProgressEvery == 0 {
+					log.Printf("PIN hashing: %d patrons processed (%s)", n, h.stats())
+				}
+				out <- p
+			}
+		}()
+	}
+}
+
+// hash sets the patron's password, from the PIN or the existing hash.
+func (h *pinHasher) hash(p *patron) error {
+	if h.dryRun {
+		return nil
+	}
+	if p.TEMP_pin == "" {
+		return nil
+	}
+	if h.algo == pinAlgoCarry && p.TEMP_pinhashed != "" {
+		// 261$z is only carried over when it is verifiably the MD5 of the
+		// PIN, as Koha expects; otherwise the patron would be locked out.
+		// A hash which cannot be converted falls back to hashing the PIN.
+		sum := md5.Sum([]byte(p.TEMP_pin))
+		if strings.EqualFold(p.TEMP_pinhashed, hex.EncodeToString(sum[:])) {
+			if pw, ok := kohaMD5(p.TEMP_pinhashed); ok {
+				p.password = pw
+				atomic.AddUint64(&h.carried, 1)
+				return nil
+			}
+		}
+	}
+
+	var fp string
+	if len(h.cacheKey) > 0 {
+		fp = h.fingerprint(p.TEMP_pin)
+		h.mu.Lock()
+		e, ok := h.cache[p.userid]
+		h.mu.Unlock()
+		if ok && hmac.Equal([]byte(e.fingerprint), []byte(fp)) {
+			p.password = e.hash
+			atomic.AddUint64(&h.cached, 1)
+			return nil
+		}
+	}
+
+	pin, err := bcrypt.GenerateFromPassword([]byte(p.TEMP_pin), h.cost)
+	if err != nil {
+		return err
+	}
+	p.password = string(pin)
+	atomic.AddUint64(&h.hashed, 1)
+
+	if fp != "" {
+		h.mu.Lock()
+		h.cache[p.userid] = pinCacheEntry{fingerprint: fp, hash: p.password}
+		h.mu.Unlock()
+	}
+	return nil
+}
+
+// fingerprint returns a keyed digest (HMAC-SHA256) identifying the PIN
+// together with the hashing parameters, so that cached hashes are
+// invalidated when either changes.
+func (h *pinHasher) fingerprint(pin string) string {
+	mac := hmac.New(sha256.New, h.cacheKey)
+	mac.Write([]byte(h.algo + "|" + strconv.Itoa(h.cost) + "|" + pin))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (h *pinHasher) stats() string {
+	return fmt.Sprintf("%d hashed, %d from cache, %d carried over",
+		atomic.LoadUint64(&h.hashed),
+		atomic.LoadUint64(&h.cached),
+		atomic.LoadUint64(&h.carried))
+}
+
+// loadCache reads cached hashes, one tab-separated
+// borrowernumber, fingerprint and hash per line.
+func (h *pinHasher) loadCache(r io.Reader) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		h.cache[fields[0]] = pinCacheEntry{fingerprint: fields[1], hash: fields[2]}
+	}
+	return scanner.Err()
+}
+
+// saveCache writes all cached hashes, in the format read by loadCache.
+func (h *pinHasher) saveCache(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	for nr, e := range h.cache {
+		if _, err := fmt.Fprintf(bw, "%s\t%s\t%s\n", nr, e.fingerprint, e.hash); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// kohaMD5 converts a hex-encoded MD5 digest, as stored in 261$z, to the
+// unpadded base64 encoding Koha expects for legacy (non-bcrypt) passwords.
+func kohaMD5(s string) (string, bool) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 16 {
+		return "", false
+	}
+	return base64.RawStdEncoding.EncodeToString(b), true
+}
@@ -0,0 +1,12 @@
+package main
+
+// bundledPostcodes is Posten's postcode register: postcode -> city.
+//
+// It is empty: the register is not in this repository. To bundle it, download
+// Postnummerregister-ansi.txt from Posten and replace this file with
+//
+//	go run gen_postcodes.go -in Postnummerregister-ansi.txt
+//
+// Until then, postcodes are only validated against a register given by
+// -postnr; without it, only Oslo postcodes are resolved to a city.
+var bundledPostcodes = map[string]string{}
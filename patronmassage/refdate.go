@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// dumpDateFormat is the format of the export timestamp in Bibliofil dump
+// filenames, as in data.laaner.20160819-073100.txt.
+const dumpDateFormat = "20060102-150405"
+
+var dumpDateRe = regexp.MustCompile(`\.(\d{8}-\d{6})\.`)
+
+// dumpDate returns the export timestamp in the filename of a dump.
+func dumpDate(filename string) (time.Time, error) {
+	m := dumpDateRe.FindStringSubmatch(filepath.Base(filename))
+	if m == nil {
+		return time.Time{}, fmt.Errorf("no export timestamp in dump filename: %s", filename)
+	}
+	return time.Parse(dumpDateFormat, m[1])
+}
+
+// referenceDate returns the date activity, age and expiry are calculated
+// relative to: refdate if given (YYYY-MM-DD or YYYYMMDD-HHMMSS), or else the
+// export timestamp of the first of the dumps having one in its filename.
+func referenceDate(refdate string, dumps ...string) (time.Time, error) {
+	if refdate != "" {
+		if t, err := time.Parse(mysqlDateFormat, refdate); err == nil {
+			return t, nil
+		}
+		t, err := time.Parse(dumpDateFormat, refdate)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("reference date not YYYY-MM-DD or YYYYMMDD-HHMMSS: %q", refdate)
+		}
+		return t, nil
+	}
+	for _, dump := range dumps {
+		if t, err := dumpDate(dump); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no export timestamp in dump filenames; give reference date with -refdate")
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReferenceDate(t *testing.T) {
+	tests := []struct {
+		refdate string
+		dumps   []string
+		want    time.Time
+		err     bool
+	}{
+		{"", []string{"/data/data.laaner.20160819-073100.txt"}, time.Date(2016, 8, 19, 7, 31, 0, 0, time.UTC), false},
+		{"", []string{"laaner.txt", "data.lmarc.20141020-085326.txt"}, time.Date(2014, 10, 20, 8, 53, 26, 0, time.UTC), false},
+		{"2016-09-01", []string{"data.laaner.20160819-073100.txt"}, time.Date(2016, 9, 1, 0, 0, 0, 0, time.UTC), false},
+		{"20160901-120000", nil, time.Date(2016, 9, 1, 12, 0, 0, 0, time.UTC), false},
+		{"", []string{"laaner.txt", "data.lnel.2016-08-19.txt"}, time.Time{}, true},
+		{"01.09.2016", nil, time.Time{}, true},
+	}
+	for _, test := range tests {
+		got, err := referenceDate(test.refdate, test.dumps...)
+		if (err != nil) != test.err {
+			t.Errorf("referenceDate(%q, %v): got error %v", test.refdate, test.dumps, err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("referenceDate(%q, %v) = %v; want %v", test.refdate, test.dumps, got, test.want)
+		}
+	}
+}
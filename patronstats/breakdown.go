@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// addMonths adds n calendar months to t, clamping the day to the end of
+// the month, so that one month before 2016-03-31 is 2016-02-29.
+func addMonths(t time.Time, n int) time.Time {
+	y, m, d := t.Date()
+	first := time.Date(y, m+time.Month(n), 1, 0, 0, 0, 0, t.Location())
+	if last := first.AddDate(0, 1, -1).Day(); d > last {
+		d = last
+	}
+	return time.Date(first.Year(), first.Month(), d, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+}
+
+// derivedDims are the dimensions patrons can be broken down by in addition
+// to segmentFields, with their values in order.
+var derivedDims = map[string][]string{
+	"ageband":  {"0-5", "6-12", "13-15", "16-17", "18-29", "30-44", "45-66", "67+", "unknown"},
+	"activity": {"0-12m", "12-24m", "24-36m", "36m+", "never"},
+	"active":   {"active", "inactive"},
+}
+
+func ageBand(p patron, now time.Time) string {
+	a, err := strconv.Atoi(age(p.dateofbirth, now))
+	if err != nil || a < 0 {
+		return "unknown"
+	}
+	for _, band := range derivedDims["ageband"][:7] {
+		if upper, _ := strconv.Atoi(band[strings.Index(band, "-")+1:]); a <= upper {
+			return band
+		}
+	}
+	return "67+"
+}
+
+// activity returns the activity bucket of the patron by last loan.
+func activity(p patron, now time.Time) string {
+	if p.TEMP_sistelaan == "" {
+		return "never"
+	}
+	for i, months := range []int{12, 24, 36} {
+		if p.TEMP_sistelaan >= addMonths(now, -months).Format(mysqlDateFormat) {
+			return derivedDims["activity"][i]
+		}
+	}
+	return "36m+"
+}
+
+// breakdown counts patrons by the values of one or more dimensions.
+type breakdown struct {
+	dims   []string
+	get    []func(p patron) string
+	counts map[string]int // values joined by "\x00" -> count
+	total  int
+}
+
+// newBreakdown returns a breakdown by the dimensions: segment fields, or
+// ageband, activity (by months since last loan) and active (last loan within
+// activeMonths).
+func newBreakdown(dims []string, now time.Time, activeMonths int) (*breakdown, error) {
+	b := &breakdown{counts: make(map[string]int)}
+	for _, d := range dims {
+		d = strings.TrimSpace(d)
+		var get func(p patron) string
+		switch d {
+		case "ageband":
+			get = func(p patron) string { return ageBand(p, now) }
+		case "activity":
+			get = func(p patron) string { return activity(p, now) }
+		case "active":
+			since := addMonths(now, -activeMonths).Format(mysqlDateFormat)
+			get = func(p patron) string {
+				if p.TEMP_sistelaan != "" && p.TEMP_sistelaan >= since {
+					return "active"
+				}
+				return "inactive"
+			}
+		default:
+			f, ok := segmentFields[d]
+			if !ok {
+				return nil, fmt.Errorf("unknown breakdown dimension: %q", d)
+			}
+			get = func(p patron) string { return f.get(p, now) }
+		}
+		b.dims = append(b.dims, d)
+		b.get = append(b.get, get)
+	}
+	if len(b.dims) == 0 {
+		return nil, fmt.Errorf("breakdown without dimensions")
+	}
+	return b, nil
+}
+
+// parseBreakdowns parses breakdowns separated by ';', each with dimensions
+// separated by ',', as in "branch,active;ageband".
+func parseBreakdowns(s string, now time.Time, activeMonths int) ([]*breakdown, error) {
+	var res []*breakdown
+	for _, dims := range strings.Split(s, ";") {
+		if strings.TrimSpace(dims) == "" {
+			continue
+		}
+		b, err := newBreakdown(strings.Split(dims, ","), now, activeMonths)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, b)
+	}
+	return res, nil
+}
+
+func (b *breakdown) add(p patron) {
+	vals := make([]string, len(b.get))
+	for i, get := range b.get {
+		vals[i] = get(p)
+	}
+	b.counts[strings.Join(vals, "\x00")]++
+	b.total++
+}
+
+// values returns the distinct values of dimension i, in order.
+func (b *breakdown) values(i int) []string {
+	seen := make(map[string]bool)
+	for k := range b.counts {
+		seen[strings.Split(k, "\x00")[i]] = true
+	}
+	var res []string
+	if order, ok := derivedDims[b.dims[i]]; ok {
+		for _, v := range order {
+			if seen[v] {
+				res = append(res, v)
+			}
+		}
+		return res
+	}
+	for v := range seen {
+		res = append(res, v)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// table returns the breakdown as a cross-tabulation, with the last dimension
+// in columns (a single count column if there is only one dimension), and
+// totals in the last row and column.
+func (b *breakdown) table() [][]string {
+	n := len(b.dims)
+	var cols []string
+	if n > 1 {
+		cols = b.values(n - 1)
+	}
+	header := append([]string(nil), b.dims[:n-1]...)
+	if n == 1 {
+		header = append(header, b.dims[0], "count")
+	} else {
+		header = append(append(header, cols...), "total")
+	}
+
+	// rows are the combinations of the other dimensions present, in order
+	rowCounts := make(map[string]map[string]int)
+	var rows []string
+	for k, c := range b.counts {
+		vals := strings.Split(k, "\x00")
+		row, col := strings.Join(vals[:n-1], "\x00"), vals[n-1]
+		if n == 1 {
+			row, col = vals[0], ""
+		}
+		if rowCounts[row] == nil {
+			rowCounts[row] = make(map[string]int)
+			rows = append(rows, row)
+		}
+		rowCounts[row][col] += c
+	}
+	rank := make([]map[string]int, n)
+	for i := range b.dims {
+		rank[i] = make(map[string]int)
+		for j, v := range b.values(i) {
+			rank[i][v] = j
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, c := strings.Split(rows[i], "\x00"), strings.Split(rows[j], "\x00")
+		for d := range a {
+			if a[d] != c[d] {
+				return rank[d][a[d]] < rank[d][c[d]]
+			}
+		}
+		return false
+	})
+
+	res := [][]string{header}
+	colTotals := make(map[string]int)
+	for _, row := range rows {
+		line := strings.Split(row, "\x00")
+		if n == 1 {
+			line = append(line, strconv.Itoa(rowCounts[row][""]))
+			res = append(res, line)
+			continue
+		}
+		total := 0
+		for _, col := range cols {
+			c := rowCounts[row][col]
+			colTotals[col] += c
+			total += c
+			line = append(line, strconv.Itoa(c))
+		}
+		res = append(res, append(line, strconv.Itoa(total)))
+	}
+	last := make([]string, n-1)
+	if n == 1 {
+		last = append(last, "total")
+	} else {
+		last[0] = "total"
+		for _, col := range cols {
+			last = append(last, strconv.Itoa(colTotals[col]))
+		}
+	}
+	return append(res, append(last, strconv.Itoa(b.total)))
+}
+
+// writeBreakdowns writes the breakdowns to w as format "table" (aligned
+// columns), "csv" (tables separated by a blank line) or "json".
+func writeBreakdowns(w io.Writer, format string, bs []*breakdown) error {
+	switch format {
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+		for i, b := range bs {
+			if i > 0 {
+				fmt.Fprintln(tw)
+			}
+			fmt.Fprintf(tw, "%s\n", strings.Join(b.dims, " × "))
+			for _, row := range b.table() {
+				fmt.Fprintf(tw, "%s\t\n", strings.Join(row, "\t"))
+			}
+		}
+		return tw.Flush()
+	case "csv":
+		enc := csv.NewWriter(w)
+		for i, b := range bs {
+			if i > 0 {
+				enc.Write(nil)
+			}
+			enc.WriteAll(b.table())
+		}
+		enc.Flush()
+		return enc.Error()
+	case "json":
+		type cell struct {
+			Values []string `json:"values"`
+			Count  int      `json:"count"`
+		}
+		type jsonBreakdown struct {
+			Dimensions []string `json:"dimensions"`
+			Total      int      `json:"total"`
+			Cells      []cell   `json:"cells"`
+		}
+		var res []jsonBreakdown
+		for _, b := range bs {
+			jb := jsonBreakdown{Dimensions: b.dims, Total: b.total, Cells: []cell{}}
+			keys := make([]string, 0, len(b.counts))
+			for k := range b.counts {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				jb.Cells = append(jb.Cells, cell{Values: strings.Split(k, "\x00"), Count: b.counts[k]})
+			}
+			res = append(res, jb)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(map[string]interface{}{"breakdowns": res})
+	}
+	return fmt.Errorf("unknown format: %q", format)
+}
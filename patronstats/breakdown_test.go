@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAddMonths(t *testing.T) {
+	tests := []struct {
+		date string
+		n    int
+		want string
+	}{
+		{"2016-08-19", -12, "2015-08-19"},
+		{"2016-03-31", -1, "2016-02-29"},
+		{"2015-03-31", -1, "2015-02-28"},
+		{"2016-02-29", -12, "2015-02-28"},
+		{"2016-01-31", 1, "2016-02-29"},
+		{"2016-05-31", -18, "2014-11-30"},
+		{"2016-12-15", 1, "2017-01-15"},
+		{"2016-01-15", -1, "2015-12-15"},
+	}
+	for _, test := range tests {
+		d, _ := time.Parse(mysqlDateFormat, test.date)
+		if got := addMonths(d, test.n).Format(mysqlDateFormat); got != test.want {
+			t.Errorf("addMonths(%s, %d) = %s; want %s", test.date, test.n, got, test.want)
+		}
+	}
+
+	// within uses calendar months
+	match, err := compileSegment("lastloan within 1m", time.Date(2016, 3, 31, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !match(patron{TEMP_sistelaan: "2016-02-29"}) || match(patron{TEMP_sistelaan: "2016-02-28"}) {
+		t.Error("lastloan within 1m of 2016-03-31 should include 2016-02-29 and not 2016-02-28")
+	}
+}
+
+func TestBreakdown(t *testing.T) {
+	now := time.Date(2016, 8, 19, 0, 0, 0, 0, time.UTC)
+	bs, err := parseBreakdowns("branch, active; ageband", now, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []patron{
+		{branchcode: "hutl", dateofbirth: "2010-01-01", TEMP_sistelaan: "2016-01-01"},
+		{branchcode: "hutl", dateofbirth: "1980-08-20", TEMP_sistelaan: "2015-08-19"},
+		{branchcode: "fbje", dateofbirth: "1940-01-01"},
+		{branchcode: "hutl", TEMP_sistelaan: "2014-01-01"},
+	} {
+		for _, b := range bs {
+			b.add(p)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeBreakdowns(&buf, "csv", bs); err != nil {
+		t.Fatal(err)
+	}
+	want := `branch,active,inactive,total
+fbje,0,1,1
+hutl,2,1,3
+total,2,2,4
+
+ageband,count
+6-12,1
+30-44,1
+67+,1
+unknown,1
+total,4
+`
+	if buf.String() != want {
+		t.Errorf("got csv:\n%s\nwant:\n%s", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := writeBreakdowns(&buf, "table", bs[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "branch × active\n") || !strings.Contains(buf.String(), "total       2         2      4") {
+		t.Errorf("got table:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := writeBreakdowns(&buf, "json", bs[:1]); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Breakdowns []struct {
+			Dimensions []string
+			Total      int
+			Cells      []struct {
+				Values []string
+				Count  int
+			}
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if b := got.Breakdowns[0]; b.Total != 4 || len(b.Cells) != 3 || b.Cells[2].Values[0] != "hutl" || b.Cells[2].Values[1] != "inactive" || b.Cells[2].Count != 1 {
+		t.Errorf("got json %+v", got)
+	}
+
+	if _, err := parseBreakdowns("branch,fnr", now, 12); err == nil {
+		t.Error("got no error on unknown dimension")
+	}
+	if err := writeBreakdowns(&buf, "xml", bs); err == nil {
+		t.Error("got no error on unknown format")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+var (
+	// categoryCodes maps ln_kat to Koha categories, as in patronmassage.
+	categoryCodes = map[string]string{
+		"v":   "V",
+		"NB":  "BIB",
+		"b":   "B",
+		"u":   "V",
+		"kl":  "KL",
+		"NF":  "BIB",
+		"pas": "PAS",
+		"bhg": "BHG",
+		"i":   "I",
+		"EU":  "I",
+		"sko": "SKO",
+		"VGS": "SKO",
+		"OV":  "I",
+		"U03": "BIB",
+		"G02": "BIB",
+		"G12": "BIB",
+		"G03": "BIB",
+		"G16": "BIB",
+		"G01": "BIB",
+		"G18": "BIB",
+		"G07": "BIB",
+		"G11": "BIB",
+		"B18": "BIB",
+		"G04": "BIB",
+		"B15": "BIB",
+		"B12": "BIB",
+		"G17": "BIB",
+		"G15": "BIB",
+		"V12": "BIB",
+		"F03": "BIB",
+		"B14": "BIB",
+		"G05": "BIB",
+		"G19": "BIB",
+		"B11": "BIB",
+		"U12": "BIB",
+		"B19": "BIB",
+		"B16": "BIB",
+		"G06": "BIB",
+		"G08": "BIB",
+		"G09": "BIB",
+		"B06": "BIB",
+		"B05": "BIB",
+		"B02": "BIB",
+		"V11": "BIB",
+		"V03": "BIB",
+		"B04": "BIB",
+		"B20": "BIB",
+		"V02": "BIB",
+		"U02": "BIB",
+		"B17": "BIB",
+		"B08": "BIB",
+		"U16": "BIB",
+		"B10": "BIB",
+		"V18": "BIB",
+		"G14": "BIB",
+		"U11": "BIB",
+		"B03": "BIB",
+		"B01": "BIB",
+		"V16": "BIB",
+		"G10": "BIB",
+		"V15": "BIB",
+		"B07": "BIB",
+		"B09": "BIB",
+		"U18": "BIB",
+		"V06": "BIB",
+		"V04": "BIB",
+		"V10": "BIB",
+		"V05": "BIB",
+		"V01": "BIB",
+		"V08": "BIB",
+		"U19": "BIB",
+		"V19": "BIB",
+		"V07": "BIB",
+		"U04": "BIB",
+		"V09": "BIB",
+		"G20": "BIB",
+		"V17": "BIB",
+		"U20": "BIB",
+		"U15": "BIB",
+		"V14": "BIB",
+		"U01": "BIB",
+		"U14": "BIB",
+		"U08": "BIB",
+		"V20": "BIB",
+		"U07": "BIB",
+		"U06": "BIB",
+		"U05": "BIB",
+		"U17": "BIB",
+		"U10": "BIB",
+		"U09": "BIB",
+		"F98": "BIB",
+		"F11": "BIB",
+		"F02": "BIB",
+		"F16": "BIB",
+		"F18": "BIB",
+		"bkm": "V",
+		"V21": "BIB",
+		"U21": "BIB",
+		"F20": "BIB",
+		"F14": "BIB",
+		"F07": "BIB",
+		"U23": "BIB",
+		"stl": "V",
+		"F19": "BIB",
+		"F06": "BIB",
+		"F01": "BIB",
+		"B21": "BIB",
+	}
+)
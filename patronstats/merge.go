@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"log"
 	"strings"
 	"time"
 	"unicode"
@@ -90,6 +91,17 @@ func onlyDigits(s string) string {
 	return r.String()
 }
 
+// kohaCategory maps a Bibliofil patron category to a Koha category, as
+// patronmassage does, so segments and breakdowns use the migrated categories.
+func kohaCategory(code string) string {
+	catCode, ok := categoryCodes[code]
+	if !ok {
+		log.Printf("missing mapping for patron category: %q; fallback to \"V\"", code)
+		return "V"
+	}
+	return catCode
+}
+
 func merge(lmarc *marc.Record, laaner, lnel map[string]string) patron {
 	// defaults:
 	p := patron{
@@ -117,7 +129,7 @@ func merge(lmarc *marc.Record, laaner, lnel map[string]string) patron {
 	p.zipcode, p.city = splitZipCity(laaner["ln_post"])
 	p.country = laaner["ln_land"]
 	p.phone = laaner["ln_tlf"]
-	p.categorycode = laaner["ln_kat"]
+	p.categorycode = kohaCategory(laaner["ln_kat"])
 
 	switch laaner["ln_kjoenn"] {
 	case "k":
@@ -1,168 +1,203 @@
 package main
 
 import (
-	"encoding/csv"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"strconv"
+	"path/filepath"
 	"strings"
-	"sync"
-	"time"
 
-	"github.com/boutros/marc"
+	"github.com/digibib/migtools/patrondump"
 )
 
 type Main struct {
-	laanerIn, lmarcIn, lnelIn io.Reader
-	laaner, lnel              map[int]map[string]string
-	lmarc                     map[int]*marc.Record
-	numWorkers                int
-	branches                  map[string]string
+	src         patrondump.Source
+	rejects     *patrondump.Rejects
+	numWorkers  int
+	branches    map[string]string
+	segments    []segment
+	export      *segmentExport // optional; nil if segment members are not exported
+	breakdowns  []*breakdown
+	inBreakdown func(patron) bool // patrons counted in breakdowns; all if nil
 }
 
-func newMain(laaner, lmarc, lnel io.Reader, nw int) *Main {
+func newMain(src patrondump.Source, nw int, segments []segment) *Main {
 	return &Main{
-		laanerIn:   laaner,
-		lmarcIn:    lmarc,
-		lnelIn:     lnel,
-		laaner:     make(map[int]map[string]string),
-		lnel:       make(map[int]map[string]string),
-		lmarc:      make(map[int]*marc.Record),
+		src:        src,
 		numWorkers: nw,
 		branches:   make(map[string]string),
+		segments:   segments,
 	}
 }
 
-func (m *Main) indexLmarc(wg *sync.WaitGroup) {
-	dec := marc.NewDecoder(m.lmarcIn, marc.LineMARC)
-	for rec, err := dec.Decode(); err != io.EOF; rec, err = dec.Decode() {
-		if err != nil {
-			log.Fatal(err)
-			// TODO continue?
-		}
-		n, err := borrowernumber(rec)
-		if err != nil {
-			log.Println(err)
-			rec.DumpTo(os.Stderr, true)
-			continue
-		}
-		m.lmarc[n] = rec
-	}
-	wg.Done()
-	log.Println("done indexing lmarc")
-}
-
-func (m *Main) indexLaaner(wg *sync.WaitGroup) {
-	dec := NewKVDecoder(m.laanerIn)
-	for rec, err := dec.Decode(); err != io.EOF; rec, err = dec.Decode() {
-		if err != nil {
-			log.Fatal(err)
-			// TODO continue?
-		}
-		if rec["ln_nr"] == "" {
-			continue
-		}
-		n, err := strconv.Atoi(rec["ln_nr"])
-		if err != nil {
-			log.Fatal(err)
-		}
-		m.laaner[n] = rec
-	}
-	log.Println("done indexing laaner")
-	wg.Done()
-}
-
-func (m *Main) indexLnel(wg *sync.WaitGroup) {
-	dec := NewKVDecoder(m.lnelIn)
-	for rec, err := dec.Decode(); err != io.EOF; rec, err = dec.Decode() {
-		if err != nil {
-			log.Fatal(err)
-			// TODO continue?
-		}
-		if rec["lnel_nr"] == "" {
-			continue
-		}
-		n, err := strconv.Atoi(rec["lnel_nr"])
-		if err != nil {
-			log.Fatal(err)
-		}
-		m.lnel[n] = rec
-	}
-	log.Println("done indexing lnel")
-	wg.Done()
-}
-
 func (m *Main) Run() {
-	log.Println("start indexing resources")
-
-	var wg sync.WaitGroup
-	wg.Add(3)
-	go m.indexLmarc(&wg)
-	go m.indexLaaner(&wg)
-	go m.indexLnel(&wg)
-	wg.Wait()
-
-	log.Println("done indexing resources")
-
-	patrons := make([]patron, 0, 200000)
-
-	for i, _ := range m.laaner {
-		p := merge(m.lmarc[i], m.laaner[i], m.lnel[i])
+	// count patrons in every segment in one pass, without holding them in memory
+	counts := make([]int, len(m.segments))
+	err := m.src.Each(func(src *patrondump.Sources) {
+		p := merge(src.Lmarc, src.Laaner, src.Lnel)
 
 		if !strings.HasPrefix(p.surname, "!!") {
 			// deleted patrons are prefixed with !!
 			if p.cardnumber == "" {
 				p.cardnumber = p.userid
 			}
-			patrons = append(patrons, p)
+			for i, seg := range m.segments {
+				if seg.match(p) {
+					counts[i]++
+					if m.export != nil {
+						if err := m.export.Write(i, p); err != nil {
+							log.Fatal(err)
+						}
+					}
+				}
+			}
+			if m.inBreakdown == nil || m.inBreakdown(p) {
+				for _, b := range m.breakdowns {
+					b.add(p)
+				}
+			}
 		}
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	enc := csv.NewWriter(os.Stdout)
-	defer enc.Flush()
-
-	for _, sel := range selections {
-		c := 0
-		for _, p := range patrons {
-			if sel.IncludeFn(p) {
-				/*if err := enc.Write(patronCSVRow(p)); err != nil {
-					log.Fatal(err)
-				}*/
-				c++
-			}
+	if m.export != nil {
+		if err := m.export.Flush(); err != nil {
+			log.Fatal(err)
 		}
-		fmt.Printf("\n%s: %d\n", sel.Desc, c)
+	}
+
+	for i, seg := range m.segments {
+		fmt.Printf("\n%s: %d\n", seg.Desc, counts[i])
+	}
+	fmt.Println()
+	if err := m.rejects.Flush(os.Stdout); err != nil {
+		log.Fatal(err)
 	}
 }
 
 func main() {
 	var (
-		laaner     = flag.String("laaner", "/home/boutros/src/github.com/digibib/ls.ext/migration/data/data.laaner.20160819-073100.txt", "laaner dump")
-		lmarc      = flag.String("lmarc", "/home/boutros/src/github.com/digibib/ls.ext/migration/data/data.lmarc.20160819-073115.txt", "lmarc dump")
-		lnel       = flag.String("lnel", "/home/boutros/src/github.com/digibib/ls.ext/migration/data/data.lnel.20160819-073113.txt", "lnel dump")
+		laaner     = flag.String("laaner", "", "laaner dump")
+		lmarc      = flag.String("lmarc", "", "lmarc dump")
+		lnel       = flag.String("lnel", "", "lnel dump")
 		numWorkers = flag.Int("n", 8, "number of concurrent workers")
+		stream     = flag.Bool("stream", false, "join dumps sorted by borrower number on disk instead of indexing them in memory")
+		sorted     = flag.Bool("sorted", false, "dumps are already sorted by borrower number (with -stream; skips sorting)")
+		sortChunk  = flag.Int("sortchunk", 100000, "records held in memory when sorting dumps (with -stream)")
+		tmpDir     = flag.String("tmpdir", "", "directory for sorted dumps (with -stream; default system temp directory)")
+		rejects    = flag.String("rejects", "rejects.csv", "write dump records which cannot be read to file, with the raw record")
+		maxRejects = flag.Int("maxrejects", 1000, "abort when more dump records than this cannot be read (-1 = no limit)")
+		segConf    = flag.String("segments", "", "segments to count (default: built-in segments, see defaultSegmentsConfig)")
+		segExpr    = flag.String("segment", "", "count a single segment given by expression, e.g. 'email != \"\" and lastloan within 18m and category in [V,B]'")
+		exportDir  = flag.String("export", "", "export the members of each segment to <dir>/<segment id>.csv")
+		columns    = flag.String("columns", "userid,cardnumber,surname,firstname,email", "comma-separated patron fields to export")
+		breakdown  = flag.String("breakdown", "", "break patrons down by comma-separated dimensions, several separated by ';', e.g. 'branch,active;ageband;category,sex'")
+		format     = flag.String("format", "table", "format of breakdowns: table, csv or json")
+		report     = flag.String("report", "", "write breakdowns to file (default stdout)")
+		activeMon  = flag.Int("activemonths", 12, "patrons with a loan in the last number of months are active (breakdown dimension active)")
+		refDate    = flag.String("refdate", "", "date activity, age and expiry are calculated relative to, YYYY-MM-DD (default: export timestamp in dump filenames)")
 	)
 
 	flag.Parse()
 
-	if *laaner == "" || *lmarc == "" || *lnel == "" {
+	if *laaner == "" || *lmarc == "" || *lnel == "" || *sortChunk < 1 {
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	laanerF := mustOpen(*laaner)
-	defer laanerF.Close()
-	lmarcF := mustOpen(*lmarc)
-	defer lmarcF.Close()
-	lnelF := mustOpen(*lnel)
-	defer lnelF.Close()
+	now, err := referenceDate(*refDate, *laaner, *lmarc, *lnel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var segs []segment
+	if *segExpr != "" {
+		var match func(patron) bool
+		match, err = compileSegment(*segExpr, now)
+		segs = []segment{{ID: "segment", Desc: *segExpr, match: match}}
+	} else {
+		var segConfig io.Reader = strings.NewReader(defaultSegmentsConfig)
+		if *segConf != "" {
+			segConfF := mustOpen(*segConf)
+			defer segConfF.Close()
+			segConfig = segConfF
+		}
+		segs, err = parseSegments(segConfig, now)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	breakdowns, err := parseBreakdowns(*breakdown, now, *activeMon)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *format != "table" && *format != "csv" && *format != "json" {
+		log.Fatalf("unknown format: %q", *format)
+	}
 
-	m := newMain(laanerF, lmarcF, lnelF, *numWorkers)
+	rejectsF := mustCreate(*rejects)
+	defer rejectsF.Close()
+	rej := patrondump.NewRejects(rejectsF, *maxRejects)
+
+	var src patrondump.Source
+	if *stream {
+		s, err := patrondump.NewStreamSource(*laaner, *lmarc, *lnel, *sorted, *tmpDir, *sortChunk, rej)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer s.Close()
+		src = s
+	} else {
+		laanerF := mustOpen(*laaner)
+		lmarcF := mustOpen(*lmarc)
+		lnelF := mustOpen(*lnel)
+		mem, err := patrondump.NewMemSource(laanerF, lmarcF, lnelF, rej)
+		if err != nil {
+			log.Fatal(err)
+		}
+		src = mem
+		laanerF.Close()
+		lmarcF.Close()
+		lnelF.Close()
+	}
+
+	m := newMain(src, *numWorkers, segs)
+	m.rejects = rej
+	if *exportDir != "" {
+		var ws []io.Writer
+		for _, seg := range segs {
+			f := mustCreate(filepath.Join(*exportDir, seg.ID+".csv"))
+			defer f.Close()
+			ws = append(ws, f)
+		}
+		m.export, err = newSegmentExport(ws, strings.Split(*columns, ","), now)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	m.breakdowns = breakdowns
+	if *segExpr != "" {
+		m.inBreakdown = segs[0].match
+	}
 	m.Run()
+
+	if len(breakdowns) > 0 {
+		var w io.Writer = os.Stdout
+		if *report != "" {
+			f := mustCreate(*report)
+			defer f.Close()
+			w = f
+		} else {
+			fmt.Println()
+		}
+		if err := writeBreakdowns(w, *format, breakdowns); err != nil {
+			log.Fatal(err)
+		}
+	}
 }
 
 func mustOpen(s string) *os.File {
@@ -173,21 +208,12 @@ func mustOpen(s string) *os.File {
 	return f
 }
 
-func borrowernumber(r *marc.Record) (int, error) {
-	for _, cf := range r.CtrlFields {
-		if cf.Tag == "001" {
-			return strconv.Atoi(cf.Value)
-		}
+func mustCreate(s string) *os.File {
+	f, err := os.Create(s)
+	if err != nil {
+		panic(err)
 	}
-	return 0, errors.New("no borrowernumber in lmarc record")
-}
-
-func patronCSVRow(p patron) []string {
-	row := make([]string, 3)
-	row[0] = p.surname
-	row[1] = p.firstname
-	row[2] = p.email
-	return row
+	return f
 }
 
 func init() {
@@ -195,58 +221,17 @@ func init() {
 	log.SetPrefix("patronmassage: ")
 }
 
-var selections = []struct {
-	Desc      string
-	IncludeFn func(patron) bool
-}{
-	{
-		"Aktive lånere (lånt i 2015 el 2016) med epostadresse",
-		func(p patron) bool { return p.email != "" && isActive(p.TEMP_sistelaan) },
-	},
-	{
-		"Lånere med epostadresse som har lånt de siste 12 månedene",
-		func(p patron) bool { return p.email != "" && isActiveLastNMonths(p.TEMP_sistelaan, 12) },
-	},
-	{
-		"Lånere med epostadresse som har lånt de siste 24 månedene",
-		func(p patron) bool { return p.email != "" && isActiveLastNMonths(p.TEMP_sistelaan, 24) },
-	},
-	{
-		"Lånere med epostadresse som har lånt de siste 36 månedene",
-		func(p patron) bool { return p.email != "" && isActiveLastNMonths(p.TEMP_sistelaan, 36) },
-	},
-	{
-		"Lånere med epostadresse som har brukt huskeliste",
-		func(p patron) bool { return p.email != "" && p.TEMP_huskeliste },
-	},
-	{
-		"Lånere med epostadresse som har lagret historikk",
-		func(p patron) bool { return p.email != "" && p.privacy == 0 },
-	},
-	{
-		"Lånere med epostadresse som har brukt famileMappaMi",
-		func(p patron) bool { return p.email != "" && p.TEMP_familie },
-	},
-	{
-		"Lånere med epostadresse som har brukt interesseområder",
-		func(p patron) bool { return p.email != "" && p.TEMP_interesse },
-	},
-	{
-		"Lånere med epostadresse",
-		func(p patron) bool { return p.email != "" },
-	},
-}
-
-func isActive(s string) bool {
-	// Date format: 2016-03-07
-	return len(s) == 10 && (s[:4] == "2015" || s[:4] == "2016")
-}
-
-func isActiveLastNMonths(s string, n int) bool {
-	// Date format: 2016-03-07
-	t, err := time.Parse("2006-01-02", s)
-	if err != nil {
-		return false
-	}
-	return len(s) == 10 && int((time.Since(t).Hours()/730.485)) <= n // TODO verify 730.485 calc
-}
+// defaultSegmentsConfig are the segments counted unless -segments or -segment
+// is given, see parseSegments for the format.
+const defaultSegmentsConfig = `
+# id	description	expression
+active1516	Aktive lånere (lånt i 2015 el 2016) med epostadresse	email != "" and lastloan >= 2015-01-01 and lastloan <= 2016-12-31
+active12m	Lånere med epostadresse som har lånt de siste 12 månedene	email != "" and lastloan within 12m
+active24m	Lånere med epostadresse som har lånt de siste 24 månedene	email != "" and lastloan within 24m
+active36m	Lånere med epostadresse som har lånt de siste 36 månedene	email != "" and lastloan within 36m
+huskeliste	Lånere med epostadresse som har brukt huskeliste	email != "" and huskeliste
+historikk	Lånere med epostadresse som har lagret historikk	email != "" and privacy = 0
+familie	Lånere med epostadresse som har brukt famileMappaMi	email != "" and familie
+interesse	Lånere med epostadresse som har brukt interesseområder	email != "" and interesse
+epost	Lånere med epostadresse	email != ""
+`
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type fieldKind int
+
+const (
+	stringField fieldKind = iota
+	dateField             // YYYY-MM-DD, empty if unknown
+	intField
+	boolField
+)
+
+// segmentField is a patron field available in segment expressions and exports.
+type segmentField struct {
+	kind fieldKind
+	get  func(p patron, now time.Time) string
+}
+
+func boolString(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
+
+// segmentFields are the patron fields, by name.
+var segmentFields = map[string]segmentField{
+	"cardnumber":    {stringField, func(p patron, _ time.Time) string { return p.cardnumber }},
+	"userid":        {stringField, func(p patron, _ time.Time) string { return p.userid }},
+	"surname":       {stringField, func(p patron, _ time.Time) string { return p.surname }},
+	"firstname":     {stringField, func(p patron, _ time.Time) string { return p.firstname }},
+	"address":       {stringField, func(p patron, _ time.Time) string { return p.address }},
+	"address2":      {stringField, func(p patron, _ time.Time) string { return p.address2 }},
+	"zipcode":       {stringField, func(p patron, _ time.Time) string { return p.zipcode }},
+	"city":          {stringField, func(p patron, _ time.Time) string { return p.city }},
+	"country":       {stringField, func(p patron, _ time.Time) string { return p.country }},
+	"email":         {stringField, func(p patron, _ time.Time) string { return p.email }},
+	"phone":         {stringField, func(p patron, _ time.Time) string { return p.phone }},
+	"sms":           {stringField, func(p patron, _ time.Time) string { return p.smsalertnumber }},
+	"branch":        {stringField, func(p patron, _ time.Time) string { return p.branchcode }},
+	"category":      {stringField, func(p patron, _ time.Time) string { return p.categorycode }},
+	"sex":           {stringField, func(p patron, _ time.Time) string { return p.sex }},
+	"notes":         {stringField, func(p patron, _ time.Time) string { return p.borrowernotes }},
+	"restransport":  {stringField, func(p patron, _ time.Time) string { return p.TEMP_res_transport }},
+	"purtransport":  {stringField, func(p patron, _ time.Time) string { return p.TEMP_pur_transport }},
+	"fvtransport":   {stringField, func(p patron, _ time.Time) string { return p.TEMP_fvarsel_transport }},
+	"dateofbirth":   {dateField, func(p patron, _ time.Time) string { return p.dateofbirth }},
+	"enrolled":      {dateField, func(p patron, _ time.Time) string { return p.dateenrolled }},
+	"expiry":        {dateField, func(p patron, _ time.Time) string { return p.dateexpiry }},
+	"lastloan":      {dateField, func(p patron, _ time.Time) string { return p.TEMP_sistelaan }},
+	"privacy":       {intField, func(p patron, _ time.Time) string { return strconv.Itoa(p.privacy) }},
+	"age":           {intField, func(p patron, now time.Time) string { return age(p.dateofbirth, now) }},
+	"lost":          {boolField, func(p patron, _ time.Time) string { return boolString(p.lost) }},
+	"gonenoaddress": {boolField, func(p patron, _ time.Time) string { return boolString(p.gonenoaddress) }},
+	"nl":            {boolField, func(p patron, _ time.Time) string { return boolString(p.TEMP_nl) }},
+	"huskeliste":    {boolField, func(p patron, _ time.Time) string { return boolString(p.TEMP_huskeliste) }},
+	"familie":       {boolField, func(p patron, _ time.Time) string { return boolString(p.TEMP_familie) }},
+	"interesse":     {boolField, func(p patron, _ time.Time) string { return boolString(p.TEMP_interesse) }},
+}
+
+// age returns the age in whole years at now, or "" if the date of birth is unknown.
+func age(dob string, now time.Time) string {
+	t, err := time.Parse(mysqlDateFormat, dob)
+	if err != nil {
+		return ""
+	}
+	years := now.Year() - t.Year()
+	if now.Month() < t.Month() || (now.Month() == t.Month() && now.Day() < t.Day()) {
+		years--
+	}
+	return strconv.Itoa(years)
+}
+
+// segment is a named group of patrons matching an expression.
+type segment struct {
+	ID, Desc string
+	match    func(p patron) bool
+}
+
+// parseSegments parses segments from r. The segments are tab-separated, with
+// lines starting with '#' ignored, one line per segment:
+//
+//	<id>	<description>	<expression>
+//
+// See compileSegment for the expression language.
+func parseSegments(r io.Reader, now time.Time) ([]segment, error) {
+	cr := csv.NewReader(r)
+	cr.Comma = '\t'
+	cr.Comment = '#'
+	cr.FieldsPerRecord = 3
+	cr.LazyQuotes = true
+	lines, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("segments: %v", err)
+	}
+	var res []segment
+	for _, l := range lines {
+		match, err := compileSegment(l[2], now)
+		if err != nil {
+			return nil, fmt.Errorf("segment %s: %v", l[0], err)
+		}
+		res = append(res, segment{ID: l[0], Desc: l[1], match: match})
+	}
+	return res, nil
+}
+
+// compileSegment compiles a filter expression over patron fields, evaluated
+// relative to now. The expression language:
+//
+//	expr       = term { "or" term }
+//	term       = factor { "and" factor }
+//	factor     = "not" factor | "(" expr ")" | comparison | <bool field>
+//	comparison = <field> ("=" | "!=" | "<" | "<=" | ">" | ">=") value
+//	           | <field> ["not"] "in" "[" value { "," value } "]"
+//	           | <field> "contains" value
+//	           | <date field> "within" <n>("d" | "m" | "y")
+//	value      = "quoted string" | word
+//
+// Dates are written YYYY-MM-DD. Comparisons with an unknown date or age are
+// false, except = "" and != "". See segmentFields for the fields.
+func compileSegment(expr string, now time.Time) (func(patron) bool, error) {
+	toks, err := lexSegment(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &segmentParser{toks: toks, now: now}
+	match, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at %d", t.val, t.pos)
+	}
+	return match, nil
+}
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokWord
+	tokString
+	tokOp    // = == != < <= > >=
+	tokPunct // ( ) [ ] ,
+)
+
+type token struct {
+	kind tokKind
+	val  string
+	pos  int
+}
+
+func lexSegment(s string) ([]token, error) {
+	var toks []token
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case strings.ContainsRune("()[],", r):
+			toks = append(toks, token{tokPunct, string(r), i})
+			i++
+		case strings.ContainsRune("=!<>", r):
+			op := string(r)
+			if i+1 < len(rs) && rs[i+1] == '=' {
+				op += "="
+			}
+			switch op {
+			case "!":
+				return nil, fmt.Errorf("unexpected \"!\" at %d", i)
+			case "==":
+				toks = append(toks, token{tokOp, "=", i})
+			default:
+				toks = append(toks, token{tokOp, op, i})
+			}
+			i += len(op)
+		case r == '"':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(rs) && rs[j] != '"'; j++ {
+				if rs[j] == '\\' && j+1 < len(rs) {
+					j++
+				}
+				b.WriteRune(rs[j])
+			}
+			if j == len(rs) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			toks = append(toks, token{tokString, b.String(), i})
+			i = j + 1
+		default:
+			j := i
+			for j < len(rs) && !unicode.IsSpace(rs[j]) && !strings.ContainsRune("()[],=!<>\"", rs[j]) {
+				j++
+			}
+			toks = append(toks, token{tokWord, string(rs[i:j]), i})
+			i = j
+		}
+	}
+	return append(toks, token{tokEOF, "end of expression", len(rs)}), nil
+}
+
+type segmentParser struct {
+	toks []token
+	pos  int
+	now  time.Time
+}
+
+func (p *segmentParser) peek() token { return p.toks[p.pos] }
+
+func (p *segmentParser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword reports whether the next token is the keyword, consuming it if so.
+func (p *segmentParser) keyword(kw string) bool {
+	if t := p.peek(); t.kind == tokWord && strings.EqualFold(t.val, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *segmentParser) punct(s string) error {
+	if t := p.next(); t.kind != tokPunct || t.val != s {
+		return fmt.Errorf("expected %q at %d, got %q", s, t.pos, t.val)
+	}
+	return nil
+}
+
+func (p *segmentParser) expr() (func(patron) bool, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(pt patron) bool { return l(pt) || right(pt) }
+	}
+	return left, nil
+}
+
+func (p *segmentParser) term() (func(patron) bool, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(pt patron) bool { return l(pt) && right(pt) }
+	}
+	return left, nil
+}
+
+func (p *segmentParser) factor() (func(patron) bool, error) {
+	if p.keyword("not") {
+		f, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return func(pt patron) bool { return !f(pt) }, nil
+	}
+	if t := p.peek(); t.kind == tokPunct && t.val == "(" {
+		p.next()
+		f, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return f, p.punct(")")
+	}
+	return p.comparison()
+}
+
+func (p *segmentParser) value() (token, error) {
+	t := p.next()
+	if t.kind != tokWord && t.kind != tokString {
+		return t, fmt.Errorf("expected value at %d, got %q", t.pos, t.val)
+	}
+	return t, nil
+}
+
+var durationRe = regexp.MustCompile(`^(\d+)([dmy])$`)
+
+func (p *segmentParser) comparison() (func(patron) bool, error) {
+	ft := p.next()
+	if ft.kind != tokWord {
+		return nil, fmt.Errorf("expected field at %d, got %q", ft.pos, ft.val)
+	}
+	field, ok := segmentFields[strings.ToLower(ft.val)]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q at %d", ft.val, ft.pos)
+	}
+	now := p.now
+	get := func(pt patron) string { return field.get(pt, now) }
+
+	t := p.peek()
+	switch {
+	case t.kind == tokOp:
+		p.next()
+		vt, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		return compare(field.kind, get, t.val, vt)
+	case t.kind == tokWord && (strings.EqualFold(t.val, "in") || strings.EqualFold(t.val, "not")):
+		negate := p.keyword("not")
+		if !p.keyword("in") {
+			return nil, fmt.Errorf("expected \"in\" at %d", p.peek().pos)
+		}
+		set := make(map[string]bool)
+		if err := p.punct("["); err != nil {
+			return nil, err
+		}
+		for {
+			vt, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			set[vt.val] = true
+			if t := p.peek(); t.kind == tokPunct && t.val == "]" {
+				p.next()
+				break
+			}
+			if err := p.punct(","); err != nil {
+				return nil, err
+			}
+		}
+		return func(pt patron) bool { return set[get(pt)] != negate }, nil
+	case t.kind == tokWord && strings.EqualFold(t.val, "contains"):
+		p.next()
+		vt, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		sub := strings.ToLower(vt.val)
+		return func(pt patron) bool { return strings.Contains(strings.ToLower(get(pt)), sub) }, nil
+	case t.kind == tokWord && strings.EqualFold(t.val, "within"):
+		p.next()
+		if field.kind != dateField {
+			return nil, fmt.Errorf("within on %s, which is not a date, at %d", ft.val, t.pos)
+		}
+		vt, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		m := durationRe.FindStringSubmatch(vt.val)
+		if m == nil {
+			return nil, fmt.Errorf("bad duration %q at %d; want <n>d, <n>m or <n>y", vt.val, vt.pos)
+		}
+		n, _ := strconv.Atoi(m[1])
+		var since time.Time
+		switch m[2] {
+		case "d":
+			since = now.AddDate(0, 0, -n)
+		case "m":
+			since = addMonths(now, -n)
+		case "y":
+			since = addMonths(now, -12*n)
+		}
+		from := since.Format(mysqlDateFormat)
+		return func(pt patron) bool {
+			v := get(pt)
+			return v != "" && v >= from
+		}, nil
+	}
+	if field.kind != boolField {
+		return nil, fmt.Errorf("expected operator after %s at %d, got %q", ft.val, t.pos, t.val)
+	}
+	return func(pt patron) bool { return get(pt) == "true" }, nil
+}
+
+// compare compiles a comparison of the field with a value.
+func compare(kind fieldKind, get func(patron) string, op string, vt token) (func(patron) bool, error) {
+	v := vt.val
+	if v == "" && (op == "=" || op == "!=") {
+		return func(pt patron) bool { return (get(pt) == "") == (op == "=") }, nil
+	}
+	var cmp func(a string) int // compares a field value with v
+	switch kind {
+	case stringField:
+		cmp = func(a string) int { return strings.Compare(a, v) }
+	case dateField:
+		if _, err := time.Parse(mysqlDateFormat, v); err != nil {
+			return nil, fmt.Errorf("bad date %q at %d; want YYYY-MM-DD", v, vt.pos)
+		}
+		cmp = func(a string) int { return strings.Compare(a, v) }
+	case intField:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q at %d", v, vt.pos)
+		}
+		cmp = func(a string) int {
+			m, _ := strconv.Atoi(a)
+			switch {
+			case m < n:
+				return -1
+			case m > n:
+				return 1
+			}
+			return 0
+		}
+	case boolField:
+		if v != "true" && v != "false" {
+			return nil, fmt.Errorf("bad boolean %q at %d; want true or false", v, vt.pos)
+		}
+		if op != "=" && op != "!=" {
+			return nil, fmt.Errorf("operator %s on boolean at %d", op, vt.pos)
+		}
+		cmp = func(a string) int { return strings.Compare(a, v) }
+	}
+	known := func(a string) bool { return kind == stringField || a != "" }
+	var test func(c int) bool
+	switch op {
+	case "=":
+		test = func(c int) bool { return c == 0 }
+	case "!=":
+		test = func(c int) bool { return c != 0 }
+	case "<":
+		test = func(c int) bool { return c < 0 }
+	case "<=":
+		test = func(c int) bool { return c <= 0 }
+	case ">":
+		test = func(c int) bool { return c > 0 }
+	case ">=":
+		test = func(c int) bool { return c >= 0 }
+	}
+	return func(pt patron) bool {
+		a := get(pt)
+		return known(a) && test(cmp(a))
+	}, nil
+}
+
+// segmentExport writes the members of segments as CSV, one writer per segment.
+type segmentExport struct {
+	columns []segmentField
+	encs    []*csv.Writer
+	now     time.Time
+}
+
+func newSegmentExport(ws []io.Writer, columns []string, now time.Time) (*segmentExport, error) {
+	e := &segmentExport{now: now}
+	for _, c := range columns {
+		f, ok := segmentFields[strings.TrimSpace(c)]
+		if !ok {
+			return nil, fmt.Errorf("unknown column: %q", c)
+		}
+		e.columns = append(e.columns, f)
+	}
+	for _, w := range ws {
+		enc := csv.NewWriter(w)
+		enc.Write(columns)
+		e.encs = append(e.encs, enc)
+	}
+	return e, nil
+}
+
+// Write writes the patron as a member of segment i.
+func (e *segmentExport) Write(i int, p patron) error {
+	row := make([]string, len(e.columns))
+	for j, c := range e.columns {
+		row[j] = c.get(p, e.now)
+	}
+	return e.encs[i].Write(row)
+}
+
+// Flush writes any buffered rows.
+func (e *segmentExport) Flush() error {
+	for _, enc := range e.encs {
+		enc.Flush()
+		if err := enc.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boutros/marc"
+)
+
+func TestSegments(t *testing.T) {
+	now := time.Date(2016, 8, 19, 0, 0, 0, 0, time.UTC)
+	p := patron{
+		userid:          "1",
+		surname:         "Testesen",
+		email:           "test@example.com",
+		categorycode:    "V",
+		dateofbirth:     "1980-08-20",
+		TEMP_sistelaan:  "2015-03-01",
+		privacy:         1,
+		TEMP_huskeliste: true,
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`email != "" and lastloan within 18m and category in [V,B]`, true},
+		{`email != "" and lastloan within 12m`, false},
+		{`lastloan within 2y and not (category in [B])`, true},
+		{`category not in [V, "B"]`, false},
+		{`email = ""`, false},
+		{`email == "test@example.com"`, true},
+		{`sms = ""`, true},
+		{`enrolled within 100y`, false}, // unknown date
+		{`enrolled < 2016-01-01`, false},
+		{`enrolled = ""`, true},
+		{`age = 35`, true}, // birthday tomorrow
+		{`age >= 36 or privacy = 1`, true},
+		{`huskeliste and not familie`, true},
+		{`huskeliste = false`, false},
+		{`surname contains TEST`, true},
+		{`lastloan >= 2015-01-01 and lastloan <= 2015-12-31`, true},
+		{`NOT lost AND (nl OR interesse OR huskeliste)`, true},
+	}
+	for _, test := range tests {
+		match, err := compileSegment(test.expr, now)
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		if got := match(p); got != test.want {
+			t.Errorf("%s: got %v; want %v", test.expr, got, test.want)
+		}
+	}
+
+	for _, expr := range []string{
+		``,
+		`email`,
+		`email !`,
+		`foo = 1`,
+		`email = "x`,
+		`(email = x`,
+		`email in [a, b`,
+		`lastloan within 18w`,
+		`email within 1y`,
+		`lastloan > 2016-13-01`,
+		`age > old`,
+		`lost < true`,
+		`email = x y`,
+	} {
+		if _, err := compileSegment(expr, now); err == nil {
+			t.Errorf("%q: got no error", expr)
+		}
+	}
+}
+
+func TestSegmentsMergedPatron(t *testing.T) {
+	laaner, err := NewKVDecoder(strings.NewReader("ln_nr |808708|\nln_navn |Testesen, Test|\nln_kat |v|\nln_sistelaan |08/06/2016|\n^\n")).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lmarc, err := marc.NewDecoder(strings.NewReader("*0010808708\n*140  $ahutl$bfmaj\n^\n"), marc.LineMARC).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := merge(lmarc, laaner, nil)
+	now := time.Date(2016, 8, 19, 0, 0, 0, 0, time.UTC)
+	for expr, want := range map[string]bool{
+		`category in [V]`:                           true,
+		`category = v`:                              false,
+		`category in [B] or lastloan within 3m`:     true,
+		`category = V and not (lastloan within 1m)`: true,
+	} {
+		match, err := compileSegment(expr, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := match(p); got != want {
+			t.Errorf("%s: got %v; want %v (category %q)", expr, got, want, p.categorycode)
+		}
+	}
+}
+
+func TestSegmentExport(t *testing.T) {
+	segs, err := parseSegments(strings.NewReader(defaultSegmentsConfig), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != 9 {
+		t.Errorf("got %d default segments; want 9", len(segs))
+	}
+	// the date range segment does not move with the reference date
+	if p := (patron{email: "test@example.com", TEMP_sistelaan: "2016-06-08"}); segs[0].ID != "active1516" || !segs[0].match(p) || segs[2].match(p) {
+		t.Errorf("segment %s: got %v, %s: got %v; want loan in 2016 counted only in active1516", segs[0].ID, segs[0].match(p), segs[2].ID, segs[2].match(p))
+	}
+
+	var a, b bytes.Buffer
+	e, err := newSegmentExport([]io.Writer{&a, &b}, []string{"userid", "email", "age"}, time.Date(2016, 8, 19, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Write(1, patron{userid: "1", email: "test@example.com", dateofbirth: "1980-08-19"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "userid,email,age\n"; a.String() != want {
+		t.Errorf("got %q; want %q", a.String(), want)
+	}
+	if want := "userid,email,age\n1,test@example.com,36\n"; b.String() != want {
+		t.Errorf("got %q; want %q", b.String(), want)
+	}
+
+	if _, err := newSegmentExport(nil, []string{"userid", "fnr"}, time.Now()); err == nil {
+		t.Error("got no error on unknown column")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/digibib/migtools/dumpgen"
+)
+
+var e2eConfig = dumpgen.Config{
+	Titles:   500,
+	Copies:   3,
+	Patrons:  300,
+	LoanRate: 0.2,
+	HoldRate: 0.2,
+	Date:     time.Date(2016, 8, 19, 7, 31, 0, 0, time.UTC),
+}
+
+var rgxBorrower = regexp.MustCompile(`ln_nr \|(\d+)\|`)
+
+// generatedConfig writes the res dump of dumps from dumpgen to dir, and
+// patrons.csv with every patron migrated to hutl, returning the
+// configuration to convert them with the built-in rules to jsonl in dir.
+func generatedConfig(t testing.TB, d *dumpgen.Buffers, dir string) config {
+	res := filepath.Join(dir, "data.res.20160819-073100.txt")
+	if err := ioutil.WriteFile(res, d.Res.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var patrons strings.Builder
+	patrons.WriteString("userid,branchcode\n")
+	for _, m := range rgxBorrower.FindAllStringSubmatch(d.Laaner.String(), -1) {
+		fmt.Fprintf(&patrons, "%s,hutl\n", m[1])
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "patrons.csv"), []byte(patrons.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return config{
+		res:          res,
+		pickupDelay:  7,
+		rejects:      filepath.Join(dir, "res_rejects.csv"),
+		maxRejects:   -1,
+		patrons:      filepath.Join(dir, "patrons.csv"),
+		unmigrated:   filepath.Join(dir, "res_unmigrated.csv"),
+		pickupReport: filepath.Join(dir, "res_pickup.csv"),
+		format:       "jsonl",
+		out:          filepath.Join(dir, "holds.jsonl"),
+	}
+}
+
+// jsonHold is a hold as written in jsonl.
+type jsonHold struct {
+	Userid       string      `json:"userid"`
+	Biblionumber json.Number `json:"biblionumber"`
+	Branchcode   string      `json:"branchcode"`
+	Priority     int         `json:"priority"`
+	Found        string      `json:"found"`
+	WaitingDate  string      `json:"waitingdate"`
+	Suspend      bool        `json:"suspend"`
+	Notes        string      `json:"reservenotes"`
+}
+
+// readHolds reads the holds written in jsonl, in order.
+func readHolds(t *testing.T, name string) []jsonHold {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var holds []jsonHold
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var h jsonHold
+		if err := json.Unmarshal(scanner.Bytes(), &h); err != nil {
+			t.Fatalf("%v: %s", err, scanner.Text())
+		}
+		holds = append(holds, h)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return holds
+}
+
+func readCSV(t *testing.T, name string) [][]string {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+// TestGeneratedDumps converts the holds of dumps from dumpgen, checking that
+// every hold except interlibrary loans is converted, with a valid queue.
+func TestGeneratedDumps(t *testing.T) {
+	d, err := dumpgen.Generate(e2eConfig, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "res2sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := generatedConfig(t, d, dir)
+	if err := run(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if rejects := readCSV(t, cfg.rejects); len(rejects) > 1 {
+		t.Errorf("got rejects %v", rejects[1:])
+	}
+
+	res := d.Res.String()
+	want := strings.Count(res, "\n^\n") - strings.Count(res, "res_exnr |998|")
+	holds := readHolds(t, cfg.out)
+	suspended, notes := 0, 0
+	queue := make(map[json.Number]int) // biblionumber -> holds in queue
+	for _, r := range holds {
+		if r.Suspend {
+			suspended++
+		}
+		if r.Notes != "" {
+			notes++
+		}
+		if r.Found == "W" && r.WaitingDate == "" {
+			t.Errorf("title %s: waiting hold without waiting date", r.Biblionumber)
+		}
+		if r.Branchcode == "" || r.Branchcode == "ukjent" {
+			t.Errorf("title %s: hold without pickup branch", r.Biblionumber)
+		}
+		if r.Found != "" {
+			if r.Priority != 0 || queue[r.Biblionumber] > 0 {
+				t.Errorf("title %s: found hold with priority %d after %d in queue", r.Biblionumber, r.Priority, queue[r.Biblionumber])
+			}
+			continue
+		}
+		if queue[r.Biblionumber]++; r.Priority != queue[r.Biblionumber] {
+			t.Errorf("title %s: got priority %d; want %d", r.Biblionumber, r.Priority, queue[r.Biblionumber])
+		}
+	}
+	if len(holds) != want || len(holds) == 0 {
+		t.Errorf("got %d holds; want %d", len(holds), want)
+	}
+	if suspended == 0 || notes == 0 {
+		t.Errorf("got %d suspended holds and %d with notes; want some", suspended, notes)
+	}
+
+	cfg.format, cfg.out = "sql", filepath.Join(dir, "holds.sql")
+	if err := run(cfg); err != nil {
+		t.Fatal(err)
+	}
+	sql, err := ioutil.ReadFile(cfg.out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(sql), "INSERT IGNORE INTO reserves"); n != len(holds) {
+		t.Errorf("got %d holds in SQL; want %d", n, len(holds))
+	}
+}
+
+// TestGeneratedDumpsDefaults converts the holds of dumps from dumpgen with
+// the default flags, without -patrons: holds at unknown branches cannot go to
+// the patron's home branch, but the run does not fail.
+func TestGeneratedDumpsDefaults(t *testing.T) {
+	d, err := dumpgen.Generate(e2eConfig, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "res2sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	res := filepath.Join(dir, "data.res.20160819-073100.txt")
+	if err := ioutil.WriteFile(res, d.Res.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config{
+		res:          res,
+		pickupDelay:  7,
+		rejects:      filepath.Join(dir, "res_rejects.csv"),
+		maxRejects:   1000,
+		unmigrated:   filepath.Join(dir, "res_unmigrated.csv"),
+		pickupReport: filepath.Join(dir, "res_pickup.csv"),
+		format:       "sql",
+		out:          filepath.Join(dir, "holds.sql"),
+	}
+	if err := run(cfg); err != nil {
+		t.Fatal(err)
+	}
+	sql, err := ioutil.ReadFile(cfg.out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := d.Res.String()
+	if got, want := strings.Count(string(sql), "INSERT IGNORE INTO reserves"), strings.Count(s, "\n^\n")-strings.Count(s, "res_exnr |998|"); got != want {
+		t.Errorf("got %d holds in SQL; want %d", got, want)
+	}
+	for _, row := range readCSV(t, cfg.pickupReport)[1:] {
+		if row[5] == "unknown branch, home branch" {
+			t.Errorf("hold of borrower %s at home branch without -patrons", row[1])
+		}
+	}
+}
+
+func BenchmarkGeneratedDumps(b *testing.B) {
+	cfg := e2eConfig
+	cfg.Titles, cfg.Patrons = 20000, 5000
+	d, err := dumpgen.Generate(cfg, 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "res2sql")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	rcfg := generatedConfig(b, d, dir)
+	rcfg.format = "sql"
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := run(rcfg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/boutros/marc"
+)
+
+// integrity checks holds against the titles, items and patrons which are
+// migrated, as written by catmassage and patronmassage, so that holds Koha
+// would silently drop are reported instead.
+type integrity struct {
+	titles    map[string]map[string]bool // biblionumber -> barcodes; nil if not checked
+	borrowers map[string]string          // userid -> home branch; nil if not checked
+	report    *csv.Writer
+	counts    map[string]int // reason -> count
+}
+
+func newIntegrity(titles map[string]map[string]bool, borrowers map[string]string, report io.Writer) *integrity {
+	c := &integrity{
+		titles:    titles,
+		borrowers: borrowers,
+		report:    csv.NewWriter(report),
+		counts:    make(map[string]int),
+	}
+	c.report.Write([]string{"biblionumber", "borrowernumber", "barcode", "status", "priority", "reason"})
+	return c
+}
+
+// check returns the holds which will migrate, reporting the others. Priorities
+// are those in Bibliofil, until the holds are prioritized.
+func (c *integrity) check(reserves Reserves) Reserves {
+	res := reserves[:0]
+	for _, r := range reserves {
+		if reason := c.invalid(r); reason != "" {
+			c.counts[reason]++
+			c.report.Write([]string{r.Biblionumber, r.Borrowernumber, r.Barcode, r.Status, strconv.Itoa(r.Priority), reason})
+			continue
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+func (c *integrity) invalid(r Reserve) string {
+	if c.titles != nil {
+		items, ok := c.titles[r.Biblionumber]
+		if !ok {
+			return "title not migrated"
+		}
+		if r.Barcode != "" && !items[r.Barcode] {
+			return "item not migrated"
+		}
+	}
+	if c.borrowers != nil {
+		if _, ok := c.borrowers[r.Borrowernumber]; !ok {
+			return "patron not migrated"
+		}
+	}
+	return ""
+}
+
+// Flush writes any buffered report rows, and prints a summary to w.
+func (c *integrity) Flush(w io.Writer) error {
+	c.report.Flush()
+	reasons := make([]string, 0, len(c.counts))
+	for reason := range c.counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	fmt.Fprintln(w, "Holds not migrated:")
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "%s\t%d\n", reason, c.counts[reason])
+	}
+	return c.report.Error()
+}
+
+// loadCatalogue reads the titles and their item barcodes (952$p) from the
+// catalogue written by catmassage, in MARC or MARCXML.
+func loadCatalogue(f *os.File) (map[string]map[string]bool, error) {
+	sniff := make([]byte, 64)
+	if _, err := f.Read(sniff); err != nil {
+		return nil, err
+	}
+	format := marc.DetectFormat(sniff)
+	switch format {
+	case marc.MARC, marc.MARCXML:
+		break
+	default:
+		return nil, errors.New("catalogue: unknown MARC format")
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	titles := make(map[string]map[string]bool)
+	dec := marc.NewDecoder(f, format)
+	for rec, err := dec.Decode(); err != io.EOF; rec, err = dec.Decode() {
+		if err != nil {
+			return nil, err
+		}
+		tnr := titleNumber(rec)
+		if tnr == "" {
+			continue
+		}
+		items := make(map[string]bool)
+		for _, df := range rec.DataFields {
+			if df.Tag != "952" {
+				continue
+			}
+			for _, sf := range df.SubFields {
+				if sf.Code == "p" {
+					items[sf.Value] = true
+				}
+			}
+		}
+		titles[tnr] = items
+	}
+	return titles, nil
+}
+
+// titleNumber returns the title number in 001, without leading zeros.
+func titleNumber(r *marc.Record) string {
+	for _, f := range r.CtrlFields {
+		if f.Tag == "001" {
+			return strings.TrimLeft(f.Value, "0")
+		}
+	}
+	return ""
+}
+
+// loadPatrons reads the Bibliofil borrower numbers (the userid column) of the
+// patrons written to patrons.csv by patronmassage, with their home branch if
+// the branchcode column is present.
+func loadPatrons(r io.Reader) (map[string]string, error) {
+	dec := csv.NewReader(r)
+	header, err := dec.Read()
+	if err != nil {
+		return nil, fmt.Errorf("patrons: %v", err)
+	}
+	col, branchCol := -1, -1
+	for i, name := range header {
+		switch name {
+		case "userid":
+			col = i
+		case "branchcode":
+			branchCol = i
+		}
+	}
+	if col == -1 {
+		return nil, errors.New("patrons: no userid column")
+	}
+	borrowers := make(map[string]string)
+	for {
+		row, err := dec.Read()
+		if err == io.EOF {
+			return borrowers, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("patrons: %v", err)
+		}
+		if branchCol != -1 {
+			borrowers[row[col]] = row[branchCol]
+		} else {
+			borrowers[row[col]] = ""
+		}
+	}
+}
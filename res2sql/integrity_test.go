@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/boutros/marc"
+)
+
+func TestIntegrity(t *testing.T) {
+	f, err := ioutil.TempFile("", "res2sql-catalogue-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	enc := marc.NewEncoder(f, marc.MARC)
+	for _, rec := range []*marc.Record{
+		{
+			Leader:     "00000cam  2200000   4500",
+			CtrlFields: marc.CFields{{Tag: "001", Value: "0000001"}},
+			DataFields: marc.DFields{{Tag: "952", Ind1: " ", Ind2: " ", SubFields: marc.SubFields{{Code: "p", Value: "03010000001001"}}}},
+		},
+		{
+			Leader:     "00000cam  2200000   4500",
+			CtrlFields: marc.CFields{{Tag: "001", Value: "0000002"}},
+		},
+	} {
+		if err := enc.Encode(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	enc.Flush()
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	titles, err := loadCatalogue(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(titles) != 2 || !titles["1"]["03010000001001"] || len(titles["2"]) != 0 {
+		t.Fatalf("got catalogue %v", titles)
+	}
+
+	borrowers, err := loadPatrons(strings.NewReader("cardnumber,surname,userid\nN001,Testesen,10\nN002,Testesen,11\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadPatrons(strings.NewReader("cardnumber,surname\nN001,Testesen\n")); err == nil {
+		t.Error("got no error on patrons without userid column")
+	}
+
+	var report bytes.Buffer
+	c := newIntegrity(titles, borrowers, &report)
+	tests := []struct {
+		in   Reserves
+		want []string // borrowernumber:priority after prioritize
+	}{
+		{
+			in: Reserves{
+				{Biblionumber: "1", Borrowernumber: "10", Priority: 1},
+				{Biblionumber: "1", Borrowernumber: "12", Priority: 2}, // patron not migrated
+				{Biblionumber: "1", Borrowernumber: "11", Priority: 3, Barcode: "03010000001001"},
+				{Biblionumber: "1", Borrowernumber: "11", Priority: 4, Barcode: "03010000001002"}, // item not migrated
+			},
+			want: []string{"10:1", "11:2"},
+		},
+		{
+			in:   Reserves{{Biblionumber: "3", Borrowernumber: "10", Priority: 1}}, // title not migrated
+			want: nil,
+		},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, r := range prioritize(c.check(test.in)) {
+			got = append(got, r.Borrowernumber+":"+strconv.Itoa(r.Priority))
+		}
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("got %v; want %v", got, test.want)
+		}
+	}
+
+	var summary bytes.Buffer
+	if err := c.Flush(&summary); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Holds not migrated:\nitem not migrated\t1\npatron not migrated\t1\ntitle not migrated\t1\n"; summary.String() != want {
+		t.Errorf("got summary %q; want %q", summary.String(), want)
+	}
+	if want := "1,12,,,2,patron not migrated\n"; !strings.Contains(report.String(), want) {
+		t.Errorf("got report:\n%s\nwant it to contain %q", report.String(), want)
+	}
+}
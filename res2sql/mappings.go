@@ -0,0 +1,27 @@
+package main
+
+// defaultPickupConfig are the pickup branch rules applied unless -pickup is
+// given, see newPickupPolicy for the format. Holds to be picked up at automat
+// branches are picked up at the branch they belong to; holds at unknown
+// branches at the patron's home branch, if -patrons is given.
+const defaultPickupConfig = `# Bibliofil pickup branch	Koha pickup branch, or "home" for the patron's home branch
+# Automat-avdelinger:
+fboa	fbol
+ffua	ffur
+fgaa	fgam
+fgra	fgry
+fgrb	fgry
+fhoa	fhol
+flaa	flam
+flan	flam
+fmaa	fmaj
+fnya	fnyd
+fopa	fopp
+frma	frmm
+frob	froa
+ftoa	ftor
+hvma	hvmu
+hvua	hutl
+# Unknown branches:
+*	home
+`
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/template"
+)
+
+// holdWriter writes holds in one of the output formats.
+type holdWriter interface {
+	Write(r Reserve) error
+	Flush() error
+}
+
+// newHoldWriter returns a writer of holds to w in format: "sql" (MySQL
+// statements in a transaction), "csv", "jsonl" (JSON Lines, one hold per
+// line), or "restplan" (plans of Koha REST API calls, see holdRESTPlan).
+func newHoldWriter(format string, w io.Writer) (holdWriter, error) {
+	switch format {
+	case "sql":
+		if _, err := fmt.Fprintln(w, "START TRANSACTION;"); err != nil {
+			return nil, err
+		}
+		return sqlWriter{w: w, tmpl: template.Must(template.New("reserve").Funcs(template.FuncMap{"sql": sqlEscape}).Parse(sqlTmpl))}, nil
+	case "csv":
+		enc := csv.NewWriter(w)
+		if err := enc.Write(holdCSVHeader); err != nil {
+			return nil, err
+		}
+		return csvWriter{enc}, nil
+	case "jsonl":
+		return jsonWriter{enc: json.NewEncoder(w), payload: holdJSON}, nil
+	case "restplan":
+		return jsonWriter{enc: json.NewEncoder(w), payload: holdRESTPlan}, nil
+	}
+	return nil, fmt.Errorf("unknown format: %q", format)
+}
+
+type sqlWriter struct {
+	w    io.Writer
+	tmpl *template.Template
+}
+
+func (s sqlWriter) Write(r Reserve) error {
+	return s.tmpl.Execute(s.w, r)
+}
+
+func (s sqlWriter) Flush() error {
+	_, err := fmt.Fprintln(s.w, "COMMIT;")
+	return err
+}
+
+// holdCSVHeader are the columns of holds in CSV, as in the Koha reserves
+// table, except that patrons are given by userid (Bibliofil borrower number)
+// and items by barcode.
+var holdCSVHeader = []string{
+	"userid", "biblionumber", "barcode", "item_level_hold", "branchcode", "priority", "found",
+	"reservedate", "waitingdate", "expirationdate", "suspend", "suspend_until", "reservenotes",
+}
+
+type csvWriter struct {
+	enc *csv.Writer
+}
+
+func (c csvWriter) Write(r Reserve) error {
+	return c.enc.Write([]string{
+		r.Borrowernumber, r.Biblionumber, r.Barcode, boolInt(r.Barcode != ""), r.Branchcode, strconv.Itoa(r.Priority), r.Status,
+		r.ReserveDate, r.WaitingDate, r.ExpirationDate, boolInt(r.Suspend), r.SuspendUntil, r.Notes,
+	})
+}
+
+func (c csvWriter) Flush() error {
+	c.enc.Flush()
+	return c.enc.Error()
+}
+
+func boolInt(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// jsonWriter writes holds as JSON Lines, with the hold given as payload.
+type jsonWriter struct {
+	enc     *json.Encoder
+	payload func(r Reserve) interface{}
+}
+
+func (j jsonWriter) Write(r Reserve) error {
+	return j.enc.Encode(j.payload(r))
+}
+
+func (j jsonWriter) Flush() error {
+	return nil
+}
+
+// nullable returns nil for an empty string, to be encoded as JSON null.
+func nullable(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// holdJSON returns the hold with the columns of holdCSVHeader.
+func holdJSON(r Reserve) interface{} {
+	return map[string]interface{}{
+		"userid":          r.Borrowernumber,
+		"biblionumber":    json.Number(r.Biblionumber),
+		"barcode":         nullable(r.Barcode),
+		"item_level_hold": r.Barcode != "",
+		"branchcode":      r.Branchcode,
+		"priority":        r.Priority,
+		"found":           nullable(r.Status),
+		"reservedate":     r.ReserveDate,
+		"waitingdate":     nullable(r.WaitingDate),
+		"expirationdate":  nullable(r.ExpirationDate),
+		"suspend":         r.Suspend,
+		"suspend_until":   nullable(r.SuspendUntil),
+		"reservenotes":    nullable(r.Notes),
+	}
+}
+
+// holdRESTPlan returns a plan for creating the hold with the Koha REST API,
+// for a loader to carry out; it is not itself a request body. "body" is
+// POST /api/v1/holds without patron_id and item_id, which are Koha's internal
+// numbers: the loader looks up patron_id by "userid" and, for item-level
+// holds, item_id by "barcode", and adds them before posting. Priority and
+// suspension are set with further calls
+// (PUT /api/v1/holds/{hold_id}/priority, POST /api/v1/holds/{hold_id}/suspension),
+// and found holds are set waiting or in transit by checking in the item.
+func holdRESTPlan(r Reserve) interface{} {
+	body := map[string]interface{}{
+		"biblio_id":         json.Number(r.Biblionumber),
+		"pickup_library_id": r.Branchcode,
+		"expiration_date":   nullable(r.ExpirationDate),
+		"notes":             nullable(r.Notes),
+	}
+	res := map[string]interface{}{
+		"method":   "POST",
+		"path":     "/api/v1/holds",
+		"userid":   r.Borrowernumber,
+		"barcode":  nullable(r.Barcode),
+		"priority": r.Priority,
+		"found":    nullable(r.Status),
+		"body":     body,
+	}
+	if r.Suspend {
+		suspension := map[string]interface{}{}
+		if r.SuspendUntil != "" {
+			suspension["end_date"] = r.SuspendUntil
+		}
+		res["suspension"] = suspension
+	}
+	return res
+}
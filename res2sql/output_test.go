@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestHoldWriters(t *testing.T) {
+	holds := []Reserve{
+		{Borrowernumber: "10", Biblionumber: "100553", Priority: 0, Status: "W", ReserveDate: "2016-06-27", WaitingDate: "2016-08-15", ExpirationDate: "2016-08-24", Branchcode: "fsto", Barcode: "03010100553002"},
+		{Borrowernumber: "11", Biblionumber: "100553", Priority: 1, ReserveDate: "2016-06-28", Branchcode: "hutl", Suspend: true, SuspendUntil: "2016-09-01", Notes: `Ring, "før" henting`},
+	}
+	write := func(format string) string {
+		var b bytes.Buffer
+		w, err := newHoldWriter(format, &b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range holds {
+			if err := w.Write(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		return b.String()
+	}
+
+	if got := write("sql"); !strings.HasPrefix(got, "START TRANSACTION;\n") || !strings.HasSuffix(got, "COMMIT;\n") || strings.Count(got, "INSERT IGNORE INTO reserves") != 2 {
+		t.Errorf("got sql:\n%s", got)
+	}
+
+	want := `userid,biblionumber,barcode,item_level_hold,branchcode,priority,found,reservedate,waitingdate,expirationdate,suspend,suspend_until,reservenotes
+10,100553,03010100553002,1,fsto,0,W,2016-06-27,2016-08-15,2016-08-24,0,,
+11,100553,,0,hutl,1,,2016-06-28,,,1,2016-09-01,"Ring, ""før"" henting"
+`
+	if got := write("csv"); got != want {
+		t.Errorf("got csv:\n%s\nwant:\n%s", got, want)
+	}
+
+	lines := strings.Split(strings.TrimSpace(write("jsonl")), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d JSON lines; want 2", len(lines))
+	}
+	var hold map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[1]), &hold); err != nil {
+		t.Fatal(err)
+	}
+	if hold["biblionumber"] != 100553.0 || hold["barcode"] != nil || hold["item_level_hold"] != false || hold["suspend"] != true || hold["suspend_until"] != "2016-09-01" || hold["reservenotes"] != `Ring, "før" henting` {
+		t.Errorf("got json %s", lines[1])
+	}
+
+	lines = strings.Split(strings.TrimSpace(write("restplan")), "\n")
+	var payload struct {
+		Method, Path, Userid string
+		Barcode              *string
+		Priority             int
+		Body                 map[string]interface{}
+		Suspension           map[string]interface{}
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Method != "POST" || payload.Path != "/api/v1/holds" || payload.Userid != "10" || payload.Barcode == nil || *payload.Barcode != "03010100553002" ||
+		payload.Body["biblio_id"] != 100553.0 || payload.Body["pickup_library_id"] != "fsto" || payload.Body["expiration_date"] != "2016-08-24" || payload.Suspension != nil {
+		t.Errorf("got rest plan %s", lines[0])
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Priority != 1 || payload.Suspension["end_date"] != "2016-09-01" {
+		t.Errorf("got rest plan %s", lines[1])
+	}
+
+	if _, err := newHoldWriter("xml", &bytes.Buffer{}); err == nil {
+		t.Error("got no error on unknown format")
+	}
+}
+
+func TestSortedTitles(t *testing.T) {
+	all := map[string]Reserves{"100": nil, "99": nil, "1000": nil, "101": nil}
+	if got := strings.Join(sortedTitles(all), " "); got != "99 100 101 1000" {
+		t.Errorf("got %s; want 99 100 101 1000", got)
+	}
+}
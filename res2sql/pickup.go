@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const homeBranch = "home"
+
+// pickupPolicy sets the pickup branch of holds by configurable rules, and
+// recalculates the expiry of holds waiting on the shelf.
+type pickupPolicy struct {
+	rules     map[string]string // Bibliofil branch -> Koha branch or homeBranch
+	fallback  string            // rule for unknown branches; empty for ukjent
+	homes     map[string]string // userid -> home branch; nil if not known
+	shelfDays int               // days waiting holds expire after now; 0 to keep expiry
+	now       time.Time
+
+	report *csv.Writer
+	counts map[string]int // rule -> count
+}
+
+// newPickupPolicy parses the rules in config, one per line: a Bibliofil pickup
+// branch, or * for unknown branches, and the Koha branch holds to be picked
+// up there are picked up at, or "home" for the patron's home branch, separated
+// by tab. Branches without a rule are mapped by branchOldToNew. Rules to
+// "home" need the patrons' home branches in homes; without them, a * rule to
+// "home" is ignored, so that holds at unknown branches go to ukjent.
+func newPickupPolicy(config io.Reader, homes map[string]string, shelfDays int, now time.Time, report io.Writer) (*pickupPolicy, error) {
+	pp := &pickupPolicy{
+		rules:     make(map[string]string),
+		homes:     homes,
+		shelfDays: shelfDays,
+		now:       now,
+		report:    csv.NewWriter(report),
+		counts:    make(map[string]int),
+	}
+	scanner := bufio.NewScanner(config)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		cols := strings.Split(line, "\t")
+		if len(cols) != 2 {
+			return nil, fmt.Errorf("pickup config line %d: expected 2 tab-separated columns, got %d", n, len(cols))
+		}
+		from, to := strings.TrimSpace(cols[0]), strings.TrimSpace(cols[1])
+		if _, ok := branchCodes[to]; !ok && to != homeBranch {
+			return nil, fmt.Errorf("pickup config line %d: unknown branch: %q", n, to)
+		}
+		if to == homeBranch && homes == nil {
+			if from == "*" {
+				continue
+			}
+			return nil, fmt.Errorf("pickup config line %d: home branch rule needs the home branches of patrons, from -patrons", n)
+		}
+		if from == "*" {
+			pp.fallback = to
+			continue
+		}
+		pp.rules[from] = to
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	pp.report.Write([]string{"biblionumber", "borrowernumber", "status", "bibliofil branch", "branch", "rule"})
+	return pp, nil
+}
+
+// apply sets the pickup branch of the hold from its Bibliofil pickup branch,
+// and the expiry if it is waiting on the shelf.
+func (pp *pickupPolicy) apply(r *Reserve) {
+	from := r.Branchcode
+	to, rule := from, ""
+	if t, ok := pp.rules[from]; ok {
+		to, rule = t, "rule"
+	} else if t, ok := branchOldToNew[from]; ok {
+		to, rule = t, "renamed"
+	}
+	if _, ok := branchCodes[to]; !ok && to != homeBranch {
+		to, rule = pp.fallback, "unknown branch"
+	}
+	if to == homeBranch {
+		to = pp.homes[r.Borrowernumber]
+		if rule == "unknown branch" {
+			rule = "unknown branch, home branch"
+		} else {
+			rule = "home branch"
+		}
+	}
+	if _, ok := branchCodes[to]; !ok {
+		to, rule = "ukjent", "no pickup branch"
+	}
+	r.Branchcode = to
+	if to != from {
+		pp.counts[rule]++
+		pp.report.Write([]string{r.Biblionumber, r.Borrowernumber, r.Status, from, to, rule})
+	}
+
+	if pp.shelfDays > 0 && r.Status == "W" {
+		from := pp.now
+		if d, err := time.Parse(mysqlDateFormat, r.WaitingDate); err == nil && d.After(from) {
+			from = d
+		}
+		r.ExpirationDate = from.AddDate(0, 0, pp.shelfDays).Format(mysqlDateFormat)
+	}
+}
+
+// Flush writes any buffered report rows, and prints a summary to w.
+func (pp *pickupPolicy) Flush(w io.Writer) error {
+	pp.report.Flush()
+	rules := make([]string, 0, len(pp.counts))
+	for rule := range pp.counts {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	fmt.Fprintln(w, "Pickup branches changed:")
+	for _, rule := range rules {
+		fmt.Fprintf(w, "%s\t%d\n", rule, pp.counts[rule])
+	}
+	return pp.report.Error()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPickupPolicy(t *testing.T) {
+	now := time.Date(2016, 8, 19, 0, 0, 0, 0, time.UTC)
+	homes := map[string]string{"10": "fsto", "11": "xxxx"}
+	var report bytes.Buffer
+	pp, err := newPickupPolicy(strings.NewReader(defaultPickupConfig), homes, 0, now, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		branch, borrower string
+		want, rule       string
+	}{
+		{"fsto", "10", "fsto", ""},
+		{"fgaa", "10", "fgam", "rule"},
+		{"hvkr", "10", "hutl", "renamed"},
+		{"xxxx", "10", "fsto", "unknown branch, home branch"},
+		{"", "10", "fsto", "unknown branch, home branch"},
+		{"xxxx", "11", "ukjent", "no pickup branch"},
+		{"xxxx", "12", "ukjent", "no pickup branch"},
+	}
+	for _, test := range tests {
+		r := Reserve{Biblionumber: "1", Borrowernumber: test.borrower, Branchcode: test.branch}
+		pp.apply(&r)
+		if r.Branchcode != test.want {
+			t.Errorf("%q of borrower %s: got %q; want %q", test.branch, test.borrower, r.Branchcode, test.want)
+		}
+	}
+	var summary bytes.Buffer
+	if err := pp.Flush(&summary); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Pickup branches changed:\nno pickup branch\t2\nrenamed\t1\nrule\t1\nunknown branch, home branch\t2\n"; summary.String() != want {
+		t.Errorf("got summary %q; want %q", summary.String(), want)
+	}
+	if want := "1,10,,fgaa,fgam,rule\n"; !strings.Contains(report.String(), want) {
+		t.Errorf("got report:\n%s\nwant it to contain %q", report.String(), want)
+	}
+
+	// all holds to be picked up at home, and waiting holds expiring after a week
+	pp, err = newPickupPolicy(strings.NewReader("# comment\n*\thome\n"), homes, 7, now, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		in   Reserve
+		want Reserve
+	}{
+		{
+			Reserve{Borrowernumber: "10", Branchcode: "fgaa", Status: "W", WaitingDate: "2016-08-01", ExpirationDate: "2016-08-08"},
+			Reserve{Borrowernumber: "10", Branchcode: "fsto", Status: "W", WaitingDate: "2016-08-01", ExpirationDate: "2016-08-26"},
+		},
+		{
+			Reserve{Borrowernumber: "10", Branchcode: "hutl", Status: "W", WaitingDate: "2016-08-20", ExpirationDate: "2016-08-27"},
+			Reserve{Borrowernumber: "10", Branchcode: "hutl", Status: "W", WaitingDate: "2016-08-20", ExpirationDate: "2016-08-27"},
+		},
+		{
+			Reserve{Borrowernumber: "10", Branchcode: "hutl", Status: "T"},
+			Reserve{Borrowernumber: "10", Branchcode: "hutl", Status: "T"},
+		},
+	} {
+		got := test.in
+		pp.apply(&got)
+		if got != test.want {
+			t.Errorf("got %+v; want %+v", got, test.want)
+		}
+	}
+
+	// without home branches, the default rule for unknown branches is ignored
+	pp, err = newPickupPolicy(strings.NewReader(defaultPickupConfig), nil, 0, now, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for branch, want := range map[string]string{"fgaa": "fgam", "xxxx": "ukjent"} {
+		r := Reserve{Borrowernumber: "10", Branchcode: branch}
+		if pp.apply(&r); r.Branchcode != want {
+			t.Errorf("%q without home branches: got %q; want %q", branch, r.Branchcode, want)
+		}
+	}
+
+	for _, config := range []string{"fgaa\n", "fgaa\tnowhere\n", "fgaa\tfgam\tx\n", "fgaa\thome\n"} {
+		if _, err := newPickupPolicy(strings.NewReader(config), nil, 0, now, &bytes.Buffer{}); err == nil {
+			t.Errorf("%q: got no error", config)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// invalidField is the reason a hold record is rejected.
+type invalidField struct {
+	field  string
+	reason string
+}
+
+func (e invalidField) Error() string {
+	return e.field + ": " + e.reason
+}
+
+// rejects records hold records which cannot be migrated, with the raw record
+// and the reason, so that the rest of the holds can be migrated.
+type rejects struct {
+	max    int // abort when exceeded; negative for no limit
+	n      int
+	counts map[string]int // invalid field -> count
+	report *csv.Writer
+}
+
+func newRejects(report io.Writer, max int) *rejects {
+	r := &rejects{
+		max:    max,
+		counts: make(map[string]int),
+		report: csv.NewWriter(report),
+	}
+	r.report.Write([]string{"line", "error", "record"})
+	return r
+}
+
+// add records a rejected hold record. It returns an error when there are more
+// rejects than the threshold.
+func (r *rejects) add(line int, raw []byte, err error) error {
+	r.n++
+	if e, ok := err.(invalidField); ok {
+		r.counts[e.field]++
+	} else {
+		r.counts["malformed record"]++
+	}
+	r.report.Write([]string{strconv.Itoa(line), err.Error(), string(raw)})
+	if r.max >= 0 && r.n > r.max {
+		r.report.Flush()
+		return fmt.Errorf("too many rejected holds (more than %d); last: line %d: %v", r.max, line, err)
+	}
+	return nil
+}
+
+// Flush writes any buffered report rows, and prints a summary to w.
+func (r *rejects) Flush(w io.Writer) error {
+	r.report.Flush()
+	reasons := make([]string, 0, len(r.counts))
+	for reason := range r.counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	fmt.Fprintln(w, "Rejected holds:")
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "%s\t%d\n", reason, r.counts[reason])
+	}
+	return r.report.Error()
+}
+
+// rawRecords splits a dump into raw records, each ending with a line
+// starting with '^', so that a bad record does not affect the next.
+type rawRecords struct {
+	r    *bufio.Reader
+	line int // lines read
+}
+
+func newRawRecords(r io.Reader) *rawRecords {
+	return &rawRecords{r: bufio.NewReader(r)}
+}
+
+// Next returns the next raw record, and the line it starts at.
+func (rr *rawRecords) Next() ([]byte, int, error) {
+	start := rr.line + 1
+	var rec []byte
+	for {
+		l, err := rr.r.ReadBytes('\n')
+		if len(l) > 0 {
+			rr.line++
+			rec = append(rec, l...)
+			if l[0] == '^' {
+				return rec, start, nil
+			}
+		}
+		if err == io.EOF && len(bytes.TrimSpace(rec)) > 0 {
+			// last record without end of record marker
+			if rec[len(rec)-1] != '\n' {
+				rec = append(rec, '\n')
+			}
+			return rec, start, nil
+		}
+		if err != nil {
+			return nil, start, err
+		}
+	}
+}
+
+// decodeKV decodes a raw key-value record, turning a panic in the
+// decoder on malformed input into an error.
+func decodeKV(raw []byte) (rec map[string]string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed record: %v", r)
+		}
+	}()
+	return NewKVDecoder(bytes.NewReader(raw)).Decode()
+}
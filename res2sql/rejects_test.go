@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const badRes = `res_titnr |1|
+res_exnr |0|
+res_laanr |10|
+res_koenr |1|
+res_hentavd |hutl|
+res_stat ||
+res_dat |27/06/2016|
+res_forfall |00/00/0000|
+^
+res_titnr |2x|
+res_laanr |11|
+res_dat |27/06/2016|
+^
+res_titnr |1|
+res_exnr |998|
+res_laanr |12|
+^
+res_titnr |1|
+res_exnr |0|
+res_laanr |13|
+res_koenr |2|
+res_dat |32/06/2016|
+^
+res_titnr |1|
+res_exnr |0|
+res_laanr |14|
+res_koenr |3|
+res_hentavd |fsto|
+res_dat |28/06/2016|`
+
+func TestReadReserves(t *testing.T) {
+	now := time.Date(2016, 8, 19, 0, 0, 0, 0, time.UTC)
+	var report bytes.Buffer
+	rej := newRejects(&report, 2)
+	all, err := readReserves(newRawRecords(strings.NewReader(badRes)), now, 7, nil, rej)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || len(all["1"]) != 2 || all["1"][0].Borrowernumber != "10" || all["1"][1].Borrowernumber != "14" {
+		t.Errorf("got holds %+v; want holds of borrowers 10 and 14 on title 1", all)
+	}
+
+	var summary bytes.Buffer
+	if err := rej.Flush(&summary); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&report).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[1][0] != "10" || rows[1][1] != `res_titnr: not a number: "2x"` || rows[2][0] != "18" || !strings.HasPrefix(rows[2][2], "res_titnr |1|\n") {
+		t.Errorf("got rejects %q", rows)
+	}
+	if want := "Rejected holds:\nres_dat\t1\nres_titnr\t1\n"; summary.String() != want {
+		t.Errorf("got summary %q; want %q", summary.String(), want)
+	}
+
+	// exceeding the threshold aborts
+	rej = newRejects(&bytes.Buffer{}, 1)
+	if _, err := readReserves(newRawRecords(strings.NewReader(badRes)), now, 7, nil, rej); err == nil || !strings.Contains(err.Error(), "too many rejected holds") {
+		t.Errorf("got %v; want error when exceeding threshold", err)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bufio"
+	"encoding/csv"
 	"flag"
 	"fmt"
 	"io"
@@ -8,39 +10,33 @@ import (
 	"os"
 	"sort"
 	"strconv"
-	"text/template"
+	"strings"
 	"time"
 )
 
 const (
 	noDateFormat    = "02/01/2006"
 	mysqlDateFormat = "2006-01-02"
-	sqlTmpl         = `
-INSERT IGNORE INTO reserves
-  (borrowernumber, reservedate, biblionumber, branchcode, priority, found, expirationdate)
-SELECT borrowers.borrowernumber,
-       '{{.ReserveDate}}',
-       '{{.Biblionumber}}',
-       '{{.Branchcode}}',
-       '{{.Priority}}',
-       '{{.Status}}',
-       '{{.ExpirationDate}}'
-FROM borrowers JOIN biblio WHERE borrowers.userid='{{.Borrowernumber}}' AND biblio.biblionumber='{{.Biblionumber}}';
-`
+	noDate          = "00/00/0000"
 
-	sqlTmplWithEx = `
+	sqlTmpl = `
 INSERT IGNORE INTO reserves
-  (borrowernumber, reservedate, biblionumber, branchcode, priority, found, itemnumber, expirationdate)
+  (borrowernumber, reservedate, biblionumber, branchcode, priority, found, itemnumber, item_level_hold, waitingdate, expirationdate, suspend, suspend_until, reservenotes)
 SELECT borrowers.borrowernumber,
        '{{.ReserveDate}}',
        '{{.Biblionumber}}',
        '{{.Branchcode}}',
        '{{.Priority}}',
-       '{{.Status}}',
-       items.itemnumber,
-       '{{.ExpirationDate}}'
-FROM borrowers JOIN items JOIN biblio
-WHERE barcode='{{.Barcode}}' AND borrowers.userid='{{.Borrowernumber}}' AND biblio.biblionumber='{{.Biblionumber}}';
+       {{if .Status}}'{{.Status}}'{{else}}NULL{{end}},
+       {{if .Barcode}}items.itemnumber{{else}}NULL{{end}},
+       {{if .Barcode}}1{{else}}0{{end}},
+       {{if .WaitingDate}}'{{.WaitingDate}}'{{else}}NULL{{end}},
+       {{if .ExpirationDate}}'{{.ExpirationDate}}'{{else}}NULL{{end}},
+       {{if .Suspend}}1{{else}}0{{end}},
+       {{if .SuspendUntil}}'{{.SuspendUntil}} 00:00:00'{{else}}NULL{{end}},
+       {{if .Notes}}'{{sql .Notes}}'{{else}}NULL{{end}}
+FROM borrowers JOIN biblio{{if .Barcode}} JOIN items{{end}}
+WHERE {{if .Barcode}}barcode='{{.Barcode}}' AND {{end}}borrowers.userid='{{.Borrowernumber}}' AND biblio.biblionumber='{{.Biblionumber}}';
 `
 )
 
@@ -58,23 +54,6 @@ var (
 		"hvlr": "hutl",
 		"hvur": "hutl",
 		"info": "hutl",
-		// Automat-avdelinger:
-		"fboa": "fbol",
-		"ffua": "ffur",
-		"fgaa": "fgam",
-		"fgra": "fgry",
-		"fgrb": "frgy",
-		"fhoa": "fhol",
-		"flaa": "flam",
-		"flan": "flam",
-		"fmaa": "fmaj",
-		"fnya": "fnyd",
-		"fopa": "fopp",
-		"frma": "frmm",
-		"frob": "froa",
-		"ftoa": "ftor",
-		"hvma": "hvmu",
-		"hvua": "hutl",
 	}
 
 	// branchcode to label
@@ -113,133 +92,473 @@ func init() {
 	log.SetPrefix("res2sql: ")
 }
 
+// Reserve is a hold, with the columns of the Koha reserves table.
 type Reserve struct {
 	Borrowernumber string
 	Biblionumber   string
-	Priority       string
+	Priority       int
 	Exnr           string
-	Status         string
+	Status         string // W (waiting), T (in transit) or empty
 	ReserveDate    string
+	WaitingDate    string
 	ExpirationDate string
+	Suspend        bool
+	SuspendUntil   string
+	Notes          string
 	Branchcode     string
-	Barcode        string
+	Barcode        string // item-level hold if not empty
+
+	merged bool // borrower re-pointed from a merged duplicate patron
+}
+
+// found reports whether an item has been found for the hold, in which case
+// it is no longer in the queue and has priority 0 in Koha.
+func (r Reserve) found() bool {
+	return r.Status != ""
 }
 
 type Reserves []Reserve
 
-func (r Reserves) Len() int           { return len(r) }
-func (r Reserves) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
-func (r Reserves) Less(i, j int) bool { return mustInt(r[i].Priority) < mustInt(r[j].Priority) }
+func (r Reserves) Len() int      { return len(r) }
+func (r Reserves) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r Reserves) Less(i, j int) bool {
+	if r[i].found() != r[j].found() {
+		return r[i].found()
+	}
+	return r[i].Priority < r[j].Priority
+}
+
+// config is the configuration of a run, as given by the command line flags.
+type config struct {
+	res          string // res dump
+	borrowerMap  string // borrowermerge.csv from patronmassage
+	refDate      string
+	pickupDelay  int
+	rejects      string
+	maxRejects   int
+	catalogue    string // catalogue.mrc from catmassage
+	patrons      string // patrons.csv from patronmassage
+	unmigrated   string
+	pickup       string // pickup branch rules; built-in rules if empty
+	pickupReport string
+	shelfDays    int
+	format       string
+	out          string // stdout if empty
+}
 
 func main() {
-	resInput := flag.String("res", "", "res dump")
+	var cfg config
+	flag.StringVar(&cfg.res, "res", "", "res dump")
+	flag.StringVar(&cfg.borrowerMap, "borrowermap", "", "borrowermerge.csv from patronmassage, to re-point holds of merged duplicate patrons")
+	flag.StringVar(&cfg.refDate, "refdate", "", "date holds are suspended and expire relative to, YYYY-MM-DD (default: export timestamp in res dump filename)")
+	flag.IntVar(&cfg.pickupDelay, "pickupdelay", 7, "days a hold waits for pickup, to derive waitingdate from expiry if the arrival date is missing (Koha ReservesMaxPickUpDelay)")
+	flag.StringVar(&cfg.rejects, "rejects", "res_rejects.csv", "file to write invalid hold records to, with the reason")
+	flag.IntVar(&cfg.maxRejects, "maxrejects", 1000, "abort when more hold records than this are invalid (-1 = no limit)")
+	flag.StringVar(&cfg.catalogue, "catalogue", "", "catalogue.mrc from catmassage, to check that titles and items of holds are migrated")
+	flag.StringVar(&cfg.patrons, "patrons", "", "patrons.csv from patronmassage, to check that patrons of holds are migrated; needed by home branch pickup rules")
+	flag.StringVar(&cfg.unmigrated, "unmigrated", "res_unmigrated.csv", "file to report holds which will not migrate to (with -catalogue or -patrons)")
+	flag.StringVar(&cfg.pickup, "pickup", "", "pickup branch rules (default: built-in rules, see defaultPickupConfig)")
+	flag.StringVar(&cfg.pickupReport, "pickupreport", "res_pickup.csv", "file to report holds whose pickup branch was changed to")
+	flag.IntVar(&cfg.shelfDays, "shelfdays", 0, "waiting holds expire this many days after the reference date, or after they arrived if later (0 = keep expiry from Bibliofil)")
+	flag.StringVar(&cfg.format, "format", "sql", "output format: sql, csv, jsonl (JSON Lines) or restplan (Koha REST API calls, to be completed with internal patron and item ids)")
+	flag.StringVar(&cfg.out, "out", "", "file to write holds to (default stdout)")
 	flag.Parse()
 
-	if *resInput == "" {
-		flag.PrintDefaults()
+	if cfg.res == "" {
+		flag.Usage()
+		os.Exit(1)
 	}
+	if err := run(cfg); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	f, err := os.Open(*resInput)
+// run converts the holds of the res dump as configured, printing summaries
+// to stderr.
+func run(cfg config) error {
+	now, err := referenceDate(cfg.refDate, cfg.res)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	dec := NewKVDecoder(f)
+	f, err := os.Open(cfg.res)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-	noexTmpl := template.Must(template.New("noex").Parse(sqlTmpl))
-	exTmpl := template.Must(template.New("ex").Parse(sqlTmplWithEx))
+	out := io.Writer(os.Stdout)
+	if cfg.out != "" {
+		outF, err := os.Create(cfg.out)
+		if err != nil {
+			return err
+		}
+		defer outF.Close()
+		out = outF
+	}
+	bw := bufio.NewWriter(out)
+	w, err := newHoldWriter(cfg.format, bw)
+	if err != nil {
+		return err
+	}
 
-	all := make(map[string]Reserves) // map[biblionumber]reserves
-	for rec, err := dec.Decode(); err != io.EOF; rec, err = dec.Decode() {
+	var borrowers map[string]string
+	if cfg.patrons != "" {
+		patronsF, err := os.Open(cfg.patrons)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
+		borrowers, err = loadPatrons(patronsF)
+		if err != nil {
+			return err
+		}
+		patronsF.Close()
+	}
 
-		if rec["res_exnr"] == "998" {
-			// eksemplarnr 998 = innlån. Hopper over disse
-			continue
+	var pickupConfig io.Reader = strings.NewReader(defaultPickupConfig)
+	if cfg.pickup != "" {
+		pickupConfF, err := os.Open(cfg.pickup)
+		if err != nil {
+			return err
 		}
+		defer pickupConfF.Close()
+		pickupConfig = pickupConfF
+	}
+	pickupF, err := os.Create(cfg.pickupReport)
+	if err != nil {
+		return err
+	}
+	defer pickupF.Close()
+	pickup, err := newPickupPolicy(pickupConfig, borrowers, cfg.shelfDays, now, pickupF)
+	if err != nil {
+		return err
+	}
 
-		res := Reserve{
-			Biblionumber:   rec["res_titnr"],
-			Priority:       rec["res_koenr"],
-			Exnr:           rec["res_exnr"],
-			Branchcode:     rec["res_hentavd"],
-			Borrowernumber: rec["res_laanr"],
+	borrowerMap := make(map[string]string)
+	if cfg.borrowerMap != "" {
+		bMapF, err := os.Open(cfg.borrowerMap)
+		if err != nil {
+			return err
+		}
+		borrowerMap, err = loadBorrowerMap(bMapF)
+		if err != nil {
+			return err
 		}
+		bMapF.Close()
+	}
 
-		if res.Biblionumber == "" {
-			log.Println("missing biblionumber")
-			log.Printf("skipping record: %+v", rec)
-			continue
+	rejF, err := os.Create(cfg.rejects)
+	if err != nil {
+		return err
+	}
+	defer rejF.Close()
+	rej := newRejects(rejF, cfg.maxRejects)
+
+	all, err := readReserves(newRawRecords(f), now, cfg.pickupDelay, borrowerMap, rej)
+	if err != nil {
+		return err
+	}
+	if err := rej.Flush(os.Stderr); err != nil {
+		return err
+	}
+
+	if cfg.catalogue != "" || cfg.patrons != "" {
+		var titles map[string]map[string]bool
+		if cfg.catalogue != "" {
+			catF, err := os.Open(cfg.catalogue)
+			if err != nil {
+				return err
+			}
+			titles, err = loadCatalogue(catF)
+			if err != nil {
+				return err
+			}
+			catF.Close()
+		}
+		reportF, err := os.Create(cfg.unmigrated)
+		if err != nil {
+			return err
+		}
+		defer reportF.Close()
+		c := newIntegrity(titles, borrowers, reportF)
+		for biblionr := range all {
+			all[biblionr] = c.check(all[biblionr])
+		}
+		if err := c.Flush(os.Stderr); err != nil {
+			return err
 		}
+	}
 
-		// avdeling
-		if newBranch, ok := branchOldToNew[res.Branchcode]; ok {
-			res.Branchcode = newBranch
+	for _, reserves := range all {
+		for i := range reserves {
+			pickup.apply(&reserves[i])
 		}
-		if _, ok := branchCodes[res.Branchcode]; !ok {
-			res.Branchcode = "ukjent"
+	}
+	if err := pickup.Flush(os.Stderr); err != nil {
+		return err
+	}
+
+	for _, biblionr := range sortedTitles(all) {
+		for _, res := range prioritize(all[biblionr]) {
+			if err := w.Write(res); err != nil {
+				return err
+			}
 		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
 
-		// status
-		switch rec["res_stat"] {
-		case "i":
-			res.Status = "W" // hentehylle
-		case "y":
-			res.Status = "T" // på vei til henteavdeling
+// sortedTitles returns the title numbers of the holds in numerical order.
+func sortedTitles(all map[string]Reserves) []string {
+	titles := make([]string, 0, len(all))
+	for biblionr := range all {
+		titles = append(titles, biblionr)
+	}
+	sort.Slice(titles, func(i, j int) bool {
+		if len(titles[i]) != len(titles[j]) {
+			return len(titles[i]) < len(titles[j])
 		}
+		return titles[i] < titles[j]
+	})
+	return titles
+}
 
-		// reservedate
-		d, err := time.Parse(noDateFormat, rec["res_dat"])
+// readReserves reads the hold records, grouped by title. Invalid records are
+// given to rej; reading fails only on I/O errors, or too many rejects.
+func readReserves(rr *rawRecords, now time.Time, pickupDelay int, borrowerMap map[string]string, rej *rejects) (map[string]Reserves, error) {
+	all := make(map[string]Reserves) // map[biblionumber]reserves
+	for {
+		raw, line, err := rr.Next()
+		if err == io.EOF {
+			return all, nil
+		}
 		if err != nil {
-			log.Fatal(err) // TODO continue?
+			return nil, err
+		}
+		rec, err := decodeKV(raw)
+		if err == io.EOF {
+			continue
 		}
-		res.ReserveDate = d.Format(mysqlDateFormat)
 
-		// exiprationdate
-		if rec["res_forfall"] != "00/00/0000" {
-			d, err := time.Parse(noDateFormat, rec["res_forfall"])
-			if err != nil {
-				log.Println(err)
-				log.Printf("skipping record: %+v", rec)
-				continue
+		if strings.TrimSpace(rec["res_exnr"]) == "998" {
+			// eksemplarnr 998 = innlån. Hopper over disse
+			continue
+		}
+
+		var res Reserve
+		if err == nil {
+			res, err = parseReserve(rec, now, pickupDelay)
+		}
+		if err != nil {
+			if err := rej.add(line, raw, err); err != nil {
+				return nil, err
 			}
-			res.ExpirationDate = d.Format(mysqlDateFormat)
+			continue
 		}
 
-		// generate barcode where specific item is reserved
-		if res.Exnr != "0" {
-			res.Barcode = fmt.Sprintf("0301%07d%03d", mustInt(res.Biblionumber), mustInt(res.Exnr))
+		// duplicate patrons merged by patronmassage
+		if survivor, ok := borrowerMap[res.Borrowernumber]; ok {
+			res.Borrowernumber = survivor
+			res.merged = true
 		}
 
 		all[res.Biblionumber] = append(all[res.Biblionumber], res)
 	}
+}
 
-	fmt.Println("START TRANSACTION;")
+// parseReserve validates a Bibliofil hold record and maps it to a Koha hold,
+// keeping the Bibliofil pickup branch for pickupPolicy. A waiting hold gets
+// waitingdate from its arrival date, or else pickupDelay days before its
+// pickup expiry. Holds paused at the reference date now are
+// suspended, until the end of the pause if it has one; found holds cannot be
+// suspended in Koha. Found holds without a copy are invalid.
+func parseReserve(rec map[string]string, now time.Time, pickupDelay int) (Reserve, error) {
+	res := Reserve{
+		Branchcode: rec["res_hentavd"],
+		Notes:      strings.TrimSpace(rec["res_merknad"]),
+	}
 
-	for biblionr, _ := range all {
-		sort.Sort(all[biblionr])
-		for i, res := range all[biblionr] {
-			res.Priority = strconv.Itoa(i + 1)
-			t := noexTmpl // biblio-level reserve
-			if res.Barcode != "" {
-				// specific copy is reserved
-				t = exTmpl
-			}
-			if err := t.Execute(os.Stdout, res); err != nil {
-				log.Fatal(err)
-			}
+	titnr, err := parseNumber(rec, "res_titnr", true)
+	if err != nil {
+		return res, err
+	}
+	res.Biblionumber = strconv.Itoa(titnr)
+	lnr, err := parseNumber(rec, "res_laanr", true)
+	if err != nil {
+		return res, err
+	}
+	res.Borrowernumber = strconv.Itoa(lnr)
+	if res.Priority, err = parseNumber(rec, "res_koenr", true); err != nil {
+		return res, err
+	}
+	exnr, err := parseNumber(rec, "res_exnr", false)
+	if err != nil {
+		return res, err
+	}
+	res.Exnr = strconv.Itoa(exnr)
+
+	// status
+	switch rec["res_stat"] {
+	case "":
+	case "i":
+		res.Status = "W" // hentehylle
+	case "y":
+		res.Status = "T" // på vei til henteavdeling
+	default:
+		return res, invalidField{"res_stat", fmt.Sprintf("unknown status: %q", rec["res_stat"])}
+	}
+	if res.found() && exnr == 0 {
+		// a found hold is on the copy found for it
+		return res, invalidField{"res_exnr", "missing on found hold"}
+	}
+
+	// reservedate
+	d, err := parseDate(rec, "res_dat")
+	if err != nil {
+		return res, err
+	}
+	if d.IsZero() {
+		return res, invalidField{"res_dat", "missing"}
+	}
+	res.ReserveDate = d.Format(mysqlDateFormat)
+
+	// exiprationdate
+	expires, err := parseDate(rec, "res_forfall")
+	if err != nil {
+		return res, err
+	}
+	if !expires.IsZero() {
+		res.ExpirationDate = expires.Format(mysqlDateFormat)
+	}
+
+	// waitingdate
+	if res.Status == "W" {
+		arrived, err := parseDate(rec, "res_ankdat")
+		if err != nil {
+			return res, err
+		}
+		if arrived.IsZero() && !expires.IsZero() {
+			arrived = expires.AddDate(0, 0, -pickupDelay)
 		}
+		if !arrived.IsZero() {
+			res.WaitingDate = arrived.Format(mysqlDateFormat)
+		}
+	}
+
+	// suspension
+	from, err := parseDate(rec, "res_pausefra")
+	if err != nil {
+		return res, err
+	}
+	until, err := parseDate(rec, "res_pausetil")
+	if err != nil {
+		return res, err
+	}
+	if !res.found() && (!from.IsZero() || !until.IsZero()) && !from.After(now) {
+		switch {
+		case until.IsZero():
+			res.Suspend = true
+		case until.After(now):
+			res.Suspend = true
+			res.SuspendUntil = until.Format(mysqlDateFormat)
+		}
+	}
+
+	// generate barcode where specific item is reserved
+	if exnr != 0 {
+		res.Barcode = fmt.Sprintf("0301%07d%03d", titnr, exnr)
+	}
+
+	return res, nil
+}
+
+// parseNumber parses a non-negative number in field of rec, which is 0 if
+// the field is empty and not required.
+func parseNumber(rec map[string]string, field string, required bool) (int, error) {
+	s := strings.TrimSpace(rec[field])
+	if s == "" {
+		if required {
+			return 0, invalidField{field, "missing"}
+		}
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, invalidField{field, fmt.Sprintf("not a number: %q", s)}
+	}
+	return n, nil
+}
+
+// parseDate parses a Bibliofil date in field of rec, returning the zero time
+// if it is empty or 00/00/0000.
+func parseDate(rec map[string]string, field string) (time.Time, error) {
+	s := rec[field]
+	if s == "" || s == noDate {
+		return time.Time{}, nil
 	}
-	fmt.Println("COMMIT;")
+	d, err := time.Parse(noDateFormat, s)
+	if err != nil {
+		return d, invalidField{field, fmt.Sprintf("invalid date: %q", s)}
+	}
+	return d, nil
+}
 
+// prioritize orders the holds on a title as in Koha: found holds first with
+// priority 0, then the queue by Bibliofil priority, numbered from 1 without
+// gaps left by holds which are not migrated.
+func prioritize(reserves Reserves) Reserves {
+	sort.Stable(reserves)
+	reserves = dedupMerged(reserves)
+	prio := 0
+	for i := range reserves {
+		if reserves[i].found() {
+			reserves[i].Priority = 0
+			continue
+		}
+		prio++
+		reserves[i].Priority = prio
+	}
+	return reserves
 }
 
-func mustInt(s string) int {
-	i, err := strconv.Atoi(s)
+// dedupMerged keeps only the first hold of a patron on a title, if any of the patron's
+// holds was re-pointed from a merged duplicate patron. The reserves must be sorted by priority.
+func dedupMerged(reserves Reserves) Reserves {
+	res := reserves[:0]
+	seen := make(map[string]bool)       // borrowers with a hold
+	seenMerged := make(map[string]bool) // borrowers with a hold re-pointed from a duplicate
+	for _, r := range reserves {
+		if seen[r.Borrowernumber] && (r.merged || seenMerged[r.Borrowernumber]) {
+			continue
+		}
+		seen[r.Borrowernumber] = true
+		seenMerged[r.Borrowernumber] = r.merged
+		res = append(res, r)
+	}
+	return res
+}
+
+// loadBorrowerMap reads a CSV file of duplicate and surviving borrower numbers,
+// as written by patronmassage.
+func loadBorrowerMap(r io.Reader) (map[string]string, error) {
+	rows, err := csv.NewReader(r).ReadAll()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return i
+	res := make(map[string]string, len(rows))
+	for _, row := range rows {
+		if len(row) != 2 {
+			return nil, fmt.Errorf("borrower map: expected 2 columns, got %d", len(row))
+		}
+		res[row[0]] = row[1]
+	}
+	return res, nil
+}
+
+// sqlEscape escapes s for use in a single-quoted SQL string.
+func sqlEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
 }
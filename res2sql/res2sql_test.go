@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestParseReserve(t *testing.T) {
+	now := time.Date(2016, 8, 19, 7, 31, 0, 0, time.UTC)
+	base := map[string]string{
+		"res_titnr":   "100553",
+		"res_exnr":    "0",
+		"res_laanr":   "101546",
+		"res_koenr":   "1",
+		"res_hentavd": "fsto",
+		"res_stat":    "",
+		"res_dat":     "27/06/2016",
+		"res_forfall": "00/00/0000",
+	}
+	tests := []struct {
+		name string
+		rec  map[string]string // overrides base
+		want Reserve
+		err  bool
+	}{
+		{
+			name: "record-level hold in queue",
+			want: Reserve{Biblionumber: "100553", Priority: 1, Exnr: "0", Branchcode: "fsto", Borrowernumber: "101546", ReserveDate: "2016-06-27"},
+		},
+		{
+			name: "item-level hold",
+			rec:  map[string]string{"res_exnr": "2"},
+			want: Reserve{Biblionumber: "100553", Priority: 1, Exnr: "2", Branchcode: "fsto", Borrowernumber: "101546", ReserveDate: "2016-06-27", Barcode: "03010100553002"},
+		},
+		{
+			name: "waiting with arrival date",
+			rec:  map[string]string{"res_stat": "i", "res_exnr": "2", "res_forfall": "24/08/2016", "res_ankdat": "15/08/2016", "res_hentavd": "fgaa"},
+			want: Reserve{Biblionumber: "100553", Priority: 1, Exnr: "2", Branchcode: "fgaa", Borrowernumber: "101546", ReserveDate: "2016-06-27", Status: "W", WaitingDate: "2016-08-15", ExpirationDate: "2016-08-24", Barcode: "03010100553002"},
+		},
+		{
+			name: "waiting without arrival date",
+			rec:  map[string]string{"res_stat": "i", "res_exnr": "2", "res_forfall": "24/08/2016"},
+			want: Reserve{Biblionumber: "100553", Priority: 1, Exnr: "2", Branchcode: "fsto", Borrowernumber: "101546", ReserveDate: "2016-06-27", Status: "W", WaitingDate: "2016-08-17", ExpirationDate: "2016-08-24", Barcode: "03010100553002"},
+		},
+		{
+			name: "in transit",
+			rec:  map[string]string{"res_stat": "y", "res_exnr": "2", "res_hentavd": "xxxx"},
+			want: Reserve{Biblionumber: "100553", Priority: 1, Exnr: "2", Branchcode: "xxxx", Borrowernumber: "101546", ReserveDate: "2016-06-27", Status: "T", Barcode: "03010100553002"},
+		},
+		{
+			name: "paused until later",
+			rec:  map[string]string{"res_pausefra": "01/08/2016", "res_pausetil": "01/09/2016", "res_merknad": " Ring før henting "},
+			want: Reserve{Biblionumber: "100553", Priority: 1, Exnr: "0", Branchcode: "fsto", Borrowernumber: "101546", ReserveDate: "2016-06-27", Suspend: true, SuspendUntil: "2016-09-01", Notes: "Ring før henting"},
+		},
+		{
+			name: "paused indefinitely",
+			rec:  map[string]string{"res_pausefra": "01/08/2016", "res_pausetil": "00/00/0000"},
+			want: Reserve{Biblionumber: "100553", Priority: 1, Exnr: "0", Branchcode: "fsto", Borrowernumber: "101546", ReserveDate: "2016-06-27", Suspend: true},
+		},
+		{
+			name: "pause ended",
+			rec:  map[string]string{"res_pausefra": "01/07/2016", "res_pausetil": "01/08/2016"},
+			want: Reserve{Biblionumber: "100553", Priority: 1, Exnr: "0", Branchcode: "fsto", Borrowernumber: "101546", ReserveDate: "2016-06-27"},
+		},
+		{
+			name: "pause not started",
+			rec:  map[string]string{"res_pausefra": "01/09/2016", "res_pausetil": "01/10/2016"},
+			want: Reserve{Biblionumber: "100553", Priority: 1, Exnr: "0", Branchcode: "fsto", Borrowernumber: "101546", ReserveDate: "2016-06-27"},
+		},
+		{
+			name: "found holds are not suspended",
+			rec:  map[string]string{"res_stat": "y", "res_exnr": "2", "res_pausefra": "01/08/2016"},
+			want: Reserve{Biblionumber: "100553", Priority: 1, Exnr: "2", Branchcode: "fsto", Borrowernumber: "101546", ReserveDate: "2016-06-27", Status: "T", Barcode: "03010100553002"},
+		},
+		{
+			name: "numbers with spaces",
+			rec:  map[string]string{"res_titnr": " 100553", "res_laanr": "101546 ", "res_exnr": " 2 "},
+			want: Reserve{Biblionumber: "100553", Priority: 1, Exnr: "2", Branchcode: "fsto", Borrowernumber: "101546", ReserveDate: "2016-06-27", Barcode: "03010100553002"},
+		},
+		{
+			name: "waiting without item",
+			rec:  map[string]string{"res_stat": "i", "res_forfall": "24/08/2016"},
+			err:  true,
+		},
+		{
+			name: "in transit without item",
+			rec:  map[string]string{"res_stat": "y", "res_exnr": ""},
+			err:  true,
+		},
+		{
+			name: "missing biblionumber",
+			rec:  map[string]string{"res_titnr": ""},
+			err:  true,
+		},
+		{
+			name: "bad expiry date",
+			rec:  map[string]string{"res_forfall": "99/99/9999"},
+			err:  true,
+		},
+		{
+			name: "bad pause date",
+			rec:  map[string]string{"res_pausetil": "1. september"},
+			err:  true,
+		},
+		{
+			name: "non-numeric biblionumber",
+			rec:  map[string]string{"res_titnr": "1005x3"},
+			err:  true,
+		},
+		{
+			name: "non-numeric item number",
+			rec:  map[string]string{"res_exnr": "a"},
+			err:  true,
+		},
+		{
+			name: "non-numeric priority",
+			rec:  map[string]string{"res_koenr": "-1"},
+			err:  true,
+		},
+		{
+			name: "missing priority",
+			rec:  map[string]string{"res_koenr": ""},
+			err:  true,
+		},
+		{
+			name: "missing borrower",
+			rec:  map[string]string{"res_laanr": ""},
+			err:  true,
+		},
+		{
+			name: "bad reserve date",
+			rec:  map[string]string{"res_dat": "31/02/2016"},
+			err:  true,
+		},
+		{
+			name: "missing reserve date",
+			rec:  map[string]string{"res_dat": "00/00/0000"},
+			err:  true,
+		},
+		{
+			name: "unknown status",
+			rec:  map[string]string{"res_stat": "x"},
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		rec := make(map[string]string)
+		for k, v := range base {
+			rec[k] = v
+		}
+		for k, v := range test.rec {
+			rec[k] = v
+		}
+		got, err := parseReserve(rec, now, 7)
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if err == nil && got != test.want {
+			t.Errorf("%s:\ngot  %+v\nwant %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPrioritize(t *testing.T) {
+	tests := []struct {
+		name string
+		in   Reserves
+		want []string // borrowernumber:priority
+	}{
+		{
+			name: "queue renumbered from 1",
+			in:   Reserves{{Borrowernumber: "a", Priority: 3}, {Borrowernumber: "b", Priority: 5}, {Borrowernumber: "c", Priority: 4}},
+			want: []string{"a:1", "c:2", "b:3"},
+		},
+		{
+			name: "found holds have priority 0",
+			in: Reserves{
+				{Borrowernumber: "a", Priority: 2},
+				{Borrowernumber: "b", Priority: 1, Status: "W"},
+				{Borrowernumber: "c", Priority: 3},
+				{Borrowernumber: "d", Priority: 4, Status: "T"},
+			},
+			want: []string{"b:0", "d:0", "a:1", "c:2"},
+		},
+		{
+			name: "merged duplicate keeps found hold",
+			in: Reserves{
+				{Borrowernumber: "a", Priority: 1, Status: "W"},
+				{Borrowernumber: "b", Priority: 2},
+				{Borrowernumber: "a", Priority: 3, merged: true},
+			},
+			want: []string{"a:0", "b:1"},
+		},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, r := range prioritize(test.in) {
+			got = append(got, r.Borrowernumber+":"+strconv.Itoa(r.Priority))
+		}
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("%s: got %v; want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReserveSQL(t *testing.T) {
+	tmpl := template.Must(template.New("reserve").Funcs(template.FuncMap{"sql": sqlEscape}).Parse(sqlTmpl))
+	tests := []struct {
+		res      Reserve
+		contains []string
+	}{
+		{
+			Reserve{Borrowernumber: "1", Biblionumber: "2", Priority: 1, ReserveDate: "2016-06-27", Branchcode: "fsto"},
+			[]string{"NULL,\n       NULL,\n       0,\n       NULL,\n       NULL,\n       0,\n       NULL,\n       NULL\nFROM borrowers JOIN biblio\nWHERE borrowers.userid='1'"},
+		},
+		{
+			Reserve{Borrowernumber: "1", Biblionumber: "2", Priority: 0, Status: "W", WaitingDate: "2016-08-15", ExpirationDate: "2016-08-24", Barcode: "03010000002001", Notes: "Kari's"},
+			[]string{"'W',\n       items.itemnumber,\n       1,\n       '2016-08-15',\n       '2016-08-24',", `'Kari\'s'`, "JOIN biblio JOIN items\nWHERE barcode='03010000002001' AND"},
+		},
+		{
+			Reserve{Borrowernumber: "1", Biblionumber: "2", Priority: 1, Suspend: true, SuspendUntil: "2016-09-01"},
+			[]string{"1,\n       '2016-09-01 00:00:00',"},
+		},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, test.res); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range test.contains {
+			if !strings.Contains(b.String(), want) {
+				t.Errorf("got SQL:\n%s\nwant it to contain:\n%s", b.String(), want)
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	bmarc "github.com/boutros/marc"
+	"github.com/digibib/migtools/marcedit"
+	"github.com/knakk/kbp/marc"
+)
+
+// Fix applies fixes (see marcedit.ParseFixes) to a record, to be run before
+// Transform. The fixes work on the boutros/marc records of marcedit, so the
+// record is converted to one and back by line-marc.
+func Fix(from *marc.Record, fixes []*marcedit.Fix) (*marc.Record, error) {
+	if len(fixes) == 0 {
+		return from, nil
+	}
+	var b bytes.Buffer
+	enc := marc.NewEncoder(&b, marc.LineMARC)
+	if err := enc.Encode(from); err != nil {
+		return nil, err
+	}
+	enc.Flush()
+	rec, err := bmarc.NewDecoder(&b, bmarc.LineMARC).Decode()
+	if err != nil {
+		return nil, fmt.Errorf("fix: %v", err)
+	}
+
+	marcedit.ApplyFixes(rec, fixes)
+
+	b.Reset()
+	benc := bmarc.NewEncoder(&b, bmarc.LineMARC)
+	if err := benc.Encode(rec); err != nil {
+		return nil, err
+	}
+	benc.Flush()
+	recs, err := marc.NewDecoder(&b, marc.LineMARC).DecodeAll()
+	if err != nil {
+		return nil, fmt.Errorf("fix: %v", err)
+	}
+	if len(recs) != 1 {
+		return nil, fmt.Errorf("fix: got %d records back; want 1", len(recs))
+	}
+	return recs[0], nil
+}
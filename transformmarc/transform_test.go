@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 
+	"github.com/digibib/migtools/marcedit"
 	"github.com/knakk/kbp/marc"
 )
 
@@ -98,3 +100,33 @@ func TestTransformation(t *testing.T) {
 		}
 	}
 }
+
+func TestFix(t *testing.T) {
+	fixes, err := marcedit.ParseFixes(strings.NewReader("set\t019$s\t15\nremove\t690\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := mustDecode(`
+*000     n
+*00842536                 a          10bul
+*019  $s42
+*690  $aSorg
+^`)
+	want := mustDecode(`
+*000
+*008                                 1
+*041  $abul
+*385  $aVoksne
+*521  $a15
+^`)
+	fixed, err := Fix(from, fixes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := Transform(fixed); !got.Eq(want) {
+		t.Errorf("got:\n%v\nwant:\n%v\n", got, want)
+	}
+	if fixes[0].N != 1 || fixes[1].N != 1 {
+		t.Errorf("got changes %d, %d; want 1, 1", fixes[0].N, fixes[1].N)
+	}
+}
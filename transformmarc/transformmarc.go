@@ -1,12 +1,91 @@
+// transformmarc transforms the records of a marcdatabase to the fields
+// used by the catalogue, see Transform, dumping them to standard out in
+// line-marc.
+//
+// Fixes given by -fix (see marcedit.ParseFixes) are applied to the records
+// before they are transformed, with the number of changes of each fix
+// written to standard error.
 package main
 
 import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
 	"strings"
 
+	"github.com/digibib/migtools/marcedit"
 	"github.com/knakk/kbp/marc"
 	"github.com/knakk/kbp/marc/normarc"
 )
 
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("transformmarc: ")
+	fixFile := flag.String("fix", "", "fix file, applied before the records are transformed")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: transformmarc [flags] <marcdatabase>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var fixes []*marcedit.Fix
+	if *fixFile != "" {
+		var err error
+		if fixes, err = marcedit.LoadFixes(*fixFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	// Detect format
+	sniff := make([]byte, 64)
+	if _, err := f.Read(sniff); err != nil {
+		log.Fatal(err)
+	}
+	format := marc.DetectFormat(sniff)
+	switch format {
+	case marc.MARC, marc.LineMARC, marc.MARCXML:
+		break
+	default:
+		log.Fatal("Unknown MARC format")
+	}
+
+	// rewind reader
+	if _, err := f.Seek(0, 0); err != nil {
+		log.Fatal(err)
+	}
+
+	dec := marc.NewDecoder(f, format)
+	enc := marc.NewEncoder(os.Stdout, marc.LineMARC)
+	for rec, err := dec.Decode(); err != io.EOF; rec, err = dec.Decode() {
+		if err != nil {
+			log.Fatal(err)
+		}
+		if rec, err = Fix(rec, fixes); err != nil {
+			log.Fatal(err)
+		}
+		if err := enc.Encode(Transform(rec)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	enc.Flush()
+
+	if len(fixes) > 0 {
+		marcedit.WriteFixCounts(os.Stderr, fixes)
+	}
+}
+
 // value -> label mappings
 var (
 	audienceMapping = map[string]string{
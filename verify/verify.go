@@ -230,7 +230,7 @@ func main() {
 		{
 			Name:      "patrons",
 			Bibliofil: "ls -1 /data/*laaner.*.txt | xargs cat | grep ln_nr | wc -l",
-			Prepared:  "cat /out/patrons.csv | wc -l",
+			Prepared:  "tail -n+2 /out/patrons.csv | wc -l", // skip header row
 			Koha:      mysqlCount("SELECT count(*) FROM borrowers"),
 		},
 		{